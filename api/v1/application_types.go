@@ -20,6 +20,7 @@ import (
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
@@ -46,6 +47,92 @@ type ApplicationSpec struct {
 	// Foo string `json:"foo,omitempty"`
 	Deployment DeploymentTemplate `json:"deployment,omitempty"`
 	Service    ServiceTemplate    `json:"service,omitempty"`
+
+	// Components 多组件应用，每个组件单独生成一对名为 <app>-<component> 的 Deployment/Service
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	Components []ComponentSpec `json:"components,omitempty"`
+
+	// DependsOn 依赖的其他 Application，全部 Ready 之后才会创建或更新当前应用的工作负载
+	// +optional
+	DependsOn []ApplicationReference `json:"dependsOn,omitempty"`
+
+	// ResourceProfile 资源规格名称，为没有设置 requests/limits 的容器填充默认值
+	// 可以是内置的 small/medium/large，也可以是策略中定义的规格，为空时使用 namespace 上的注解
+	// +optional
+	ResourceProfile string `json:"resourceProfile,omitempty"`
+
+	// WorkloadKind 工作负载的类型，创建后不能修改，目前只支持 Deployment
+	// +kubebuilder:default=Deployment
+	// +optional
+	WorkloadKind WorkloadKind `json:"workloadKind,omitempty"`
+
+	// DeletionProtection 为 true 时 webhook 拒绝删除请求，除非带上确认删除的注解
+	// +optional
+	DeletionProtection bool `json:"deletionProtection,omitempty"`
+
+	// DriftPolicy 子资源被手工修改后的处理方式，默认 Enforce 恢复成期望的状态。
+	// Application 自身的修改总是会更新到子资源，不受这个字段影响
+	// +kubebuilder:default=Enforce
+	// +optional
+	DriftPolicy DriftPolicy `json:"driftPolicy,omitempty"`
+
+	// Adopt 为 true 时接管已经存在、没有其他 controller 的同名 Deployment/Service，
+	// 为 false 时只接管带有 apps.aloys.cn/adopt=<Application 名称> 注解的对象，其他情况记录 Conflict condition
+	// +optional
+	Adopt bool `json:"adopt,omitempty"`
+}
+
+// ApplicationReference points to another Application, possibly in another namespace.
+type ApplicationReference struct {
+	Name string `json:"name"`
+	// Namespace 为空时表示和当前 Application 在同一个 namespace
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// NamespacedName resolves the reference relative to the namespace of the referring Application.
+func (r ApplicationReference) NamespacedName(namespace string) types.NamespacedName {
+	if r.Namespace != "" {
+		namespace = r.Namespace
+	}
+	return types.NamespacedName{Namespace: namespace, Name: r.Name}
+}
+
+// WorkloadKind 工作负载的类型
+// +kubebuilder:validation:Enum=Deployment
+type WorkloadKind string
+
+const (
+	// WorkloadKindDeployment 使用 Deployment 运行工作负载
+	WorkloadKindDeployment WorkloadKind = "Deployment"
+)
+
+// DriftPolicy 子资源和期望的状态不一致时的处理方式
+// +kubebuilder:validation:Enum=Enforce;Report;Ignore
+type DriftPolicy string
+
+const (
+	// DriftPolicyEnforce 把子资源更新为期望的状态
+	DriftPolicyEnforce DriftPolicy = "Enforce"
+	// DriftPolicyReport 只记录 Drifted condition 和事件，不修改子资源
+	DriftPolicyReport DriftPolicy = "Report"
+	// DriftPolicyIgnore 不检查漂移
+	DriftPolicyIgnore DriftPolicy = "Ignore"
+)
+
+// ComponentSpec defines one component (frontend, api, worker...) of a multi-component Application.
+type ComponentSpec struct {
+	// Name is the component name, child objects are named <app>-<name>.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	// +kubebuilder:validation:MaxLength=40
+	Name string `json:"name"`
+	// Deployment 组件自己的 pod 模板和副本数
+	Deployment DeploymentTemplate `json:"deployment"`
+	// Service 可选，为空时不为该组件创建 Service
+	// +optional
+	Service *ServiceTemplate `json:"service,omitempty"`
 }
 
 // ApplicationStatus defines the observed state of Application.
@@ -55,12 +142,69 @@ type ApplicationStatus struct {
 	// Important: Run "make" to regenerate code after modifying this file
 	Workflow appsv1.DeploymentStatus `json:"workflow,omitempty"`
 	Network  corev1.ServiceStatus    `json:"network,omitempty"`
+
+	// Components 每个组件的状态
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	Components []ComponentStatus `json:"components,omitempty"`
+
+	// Conditions 记录 Application 的聚合状态，例如 Ready
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+	// Plan 预览模式下计算出的变更，这些变更没有写入集群
+	// +optional
+	Plan *PlanStatus `json:"plan,omitempty"`
+}
+
+// PlanStatus is the result of a dry-run reconcile.
+type PlanStatus struct {
+	// ObservedGeneration 计算变更时 Application 的 generation
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// Changes 关闭预览模式后会执行的变更，为空表示子资源已经是期望的状态
+	// +optional
+	Changes []PlannedChange `json:"changes,omitempty"`
+}
+
+// PlannedChange is a write the reconciler would make to a child object.
+type PlannedChange struct {
+	Action PlannedAction `json:"action"`
+	Kind   string        `json:"kind"`
+	Name   string        `json:"name"`
+	// Fields 需要修改的字段路径，创建时为空
+	// +optional
+	Fields []string `json:"fields,omitempty"`
+}
+
+// PlannedAction 对子资源执行的操作
+// +kubebuilder:validation:Enum=Create;Update;Delete
+type PlannedAction string
+
+const (
+	// PlannedActionCreate 子资源不存在，需要创建
+	PlannedActionCreate PlannedAction = "Create"
+	// PlannedActionUpdate 子资源和期望的状态不一致，需要更新
+	PlannedActionUpdate PlannedAction = "Update"
+	// PlannedActionDelete 子资源不再属于期望的状态，例如组件已经从 spec.components 中移除
+	PlannedActionDelete PlannedAction = "Delete"
+)
+
+// ComponentStatus defines the observed state of one component.
+type ComponentStatus struct {
+	Name     string                  `json:"name"`
+	Workflow appsv1.DeploymentStatus `json:"workflow,omitempty"`
+	// +optional
+	Network *corev1.ServiceStatus `json:"network,omitempty"`
 }
 
 // +kubebuilder:object:root=true
 // +kubebuilder:subresource:status
 // +kubebuilder:printcolumn:name="Replicas",type="integer",JSONPath=".spec.deployment.replicas"
 // +kubebuilder:printcolumn:name="UpdatedReplicas",type="string",JSONPath=".spec.deployment.replicas.updatedReplicas"
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type=='Ready')].status"
 // +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 // +kubebuilder:resource:path=applications,singular=application,scope=Namespaced,shortName=app
 // +kubebuilder:storageversion
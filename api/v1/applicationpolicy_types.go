@@ -0,0 +1,196 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ReplicasEnforcement 超过最大副本数时的处理方式
+// +kubebuilder:validation:Enum=Deny;Warn
+type ReplicasEnforcement string
+
+const (
+	// ReplicasEnforcementDeny 拒绝请求
+	ReplicasEnforcementDeny ReplicasEnforcement = "Deny"
+	// ReplicasEnforcementWarn 允许请求，但返回 admission warning
+	ReplicasEnforcementWarn ReplicasEnforcement = "Warn"
+)
+
+// ApplicationPolicySpec defines the guardrails the admission webhooks apply to Applications.
+// 平台团队通过策略资源调整校验和默认值，不需要重新编译 webhook
+type ApplicationPolicySpec struct {
+	// AllowedRegistries 允许使用的镜像仓库，可以是仓库地址或者带路径的前缀，为空表示不限制
+	// +optional
+	AllowedRegistries []string `json:"allowedRegistries,omitempty"`
+
+	// RequiredLabels Application 必须携带的标签
+	// +optional
+	RequiredLabels []string `json:"requiredLabels,omitempty"`
+
+	// MaxReplicas 每个工作负载允许的最大副本数
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	MaxReplicas *int32 `json:"maxReplicas,omitempty"`
+
+	// ReplicasEnforcement 超过 MaxReplicas 时拒绝还是只提示，默认 Deny
+	// +optional
+	ReplicasEnforcement ReplicasEnforcement `json:"replicasEnforcement,omitempty"`
+
+	// AllowedServiceTypes 允许使用的 Service 类型，为空表示不限制
+	// +optional
+	AllowedServiceTypes []corev1.ServiceType `json:"allowedServiceTypes,omitempty"`
+
+	// RequireResourceLimits 要求每个容器都设置 cpu 和 memory 的 limits
+	// +optional
+	RequireResourceLimits bool `json:"requireResourceLimits,omitempty"`
+
+	// Defaults 由 defaulting webhook 填充的默认值
+	// +optional
+	Defaults *PolicyDefaults `json:"defaults,omitempty"`
+
+	// Rules 使用 CEL 表达式描述的校验规则，self 表示整个 Application 对象
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	Rules []ValidationRule `json:"rules,omitempty"`
+
+	// ResourceProfiles 自定义的资源规格，和内置规格同名时覆盖内置规格
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	ResourceProfiles []ResourceProfile `json:"resourceProfiles,omitempty"`
+
+	// ResourceBudget namespace 内所有 Application 的 requests 总和（副本数 x 单个 pod 的 requests）的上限
+	// +optional
+	ResourceBudget corev1.ResourceList `json:"resourceBudget,omitempty"`
+}
+
+// ResourceProfile is a named set of requests and limits applied to containers that do not set them.
+type ResourceProfile struct {
+	// Name 规格名称，通过 spec.resourceProfile 或者 namespace 注解引用
+	Name string `json:"name"`
+
+	// Requests 容器没有设置时使用的 requests
+	// +optional
+	Requests corev1.ResourceList `json:"requests,omitempty"`
+
+	// Limits 容器没有设置时使用的 limits
+	// +optional
+	Limits corev1.ResourceList `json:"limits,omitempty"`
+}
+
+// RuleSeverity CEL 规则不满足时的处理方式
+// +kubebuilder:validation:Enum=Deny;Warn
+type RuleSeverity string
+
+const (
+	// RuleSeverityDeny 拒绝请求
+	RuleSeverityDeny RuleSeverity = "Deny"
+	// RuleSeverityWarn 允许请求，但返回 admission warning
+	RuleSeverityWarn RuleSeverity = "Warn"
+)
+
+// ValidationRule is a CEL expression evaluated against the Application, e.g.
+// self.spec.deployment.template.spec.containers.all(c, c.image.startsWith('registry.corp/')).
+type ValidationRule struct {
+	// Name 规则名称，在同一个策略内唯一
+	Name string `json:"name"`
+
+	// Expression 返回 bool 的 CEL 表达式，返回 false 表示违反规则
+	// +kubebuilder:validation:MinLength=1
+	Expression string `json:"expression"`
+
+	// Message 违反规则时返回给用户的信息，为空时使用表达式本身
+	// +optional
+	Message string `json:"message,omitempty"`
+
+	// Severity 违反规则时拒绝还是只提示，默认 Deny
+	// +optional
+	Severity RuleSeverity `json:"severity,omitempty"`
+}
+
+// PolicyDefaults holds the values the defaulting webhook fills in when the Application leaves them empty.
+type PolicyDefaults struct {
+	// Replicas 未指定副本数时的默认值
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// Labels 补充到 Application 上的标签，已有的标签不会被覆盖
+	// +optional
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// ServiceType 未指定 Service 类型时的默认值
+	// +optional
+	ServiceType corev1.ServiceType `json:"serviceType,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:path=applicationpolicies,singular=applicationpolicy,scope=Namespaced,shortName=apppol
+
+// ApplicationPolicy is the Schema for the applicationpolicies API.
+// 只作用于同一个 namespace 下的 Application
+type ApplicationPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ApplicationPolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ApplicationPolicyList contains a list of ApplicationPolicy.
+type ApplicationPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ApplicationPolicy `json:"items"`
+}
+
+// ClusterApplicationPolicySpec defines a policy applied to the Applications of every selected namespace.
+type ClusterApplicationPolicySpec struct {
+	ApplicationPolicySpec `json:",inline"`
+
+	// NamespaceSelector 选择策略生效的 namespace，为空时作用于所有 namespace
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:path=clusterapplicationpolicies,singular=clusterapplicationpolicy,scope=Cluster,shortName=capppol
+
+// ClusterApplicationPolicy is the Schema for the clusterapplicationpolicies API.
+type ClusterApplicationPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ClusterApplicationPolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ClusterApplicationPolicyList contains a list of ClusterApplicationPolicy.
+type ClusterApplicationPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterApplicationPolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&ApplicationPolicy{}, &ApplicationPolicyList{}, &ClusterApplicationPolicy{}, &ClusterApplicationPolicyList{})
+}
@@ -0,0 +1,403 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2
+
+import (
+	"encoding/json"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/conversion"
+
+	v1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+)
+
+// AnnotationV1Spec 保存 v2 无法表示的 v1 spec，转换回 v1 时用来恢复这些字段
+const AnnotationV1Spec = "apps.aloys.cn/v1-spec"
+
+var _ conversion.Convertible = &Application{}
+
+// ConvertTo converts this Application to the hub version (v1).
+func (src *Application) ConvertTo(dstRaw conversion.Hub) error {
+	dst, ok := dstRaw.(*v1.Application)
+	if !ok {
+		return fmt.Errorf("expected a v1 Application but got %T", dstRaw)
+	}
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	spec := convertSpecToV1(&src.Spec)
+
+	// 先恢复 v2 无法表示的字段，再用 v2 中的值覆盖，这样通过 v2 修改的字段同样生效
+	if data, ok := dst.Annotations[AnnotationV1Spec]; ok {
+		stashed := &v1.ApplicationSpec{}
+		if err := json.Unmarshal([]byte(data), stashed); err != nil {
+			return fmt.Errorf("invalid annotation %s: %w", AnnotationV1Spec, err)
+		}
+		spec = mergeSpec(stashed, spec)
+		delete(dst.Annotations, AnnotationV1Spec)
+	}
+	dst.Spec = *spec
+	dst.Status = convertStatusToV1(&src.Status)
+	return nil
+}
+
+// ConvertFrom converts from the hub version (v1) to this version.
+func (dst *Application) ConvertFrom(srcRaw conversion.Hub) error {
+	src, ok := srcRaw.(*v1.Application)
+	if !ok {
+		return fmt.Errorf("expected a v1 Application but got %T", srcRaw)
+	}
+	dst.ObjectMeta = *src.ObjectMeta.DeepCopy()
+	dst.Spec = convertSpecFromV1(&src.Spec)
+	dst.Status = convertStatusFromV1(&src.Status)
+
+	// 只有 v1 中存在 v2 无法表示的字段时才保存注解
+	if apiequality.Semantic.DeepEqual(convertSpecToV1(&dst.Spec), &src.Spec) {
+		delete(dst.Annotations, AnnotationV1Spec)
+		return nil
+	}
+	data, err := json.Marshal(&src.Spec)
+	if err != nil {
+		return err
+	}
+	if dst.Annotations == nil {
+		dst.Annotations = map[string]string{}
+	}
+	dst.Annotations[AnnotationV1Spec] = string(data)
+	return nil
+}
+
+func convertSpecToV1(in *ApplicationSpec) *v1.ApplicationSpec {
+	out := &v1.ApplicationSpec{
+		Deployment:         workloadToV1(in.Replicas, in.Selector, in.PodLabels, in.Containers),
+		Service:            v1.ServiceTemplate{ServiceSpec: exposeToV1(&in.Expose)},
+		ResourceProfile:    in.ResourceProfile,
+		WorkloadKind:       v1.WorkloadKind(in.WorkloadKind),
+		DeletionProtection: in.DeletionProtection,
+		DriftPolicy:        v1.DriftPolicy(in.DriftPolicy),
+		Adopt:              in.Adopt,
+	}
+	for i := range in.Components {
+		component := &in.Components[i]
+		converted := v1.ComponentSpec{
+			Name:       component.Name,
+			Deployment: workloadToV1(component.Replicas, component.Selector, component.PodLabels, component.Containers),
+		}
+		if component.Expose != nil {
+			converted.Service = &v1.ServiceTemplate{ServiceSpec: exposeToV1(component.Expose)}
+		}
+		out.Components = append(out.Components, converted)
+	}
+	for _, ref := range in.DependsOn {
+		out.DependsOn = append(out.DependsOn, v1.ApplicationReference{Name: ref.Name, Namespace: ref.Namespace})
+	}
+	return out
+}
+
+func convertSpecFromV1(in *v1.ApplicationSpec) ApplicationSpec {
+	out := ApplicationSpec{
+		Expose:             exposeFromV1(&in.Service.ServiceSpec),
+		ResourceProfile:    in.ResourceProfile,
+		WorkloadKind:       string(in.WorkloadKind),
+		DeletionProtection: in.DeletionProtection,
+		DriftPolicy:        string(in.DriftPolicy),
+		Adopt:              in.Adopt,
+	}
+	out.Replicas, out.Selector, out.PodLabels, out.Containers = workloadFromV1(&in.Deployment)
+	for i := range in.Components {
+		component := &in.Components[i]
+		converted := Component{Name: component.Name}
+		converted.Replicas, converted.Selector, converted.PodLabels, converted.Containers = workloadFromV1(&component.Deployment)
+		if component.Service != nil {
+			expose := exposeFromV1(&component.Service.ServiceSpec)
+			converted.Expose = &expose
+		}
+		out.Components = append(out.Components, converted)
+	}
+	for _, ref := range in.DependsOn {
+		out.DependsOn = append(out.DependsOn, ApplicationReference{Name: ref.Name, Namespace: ref.Namespace})
+	}
+	return out
+}
+
+func workloadToV1(replicas *int32, selector, podLabels map[string]string, containers []Container) v1.DeploymentTemplate {
+	out := v1.DeploymentTemplate{}
+	if replicas != nil {
+		r := *replicas
+		out.Replicas = &r
+	}
+	if len(selector) > 0 {
+		out.Selector = &metav1.LabelSelector{MatchLabels: copyMap(selector)}
+	}
+	out.Template.Labels = copyMap(podLabels)
+	for i := range containers {
+		out.Template.Spec.Containers = append(out.Template.Spec.Containers, containerToV1(&containers[i]))
+	}
+	return out
+}
+
+func workloadFromV1(in *v1.DeploymentTemplate) (*int32, map[string]string, map[string]string, []Container) {
+	var replicas *int32
+	if in.Replicas != nil {
+		r := *in.Replicas
+		replicas = &r
+	}
+	var selector map[string]string
+	if in.Selector != nil {
+		selector = copyMap(in.Selector.MatchLabels)
+	}
+	var containers []Container
+	for i := range in.Template.Spec.Containers {
+		containers = append(containers, containerFromV1(&in.Template.Spec.Containers[i]))
+	}
+	return replicas, selector, copyMap(in.Template.Labels), containers
+}
+
+func containerToV1(in *Container) corev1.Container {
+	c := in.DeepCopy()
+	out := corev1.Container{
+		Name:           c.Name,
+		Image:          c.Image,
+		Command:        c.Command,
+		Args:           c.Args,
+		Env:            c.Env,
+		Resources:      c.Resources,
+		ReadinessProbe: c.ReadinessProbe,
+		LivenessProbe:  c.LivenessProbe,
+	}
+	for _, p := range c.Ports {
+		out.Ports = append(out.Ports, corev1.ContainerPort{Name: p.Name, ContainerPort: p.ContainerPort, Protocol: p.Protocol})
+	}
+	return out
+}
+
+func containerFromV1(in *corev1.Container) Container {
+	c := in.DeepCopy()
+	out := Container{
+		Name:           c.Name,
+		Image:          c.Image,
+		Command:        c.Command,
+		Args:           c.Args,
+		Env:            c.Env,
+		Resources:      c.Resources,
+		ReadinessProbe: c.ReadinessProbe,
+		LivenessProbe:  c.LivenessProbe,
+	}
+	for _, p := range c.Ports {
+		out.Ports = append(out.Ports, ContainerPort{Name: p.Name, ContainerPort: p.ContainerPort, Protocol: p.Protocol})
+	}
+	return out
+}
+
+func exposeToV1(in *ExposeSpec) corev1.ServiceSpec {
+	out := corev1.ServiceSpec{Type: in.Type}
+	for _, p := range in.Ports {
+		out.Ports = append(out.Ports, corev1.ServicePort{
+			Name:       p.Name,
+			Protocol:   p.Protocol,
+			Port:       p.Port,
+			TargetPort: p.TargetPort,
+			NodePort:   p.NodePort,
+		})
+	}
+	return out
+}
+
+func exposeFromV1(in *corev1.ServiceSpec) ExposeSpec {
+	out := ExposeSpec{Type: in.Type}
+	for _, p := range in.Ports {
+		out.Ports = append(out.Ports, ServicePort{
+			Name:       p.Name,
+			Protocol:   p.Protocol,
+			Port:       p.Port,
+			TargetPort: p.TargetPort,
+			NodePort:   p.NodePort,
+		})
+	}
+	return out
+}
+
+// mergeSpec 以注解中保存的 spec 为基础，覆盖 v2 能够表示的字段
+func mergeSpec(stashed, converted *v1.ApplicationSpec) *v1.ApplicationSpec {
+	out := stashed.DeepCopy()
+	mergeWorkload(&out.Deployment, &converted.Deployment)
+	mergeService(&out.Service.ServiceSpec, &converted.Service.ServiceSpec)
+
+	components := make([]v1.ComponentSpec, 0, len(converted.Components))
+	for i := range converted.Components {
+		component := converted.Components[i]
+		base := findComponent(stashed.Components, i, component.Name)
+		if base == nil {
+			components = append(components, component)
+			continue
+		}
+		merged := *base.DeepCopy()
+		mergeWorkload(&merged.Deployment, &component.Deployment)
+		switch {
+		case component.Service == nil:
+			merged.Service = nil
+		case merged.Service == nil:
+			merged.Service = component.Service
+		default:
+			mergeService(&merged.Service.ServiceSpec, &component.Service.ServiceSpec)
+		}
+		components = append(components, merged)
+	}
+	out.Components = components
+	out.DependsOn = converted.DependsOn
+	out.ResourceProfile = converted.ResourceProfile
+	out.WorkloadKind = converted.WorkloadKind
+	out.DeletionProtection = converted.DeletionProtection
+	out.DriftPolicy = converted.DriftPolicy
+	out.Adopt = converted.Adopt
+	return out
+}
+
+func mergeWorkload(base, converted *v1.DeploymentTemplate) {
+	base.Replicas = converted.Replicas
+	switch {
+	case base.Selector == nil:
+		base.Selector = converted.Selector
+	case converted.Selector == nil:
+		// matchExpressions 等 v2 无法表示的部分保留
+		base.Selector.MatchLabels = nil
+	default:
+		base.Selector.MatchLabels = converted.Selector.MatchLabels
+	}
+	base.Template.Labels = converted.Template.Labels
+
+	containers := make([]corev1.Container, 0, len(converted.Template.Spec.Containers))
+	for i := range converted.Template.Spec.Containers {
+		c := converted.Template.Spec.Containers[i]
+		stashed := findContainer(base.Template.Spec.Containers, i, c.Name)
+		if stashed == nil {
+			containers = append(containers, c)
+			continue
+		}
+		merged := *stashed.DeepCopy()
+		merged.Image = c.Image
+		merged.Command = c.Command
+		merged.Args = c.Args
+		merged.Env = c.Env
+		merged.Resources = c.Resources
+		merged.ReadinessProbe = c.ReadinessProbe
+		merged.LivenessProbe = c.LivenessProbe
+		ports := make([]corev1.ContainerPort, 0, len(c.Ports))
+		for j, p := range c.Ports {
+			// hostPort/hostIP 只在端口没有变化时保留
+			if j < len(merged.Ports) && merged.Ports[j].ContainerPort == p.ContainerPort {
+				q := merged.Ports[j]
+				q.Name, q.Protocol = p.Name, p.Protocol
+				p = q
+			}
+			ports = append(ports, p)
+		}
+		merged.Ports = ports
+		containers = append(containers, merged)
+	}
+	base.Template.Spec.Containers = containers
+}
+
+func mergeService(base, converted *corev1.ServiceSpec) {
+	base.Type = converted.Type
+	ports := make([]corev1.ServicePort, 0, len(converted.Ports))
+	for i, p := range converted.Ports {
+		// appProtocol 只在端口没有变化时保留
+		if i < len(base.Ports) && base.Ports[i].Port == p.Port {
+			q := base.Ports[i]
+			q.Name, q.Protocol, q.TargetPort, q.NodePort = p.Name, p.Protocol, p.TargetPort, p.NodePort
+			p = q
+		}
+		ports = append(ports, p)
+	}
+	base.Ports = ports
+}
+
+// findComponent 优先使用相同位置的组件，名称不一致时再按名称查找
+func findComponent(components []v1.ComponentSpec, index int, name string) *v1.ComponentSpec {
+	if index < len(components) && components[index].Name == name {
+		return &components[index]
+	}
+	for i := range components {
+		if components[i].Name == name {
+			return &components[i]
+		}
+	}
+	return nil
+}
+
+func findContainer(containers []corev1.Container, index int, name string) *corev1.Container {
+	if index < len(containers) && containers[index].Name == name {
+		return &containers[index]
+	}
+	for i := range containers {
+		if containers[i].Name == name {
+			return &containers[i]
+		}
+	}
+	return nil
+}
+
+func convertStatusToV1(in *ApplicationStatus) v1.ApplicationStatus {
+	status := in.DeepCopy()
+	out := v1.ApplicationStatus{
+		Workflow:   status.Workflow,
+		Network:    status.Network,
+		Conditions: status.Conditions,
+	}
+	for _, c := range status.Components {
+		out.Components = append(out.Components, v1.ComponentStatus{Name: c.Name, Workflow: c.Workflow, Network: c.Network})
+	}
+	if status.Plan != nil {
+		out.Plan = &v1.PlanStatus{ObservedGeneration: status.Plan.ObservedGeneration}
+		for _, c := range status.Plan.Changes {
+			out.Plan.Changes = append(out.Plan.Changes, v1.PlannedChange{Action: v1.PlannedAction(c.Action), Kind: c.Kind, Name: c.Name, Fields: c.Fields})
+		}
+	}
+	return out
+}
+
+func convertStatusFromV1(in *v1.ApplicationStatus) ApplicationStatus {
+	status := in.DeepCopy()
+	out := ApplicationStatus{
+		Workflow:   status.Workflow,
+		Network:    status.Network,
+		Conditions: status.Conditions,
+	}
+	for _, c := range status.Components {
+		out.Components = append(out.Components, ComponentStatus{Name: c.Name, Workflow: c.Workflow, Network: c.Network})
+	}
+	if status.Plan != nil {
+		out.Plan = &PlanStatus{ObservedGeneration: status.Plan.ObservedGeneration}
+		for _, c := range status.Plan.Changes {
+			out.Plan.Changes = append(out.Plan.Changes, PlannedChange{Action: string(c.Action), Kind: c.Kind, Name: c.Name, Fields: c.Fields})
+		}
+	}
+	return out
+}
+
+func copyMap(in map[string]string) map[string]string {
+	if in == nil {
+		return nil
+	}
+	out := make(map[string]string, len(in))
+	for k, v := range in {
+		out[k] = v
+	}
+	return out
+}
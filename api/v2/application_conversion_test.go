@@ -0,0 +1,150 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	fuzz "github.com/google/gofuzz"
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+
+	v1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+)
+
+const fuzzIterations = 500
+
+// newFuzzer 随机生成的对象需要能够序列化成 JSON，这里替换掉 gofuzz 无法正确生成的类型
+func newFuzzer(seed int64) *fuzz.Fuzzer {
+	return fuzz.NewWithSeed(seed).NilChance(0.3).NumElements(0, 3).Funcs(
+		func(q *resource.Quantity, c fuzz.Continue) {
+			*q = *resource.NewMilliQuantity(c.Int63n(1000000), resource.DecimalSI)
+		},
+		func(v *intstr.IntOrString, c fuzz.Continue) {
+			if c.RandBool() {
+				*v = intstr.FromInt32(c.Int31n(65536))
+			} else {
+				*v = intstr.FromString(fmt.Sprintf("port-%d", c.Intn(100)))
+			}
+		},
+		func(t *metav1.Time, c fuzz.Continue) {
+			// JSON 只保留到秒
+			*t = metav1.Unix(c.Int63n(time.Now().Unix()), 0).Rfc3339Copy()
+		},
+		// apiVersion/kind 由 conversion webhook 设置
+		func(*metav1.TypeMeta, fuzz.Continue) {},
+		func(m *metav1.ObjectMeta, c fuzz.Continue) {
+			c.Fuzz(&m.Name)
+			c.Fuzz(&m.Namespace)
+			c.Fuzz(&m.Labels)
+			c.Fuzz(&m.Annotations)
+		},
+	)
+}
+
+func TestFuzzyConversionHubSpokeHub(t *testing.T) {
+	seed := time.Now().UnixNano()
+	f := newFuzzer(seed)
+	for i := 0; i < fuzzIterations; i++ {
+		hub := &v1.Application{}
+		f.Fuzz(hub)
+
+		spoke := &Application{}
+		if err := spoke.ConvertFrom(hub.DeepCopy()); err != nil {
+			t.Fatalf("seed %d: ConvertFrom failed: %v", seed, err)
+		}
+		restored := &v1.Application{}
+		if err := spoke.DeepCopy().ConvertTo(restored); err != nil {
+			t.Fatalf("seed %d: ConvertTo failed: %v", seed, err)
+		}
+		if !apiequality.Semantic.DeepEqual(hub, restored) {
+			t.Fatalf("seed %d: v1 -> v2 -> v1 lost data:\n%s", seed, cmp.Diff(hub, restored))
+		}
+	}
+}
+
+func TestFuzzyConversionSpokeHubSpoke(t *testing.T) {
+	seed := time.Now().UnixNano()
+	f := newFuzzer(seed)
+	for i := 0; i < fuzzIterations; i++ {
+		spoke := &Application{}
+		f.Fuzz(spoke)
+		// 注解由转换本身维护，不参与随机生成
+		delete(spoke.Annotations, AnnotationV1Spec)
+
+		hub := &v1.Application{}
+		if err := spoke.DeepCopy().ConvertTo(hub); err != nil {
+			t.Fatalf("seed %d: ConvertTo failed: %v", seed, err)
+		}
+		restored := &Application{}
+		if err := restored.ConvertFrom(hub); err != nil {
+			t.Fatalf("seed %d: ConvertFrom failed: %v", seed, err)
+		}
+		if !apiequality.Semantic.DeepEqual(spoke, restored) {
+			t.Fatalf("seed %d: v2 -> v1 -> v2 lost data:\n%s", seed, cmp.Diff(spoke, restored))
+		}
+	}
+}
+
+// TestConversionKeepsV2Changes 通过 v2 修改的字段要生效，同时保留 v2 无法表示的字段
+func TestConversionKeepsV2Changes(t *testing.T) {
+	hostPort := corev1.ContainerPort{ContainerPort: 80, HostPort: 8080}
+	hub := &v1.Application{
+		ObjectMeta: metav1.ObjectMeta{Name: "shop", Namespace: "default"},
+		Spec:       v1.ApplicationSpec{Deployment: v1.DeploymentTemplate{}},
+	}
+	hub.Spec.Deployment.MinReadySeconds = 10
+	hub.Spec.Deployment.Template.Spec.Volumes = []corev1.Volume{{Name: "data"}}
+	hub.Spec.Deployment.Template.Spec.Containers = []corev1.Container{{
+		Name:  "main",
+		Image: "nginx:1.26",
+		Ports: []corev1.ContainerPort{hostPort},
+	}}
+
+	spoke := &Application{}
+	if err := spoke.ConvertFrom(hub); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := spoke.Annotations[AnnotationV1Spec]; !ok {
+		t.Fatalf("expected annotation %s to keep fields v2 cannot represent", AnnotationV1Spec)
+	}
+	spoke.Spec.Containers[0].Image = "nginx:1.27"
+	two := int32(2)
+	spoke.Spec.Replicas = &two
+
+	restored := &v1.Application{}
+	if err := spoke.ConvertTo(restored); err != nil {
+		t.Fatal(err)
+	}
+	deployment := restored.Spec.Deployment
+	if deployment.Template.Spec.Containers[0].Image != "nginx:1.27" || *deployment.Replicas != 2 {
+		t.Errorf("changes made through v2 were lost: %+v", deployment)
+	}
+	if deployment.MinReadySeconds != 10 || len(deployment.Template.Spec.Volumes) != 1 ||
+		deployment.Template.Spec.Containers[0].Ports[0] != hostPort {
+		t.Errorf("fields v2 cannot represent were lost: %+v", deployment)
+	}
+	if _, ok := restored.Annotations[AnnotationV1Spec]; ok {
+		t.Errorf("annotation %s must not leak into v1", AnnotationV1Spec)
+	}
+}
@@ -0,0 +1,283 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v2
+
+import (
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// v2 不再内嵌完整的 DeploymentSpec/ServiceSpec，只暴露应用关心的字段
+// v1 中无法用 v2 表示的字段在转换时保存在注解里，不会丢失
+
+// ApplicationSpec defines the desired state of Application.
+type ApplicationSpec struct {
+	// Replicas 副本数
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// Selector pod 的选择器，同时作为 pod 的标签
+	// +optional
+	Selector map[string]string `json:"selector,omitempty"`
+
+	// PodLabels pod 模板上的标签
+	// +optional
+	PodLabels map[string]string `json:"podLabels,omitempty"`
+
+	// Containers 应用的容器
+	// +optional
+	Containers []Container `json:"containers,omitempty"`
+
+	// Expose 如何通过 Service 暴露应用
+	// +optional
+	Expose ExposeSpec `json:"expose,omitempty"`
+
+	// Components 多组件应用，每个组件单独生成一对名为 <app>-<component> 的 Deployment/Service
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	Components []Component `json:"components,omitempty"`
+
+	// DependsOn 依赖的其他 Application，全部 Ready 之后才会创建或更新当前应用的工作负载
+	// +optional
+	DependsOn []ApplicationReference `json:"dependsOn,omitempty"`
+
+	// ResourceProfile 资源规格名称，为没有设置 requests/limits 的容器填充默认值
+	// +optional
+	ResourceProfile string `json:"resourceProfile,omitempty"`
+
+	// WorkloadKind 工作负载的类型，创建后不能修改，目前只支持 Deployment
+	// +kubebuilder:validation:Enum=Deployment
+	// +kubebuilder:default=Deployment
+	// +optional
+	WorkloadKind string `json:"workloadKind,omitempty"`
+
+	// DeletionProtection 为 true 时 webhook 拒绝删除请求，除非带上确认删除的注解
+	// +optional
+	DeletionProtection bool `json:"deletionProtection,omitempty"`
+
+	// DriftPolicy 子资源被手工修改后的处理方式，默认 Enforce 恢复成期望的状态。
+	// Application 自身的修改总是会更新到子资源，不受这个字段影响
+	// +kubebuilder:validation:Enum=Enforce;Report;Ignore
+	// +kubebuilder:default=Enforce
+	// +optional
+	DriftPolicy string `json:"driftPolicy,omitempty"`
+
+	// Adopt 为 true 时接管已经存在、没有其他 controller 的同名 Deployment/Service，
+	// 为 false 时只接管带有 apps.aloys.cn/adopt=<Application 名称> 注解的对象，其他情况记录 Conflict condition
+	// +optional
+	Adopt bool `json:"adopt,omitempty"`
+}
+
+// Container is the opinionated subset of corev1.Container an Application needs.
+type Container struct {
+	// Name 容器名称
+	Name string `json:"name"`
+
+	// Image 容器镜像
+	Image string `json:"image,omitempty"`
+
+	// Command 覆盖镜像的 ENTRYPOINT
+	// +optional
+	Command []string `json:"command,omitempty"`
+
+	// Args 覆盖镜像的 CMD
+	// +optional
+	Args []string `json:"args,omitempty"`
+
+	// Ports 容器监听的端口
+	// +optional
+	Ports []ContainerPort `json:"ports,omitempty"`
+
+	// Env 环境变量
+	// +optional
+	Env []corev1.EnvVar `json:"env,omitempty"`
+
+	// Resources requests/limits
+	// +optional
+	Resources corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// ReadinessProbe 就绪探针
+	// +optional
+	ReadinessProbe *corev1.Probe `json:"readinessProbe,omitempty"`
+
+	// LivenessProbe 存活探针
+	// +optional
+	LivenessProbe *corev1.Probe `json:"livenessProbe,omitempty"`
+}
+
+// ContainerPort is a port the container listens on.
+type ContainerPort struct {
+	// Name 端口名称，可以被 Service 的 targetPort 引用
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// ContainerPort 容器端口
+	ContainerPort int32 `json:"containerPort"`
+
+	// Protocol 协议，默认 TCP
+	// +optional
+	Protocol corev1.Protocol `json:"protocol,omitempty"`
+}
+
+// ExposeSpec describes the Service created for a workload.
+type ExposeSpec struct {
+	// Type Service 类型，默认 ClusterIP
+	// +optional
+	Type corev1.ServiceType `json:"type,omitempty"`
+
+	// Ports Service 暴露的端口
+	// +optional
+	Ports []ServicePort `json:"ports,omitempty"`
+}
+
+// ServicePort is a port exposed by the Service.
+type ServicePort struct {
+	// Name 端口名称
+	// +optional
+	Name string `json:"name,omitempty"`
+
+	// Protocol 协议，默认 TCP
+	// +optional
+	Protocol corev1.Protocol `json:"protocol,omitempty"`
+
+	// Port Service 端口
+	Port int32 `json:"port"`
+
+	// TargetPort 容器端口或者端口名称，默认和 Port 相同
+	// +optional
+	TargetPort intstr.IntOrString `json:"targetPort,omitempty"`
+
+	// NodePort 类型为 NodePort 或 LoadBalancer 时使用的节点端口
+	// +optional
+	NodePort int32 `json:"nodePort,omitempty"`
+}
+
+// Component is a workload of a multi-component Application.
+type Component struct {
+	// Name is the component name, child objects are named <app>-<name>.
+	// +kubebuilder:validation:Pattern=`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`
+	// +kubebuilder:validation:MaxLength=40
+	Name string `json:"name"`
+
+	// Replicas 副本数
+	// +optional
+	Replicas *int32 `json:"replicas,omitempty"`
+
+	// Selector pod 的选择器
+	// +optional
+	Selector map[string]string `json:"selector,omitempty"`
+
+	// PodLabels pod 模板上的标签
+	// +optional
+	PodLabels map[string]string `json:"podLabels,omitempty"`
+
+	// Containers 组件的容器
+	// +optional
+	Containers []Container `json:"containers,omitempty"`
+
+	// Expose 可选，为空时不为该组件创建 Service
+	// +optional
+	Expose *ExposeSpec `json:"expose,omitempty"`
+}
+
+// ApplicationReference points to another Application.
+type ApplicationReference struct {
+	Name string `json:"name"`
+	// Namespace 为空时表示和当前 Application 在同一个 namespace
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// ApplicationStatus defines the observed state of Application.
+type ApplicationStatus struct {
+	Workflow appsv1.DeploymentStatus `json:"workflow,omitempty"`
+	Network  corev1.ServiceStatus    `json:"network,omitempty"`
+
+	// Components 每个组件的状态
+	// +optional
+	// +listType=map
+	// +listMapKey=name
+	Components []ComponentStatus `json:"components,omitempty"`
+
+	// Conditions 记录 Application 的聚合状态，例如 Ready
+	// +optional
+	// +listType=map
+	// +listMapKey=type
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// Plan 预览模式下计算出的变更，这些变更没有写入集群
+	// +optional
+	Plan *PlanStatus `json:"plan,omitempty"`
+}
+
+// PlanStatus is the result of a dry-run reconcile.
+type PlanStatus struct {
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// +optional
+	Changes []PlannedChange `json:"changes,omitempty"`
+}
+
+// PlannedChange is a write the reconciler would make to a child object.
+type PlannedChange struct {
+	// +kubebuilder:validation:Enum=Create;Update;Delete
+	Action string `json:"action"`
+	Kind   string `json:"kind"`
+	Name   string `json:"name"`
+	// +optional
+	Fields []string `json:"fields,omitempty"`
+}
+
+// ComponentStatus is the observed state of a component.
+type ComponentStatus struct {
+	Name     string                  `json:"name"`
+	Workflow appsv1.DeploymentStatus `json:"workflow,omitempty"`
+	// +optional
+	Network *corev1.ServiceStatus `json:"network,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Replicas",type="integer",JSONPath=".spec.replicas"
+// +kubebuilder:printcolumn:name="Ready",type="string",JSONPath=".status.conditions[?(@.type=='Ready')].status"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+// +kubebuilder:resource:path=applications,singular=application,scope=Namespaced,shortName=app
+
+// Application is the Schema for the applications API.
+type Application struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ApplicationSpec   `json:"spec,omitempty"`
+	Status ApplicationStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ApplicationList contains a list of Application.
+type ApplicationList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Application `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Application{}, &ApplicationList{})
+}
@@ -17,28 +17,46 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	appv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+	appv2 "github.com/aloys.zy/aloys-application-operator-webhook/api/v2"
 	ubzap "go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/filters"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 
+	"github.com/aloys.zy/aloys-application-operator-webhook/internal/certs"
+	"github.com/aloys.zy/aloys-application-operator-webhook/internal/config"
 	"github.com/aloys.zy/aloys-application-operator-webhook/internal/controller"
+	"github.com/aloys.zy/aloys-application-operator-webhook/internal/features"
+	"github.com/aloys.zy/aloys-application-operator-webhook/internal/health"
+	"github.com/aloys.zy/aloys-application-operator-webhook/internal/scope"
+	"github.com/aloys.zy/aloys-application-operator-webhook/internal/sharding"
 	webhookappsv1 "github.com/aloys.zy/aloys-application-operator-webhook/internal/webhook/v1"
 	// +kubebuilder:scaffold:imports
 )
@@ -50,37 +68,33 @@ var (
 	setupLog = ctrl.Log.WithName("setup")
 )
 
+// 和 config/default 中的 namePrefix 保持一致
+const (
+	mutatingWebhookConfigurationName   = "aloys-application-operator-webhook-mutating-webhook-configuration"
+	validatingWebhookConfigurationName = "aloys-application-operator-webhook-validating-webhook-configuration"
+	applicationCRDName                 = "applications.apps.aloys.cn"
+)
+
 func init() {
 	// Scheme 绑定内置资源
 	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	// 自己管理证书时需要把 CA bundle 写入 CRD 的 conversion webhook
+	utilruntime.Must(apiextensionsv1.AddToScheme(scheme))
 	// Scheme 绑定自建 CRD
 	utilruntime.Must(appv1.AddToScheme(scheme))
+	// v2 通过 conversion webhook 和存储版本 v1 互相转换
+	utilruntime.Must(appv2.AddToScheme(scheme))
 	// +kubebuilder:scaffold:scheme
 }
 
 func main() {
-	var metricsAddr string
-	var pprofAddr string
-	var probeAddr string
-	var webHookPort int
-	var secureMetrics bool
-	var enableHTTP2 bool
-	var enablePprof bool
-	var enableLeaderElection bool
+	var configFile string
 	var tlsOpts []func(*tls.Config)
-	flag.IntVar(&webHookPort, "webhook-bind-port", 9443, "bind port to webhook server. default is 9443")
-	flag.StringVar(&metricsAddr, "metrics-bind-address", "0", "The address the metrics endpoint binds to. "+
-		"Use :8443 for HTTPS or :8080 for HTTP, or leave as 0 to disable the metrics service.")
-	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
-	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
-		"Enable leader election for controller manager. "+
-			"Enabling this will ensure there is only one active controller manager.")
-	flag.BoolVar(&secureMetrics, "metrics-secure", true,
-		"If set, the metrics endpoint is served securely via HTTPS. Use --metrics-secure=false to use HTTP instead.")
-	flag.BoolVar(&enableHTTP2, "enable-http2", false,
-		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
-	flag.BoolVar(&enablePprof, "enable-pprof", false, "Enable pprof profiling")
-	flag.StringVar(&pprofAddr, "pprof-addr", "localhost:6060", "The address on which to expose the pprof handler")
+	// 参数的默认值来自配置的默认值，加载配置文件后再次解析参数，命令行参数优先于配置文件
+	cfg := config.New()
+	cfg.BindFlags(flag.CommandLine)
+	flag.StringVar(&configFile, "config", "",
+		"The path of a "+config.Kind+" file. Flags set on the command line override values from the file.")
 
 	// 定义自定义的 Zap 选项
 	opts := zap.Options{
@@ -128,8 +142,46 @@ func main() {
 	opts.BindFlags(flag.CommandLine)
 	// 解析命令行参数
 	flag.Parse()
+	if configFile != "" {
+		if err := cfg.LoadFile(configFile); err != nil {
+			// 日志还没有初始化
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		// 配置文件中的日志配置通过 --zap-* 参数生效，同样可以被命令行覆盖
+		if err := applyLoggingConfig(flag.CommandLine, cfg.Logging); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		flag.Parse()
+	}
+	cfg.Default()
 	// 应用自定义选项并设置全局日志记录器
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
+	if err := cfg.Validate(); err != nil {
+		setupLog.Error(err, "invalid configuration")
+		os.Exit(1)
+	}
+	if err := features.DefaultMutableFeatureGate.SetFromMap(cfg.FeatureGates); err != nil {
+		setupLog.Error(err, "invalid feature gates")
+		os.Exit(1)
+	}
+	features.RecordMetrics()
+	setupLog.Info("feature gates", "enabled", features.Status())
+	// 多个实例共用一个集群时，按 namespace 和标签划分各自负责的 Application
+	appScope, err := scope.New(cfg.Scope.Namespaces, cfg.Scope.NamespaceSelector, cfg.Scope.ApplicationSelector)
+	if err != nil {
+		setupLog.Error(err, "invalid scope")
+		os.Exit(1)
+	}
+	cacheOptions := appScope.CacheOptions()
+	if cfg.Admission.SidecarTemplateNamespace != "" {
+		// 只有 sidecar 模板会读取 ConfigMap，informer 只 watch 模板所在的 namespace，
+		// 避免缓存整个集群的 ConfigMap，模板所在的 namespace 也不一定在 watch 的范围内
+		cacheOptions.ByObject = map[client.Object]cache.ByObject{
+			&corev1.ConfigMap{}: {Namespaces: map[string]cache.Config{cfg.Admission.SidecarTemplateNamespace: {}}},
+		}
+	}
 
 	// if the enable-http2 flag is false (the default), http/2 should be disabled
 	// due to its vulnerabilities. More specifically, disabling http/2 will
@@ -142,20 +194,46 @@ func main() {
 		c.NextProtos = []string{"http/1.1"}
 	}
 
-	if !enableHTTP2 {
+	if !cfg.EnableHTTP2 {
 		tlsOpts = append(tlsOpts, disableHTTP2)
 	}
 
+	restConfig := ctrl.GetConfigOrDie()
+	enableWebhooks := cfg.Webhook.Enabled && os.Getenv("ENABLE_WEBHOOKS") != "false"
+	// webhook server 启动时证书文件必须已经存在，所以在创建 manager 之前先同步签发一次，再由 manager 定期轮换
+	var rotator *certs.Rotator
+	if cfg.Webhook.CertMode == config.CertModeSelfManaged && enableWebhooks {
+		rotator, err = newCertRotator(restConfig, cfg.Webhook)
+		if err != nil {
+			setupLog.Error(err, "unable to set up webhook certificate rotation")
+			os.Exit(1)
+		}
+		if err := rotator.EnsureCertificates(ctrl.LoggerInto(context.Background(), setupLog)); err != nil {
+			setupLog.Error(err, "unable to provision webhook certificates")
+			os.Exit(1)
+		}
+	}
+	// 证书更新后通过 certWatcher 重新加载，不需要重启
+	var certWatcher *certs.Watcher
+	webhookTLSOpts := tlsOpts
+	if enableWebhooks {
+		certWatcher, err = certs.NewWatcher(filepath.Join(cfg.Webhook.CertDir, cfg.Webhook.CertName),
+			filepath.Join(cfg.Webhook.CertDir, cfg.Webhook.KeyName))
+		if err != nil {
+			setupLog.Error(err, "unable to load webhook certificates", "dir", cfg.Webhook.CertDir)
+			os.Exit(1)
+		}
+		webhookTLSOpts = append(append([]func(*tls.Config){}, tlsOpts...), certWatcher.TLSOpt)
+	}
+
 	var webhookServer webhook.Server
-	// 修改配置，在这个基础上添加了环境变量的判断，这样在本地测试的时候传入变量即可
 	webhookServer = webhook.NewServer(webhook.Options{
-		Port: webHookPort, // 设置webhook服务监听端口，默认9443
-		// 获取证书位置,在本地测试使用
-		CertDir:  "./internal/webhook/certs",
-		CertName: "tls.crt",
-		KeyName:  "tls.key",
+		Port:     cfg.Webhook.Port, // 设置webhook服务监听端口，默认9443
+		CertDir:  cfg.Webhook.CertDir,
+		CertName: cfg.Webhook.CertName,
+		KeyName:  cfg.Webhook.KeyName,
 		// 默认配置
-		TLSOpts: tlsOpts,
+		TLSOpts: webhookTLSOpts,
 	})
 
 	// Metrics endpoint is enabled in 'config/default/kustomization.yaml'. The Metrics options configure the server.
@@ -163,12 +241,12 @@ func main() {
 	// - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.19.1/pkg/metrics/server
 	// - https://book.kubebuilder.io/reference/metrics.html
 	metricsServerOptions := metricsserver.Options{
-		BindAddress:   metricsAddr,
-		SecureServing: secureMetrics,
+		BindAddress:   cfg.Metrics.BindAddress,
+		SecureServing: cfg.Metrics.Secure,
 		TLSOpts:       tlsOpts,
 	}
 
-	if secureMetrics {
+	if cfg.Metrics.Secure {
 		// FilterProvider is used to protect the metrics endpoint with authn/authz.
 		// These configurations ensure that only authorized users and service accounts
 		// can access the metrics endpoint. The RBAC are configured in 'config/rbac/kustomization.yaml'. More info:
@@ -181,36 +259,74 @@ func main() {
 	}
 	// 计算 PprofBindAddress 的值
 	var pprofBindAddress string
-	if enablePprof && pprofAddr != "" && pprofAddr != ":0" {
-		pprofBindAddress = pprofAddr
+	if cfg.Pprof.Enabled && cfg.Pprof.BindAddress != "" && cfg.Pprof.BindAddress != ":0" {
+		pprofBindAddress = cfg.Pprof.BindAddress
 	} else {
 		pprofBindAddress = ""
 	}
 	// mgr基本配置
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	mgr, err := ctrl.NewManager(restConfig, ctrl.Options{
 		Scheme:                 scheme,
+		Cache:                  cacheOptions,
 		Metrics:                metricsServerOptions,
 		WebhookServer:          webhookServer,
-		HealthProbeBindAddress: probeAddr,
-		LeaderElection:         enableLeaderElection,
-		LeaderElectionID:       "db092cec.aloys.cn",
+		HealthProbeBindAddress: cfg.Health.ProbeBindAddress,
 		PprofBindAddress:       pprofBindAddress,
+		// 只有 controller 需要选主，webhook server、证书轮换和分片在每个副本上都会运行
+		LeaderElection:          cfg.LeaderElection.LeaderElect,
+		LeaderElectionID:        cfg.LeaderElection.ResourceName,
+		LeaderElectionNamespace: cfg.LeaderElection.ResourceNamespace,
+		LeaseDuration:           &cfg.LeaderElection.LeaseDuration.Duration,
+		RenewDeadline:           &cfg.LeaderElection.RenewDeadline.Duration,
+		RetryPeriod:             &cfg.LeaderElection.RetryPeriod.Duration,
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
 		// speeds up voluntary leader transitions as the new leader don't have to wait
 		// LeaseDuration time first.
 		//
-		// In the default scaffold provided, the program ends immediately after
-		// the manager stops, so would be fine to enable this option. However,
-		// if you are doing or is intended to do any operation such as perform cleanups
-		// after the manager stops then its usage might be unsafe.
-		// LeaderElectionReleaseOnCancel: true,
+		// main 在 manager 停止后立即退出，开启是安全的
+		LeaderElectionReleaseOnCancel: cfg.LeaderElection.ReleaseOnCancel,
 	})
 	if err != nil {
 		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
+	if rotator != nil {
+		if err := mgr.Add(rotator); err != nil {
+			setupLog.Error(err, "unable to add webhook certificate rotator")
+			os.Exit(1)
+		}
+	}
+	if certWatcher != nil {
+		if err := mgr.Add(certWatcher); err != nil {
+			setupLog.Error(err, "unable to add webhook certificate watcher")
+			os.Exit(1)
+		}
+	}
+	// 通过 application_operator_leader 指标区分 leader 和 standby 副本
+	if err := mgr.Add(&health.LeaderReporter{Elected: mgr.Elected()}); err != nil {
+		setupLog.Error(err, "unable to add leader reporter")
+		os.Exit(1)
+	}
+	var sharder *sharding.Sharder
+	if cfg.Sharding.Enabled {
+		sharder, err = newSharder(mgr, cfg.Sharding)
+		if err != nil {
+			setupLog.Error(err, "unable to set up sharding")
+			os.Exit(1)
+		}
+		if err := mgr.Add(sharder); err != nil {
+			setupLog.Error(err, "unable to add sharder")
+			os.Exit(1)
+		}
+		setupLog.Info("sharding enabled", "group", sharder.Group, "identity", sharder.Identity)
+	}
+	if cfg.Controller.DryRun {
+		setupLog.Info("dry run enabled, Deployments and Services will not be modified")
+	}
+	reconcileTracker := health.NewReconcileTracker()
+	controller.GenericRequeueDuration = cfg.Controller.RequeueInterval.Duration
 	// 注册controller
 	if err = (&controller.ApplicationReconciler{
 		// 将 Manager 的 Client 传给 AppReconciler， (r *AppReconciler) Reconciler方法就可以使用client
@@ -219,14 +335,37 @@ func main() {
 		Scheme: mgr.GetScheme(),
 		// 初始化事件方法
 		Recorder: mgr.GetEventRecorderFor("Application"),
+		Tracker:  reconcileTracker,
+		// 同时执行的最大调谐数量
+		MaxConcurrentReconciles: cfg.Controller.MaxConcurrentReconciles,
+		Scope:                   appScope,
+		Sharder:                 sharder,
+		DryRun:                  cfg.Controller.DryRun,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Application")
 		os.Exit(1)
 	}
 	// 注册webhook
 	// nolint:goconst
-	if os.Getenv("ENABLE_WEBHOOKS") != "false" {
-		if err = webhookappsv1.SetupApplicationWebhookWithManager(mgr); err != nil {
+	if enableWebhooks {
+		webhookOpts := webhookappsv1.Options{
+			DefaultReplicas:       int32(cfg.Admission.DefaultReplicas),
+			MaxReplicas:           int32(cfg.Admission.MaxReplicas),
+			AllowedRegistries:     cfg.Admission.AllowedRegistries,
+			ImageMirrors:          cfg.Admission.ImageMirrors,
+			SidecarNamespace:      cfg.Admission.SidecarTemplateNamespace,
+			MaxReplicaDropPercent: int32(cfg.Admission.MaxReplicaDropPercent),
+			Scope:                 appScope,
+		}
+		if imageDigestFile := cfg.Admission.ImageDigestFile; imageDigestFile != "" {
+			resolver, err := webhookappsv1.NewFileImageResolver(imageDigestFile)
+			if err != nil {
+				setupLog.Error(err, "unable to load image digests", "file", imageDigestFile)
+				os.Exit(1)
+			}
+			webhookOpts.ImageResolver = resolver
+		}
+		if err = webhookappsv1.SetupApplicationWebhookWithManager(mgr, webhookOpts); err != nil {
 			setupLog.Error(err, "unable to create webhook", "webhook", "Application")
 			os.Exit(1)
 		}
@@ -237,10 +376,37 @@ func main() {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
 	}
+	if timeout := cfg.Health.ReconcileStuckTimeout.Duration; timeout > 0 {
+		if err := mgr.AddHealthzCheck("reconcile", reconcileTracker.Checker(timeout)); err != nil {
+			setupLog.Error(err, "unable to set up reconcile health check")
+			os.Exit(1)
+		}
+	}
 	if err := mgr.AddReadyzCheck("readyz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	if err := mgr.AddReadyzCheck("informers", health.CacheSyncChecker(mgr.GetCache(), time.Second)); err != nil {
+		setupLog.Error(err, "unable to set up informer sync check")
+		os.Exit(1)
+	}
+	if cfg.Health.RequireLeader && cfg.LeaderElection.LeaderElect {
+		if err := mgr.AddReadyzCheck("leader", health.LeaderChecker(mgr.Elected())); err != nil {
+			setupLog.Error(err, "unable to set up leader check")
+			os.Exit(1)
+		}
+	}
+	if certWatcher != nil {
+		// 监听端口可以完成 TLS 握手，证书在有效期内
+		if err := mgr.AddReadyzCheck("webhook", mgr.GetWebhookServer().StartedChecker()); err != nil {
+			setupLog.Error(err, "unable to set up webhook server check")
+			os.Exit(1)
+		}
+		if err := mgr.AddReadyzCheck("webhook-cert", certWatcher.ExpiryChecker(cfg.Webhook.CertExpiryWindow.Duration)); err != nil {
+			setupLog.Error(err, "unable to set up webhook certificate check")
+			os.Exit(1)
+		}
+	}
 
 	setupLog.Info("starting manager")
 	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
@@ -248,3 +414,73 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// newCertRotator 在 manager 创建之前使用，这里使用直连 apiserver 的 client，也避免缓存集群中所有的 Secret
+func newCertRotator(restConfig *rest.Config, webhookConfig config.WebhookConfiguration) (*certs.Rotator, error) {
+	namespace, err := operatorNamespace()
+	if err != nil {
+		return nil, err
+	}
+	c, err := client.New(restConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, err
+	}
+	return &certs.Rotator{
+		Client:             c,
+		Secret:             types.NamespacedName{Namespace: namespace, Name: webhookConfig.CertSecretName},
+		CertDir:            webhookConfig.CertDir,
+		CertName:           webhookConfig.CertName,
+		KeyName:            webhookConfig.KeyName,
+		DNSNames:           certs.ServiceDNSNames(webhookConfig.ServiceName, namespace),
+		MutatingWebhooks:   []string{mutatingWebhookConfigurationName},
+		ValidatingWebhooks: []string{validatingWebhookConfigurationName},
+		CRDs:               []string{applicationCRDName},
+		RotateBefore:       webhookConfig.CertRotateBefore.Duration,
+	}, nil
+}
+
+// newSharder 每个副本使用 Pod 名称作为分片的标识，Lease 创建在 operator 所在的 namespace
+func newSharder(mgr ctrl.Manager, shardingConfig config.ShardingConfiguration) (*sharding.Sharder, error) {
+	namespace, err := operatorNamespace()
+	if err != nil {
+		return nil, err
+	}
+	identity, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("unable to determine the shard identity: %w", err)
+	}
+	// Lease 所在的 namespace 不一定在缓存的范围内，直接读取 apiserver
+	sharder := sharding.New(mgr.GetClient(), mgr.GetAPIReader(), namespace, shardingConfig.Group, identity)
+	sharder.LeaseDuration = shardingConfig.LeaseDuration.Duration
+	sharder.RenewInterval = shardingConfig.RenewInterval.Duration
+	return sharder, nil
+}
+
+// operatorNamespace 优先使用 POD_NAMESPACE 环境变量，否则读取 ServiceAccount 挂载的 namespace
+func operatorNamespace() (string, error) {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace, nil
+	}
+	data, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace")
+	if err != nil {
+		return "", fmt.Errorf("unable to determine the operator namespace, set POD_NAMESPACE: %w", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// applyLoggingConfig 把配置文件中的日志配置设置到对应的 --zap-* 参数上
+func applyLoggingConfig(fs *flag.FlagSet, logging config.LoggingConfiguration) error {
+	values := map[string]string{}
+	if logging.Level != "" {
+		values["zap-log-level"] = logging.Level
+	}
+	if logging.Development {
+		values["zap-devel"] = "true"
+	}
+	for name, value := range values {
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid logging configuration: %w", err)
+		}
+	}
+	return nil
+}
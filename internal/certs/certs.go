@@ -0,0 +1,177 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package certs generates and rotates the serving certificate of the webhook server.
+package certs
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"time"
+)
+
+// KeyPair PEM 编码的证书和私钥
+type KeyPair struct {
+	Cert []byte
+	Key  []byte
+}
+
+// GenerateCA 生成自签名的 CA
+func GenerateCA(commonName string, notBefore time.Time, validity time.Duration) (*KeyPair, error) {
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	return sign(template, nil)
+}
+
+// GenerateServingCert 使用 CA 签发 webhook 服务端证书，第一个 DNS 名称作为 CommonName
+func GenerateServingCert(ca *KeyPair, dnsNames []string, notBefore time.Time, validity time.Duration) (*KeyPair, error) {
+	if len(dnsNames) == 0 {
+		return nil, errors.New("at least one DNS name is required")
+	}
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:    dnsNames,
+		NotBefore:   notBefore,
+		NotAfter:    notBefore.Add(validity),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	return sign(template, ca)
+}
+
+// sign 生成新的私钥并签发证书，ca 为 nil 时自签名
+func sign(template *x509.Certificate, ca *KeyPair) (*KeyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serial
+
+	parent, signer := template, any(key)
+	if ca != nil {
+		if parent, err = ParseCertificate(ca.Cert); err != nil {
+			return nil, fmt.Errorf("invalid CA certificate: %w", err)
+		}
+		if signer, err = parsePrivateKey(ca.Key); err != nil {
+			return nil, fmt.Errorf("invalid CA key: %w", err)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{
+		Cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		Key:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
+
+// ParseCertificate 解析 PEM 中的第一个证书
+func ParseCertificate(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM encoded certificate found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func parsePrivateKey(data []byte) (any, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM encoded private key found")
+	}
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+}
+
+// needsRotation 证书无法解析、即将过期或者 DNS 名称不一致时需要重新签发
+func needsRotation(data []byte, dnsNames []string, now time.Time, rotateBefore time.Duration) bool {
+	cert, err := ParseCertificate(data)
+	if err != nil {
+		return true
+	}
+	if now.Add(rotateBefore).After(cert.NotAfter) {
+		return true
+	}
+	return dnsNames != nil && !slices.Equal(cert.DNSNames, dnsNames)
+}
+
+// verifiedBy 证书是否由 bundle 中的第一个（当前的）CA 签发
+func verifiedBy(certData, caData []byte, now time.Time) bool {
+	cert, err := ParseCertificate(certData)
+	if err != nil {
+		return false
+	}
+	ca, err := ParseCertificate(caData)
+	if err != nil {
+		return false
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	_, err = cert.Verify(x509.VerifyOptions{
+		Roots:       pool,
+		CurrentTime: now,
+		KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return err == nil
+}
+
+// caBundle 新 CA 在前，旧 bundle 中的第一个 CA 仍然有效时保留下来，
+// 避免轮换期间 apiserver 使用旧 bundle 或者 webhook 还在使用旧证书时校验失败
+func caBundle(current, previous []byte, now time.Time) []byte {
+	bundle := bytes.Clone(current)
+	block, _ := pem.Decode(previous)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return bundle
+	}
+	old := pem.EncodeToMemory(block)
+	if bytes.Equal(old, current) {
+		return bundle
+	}
+	if cert, err := x509.ParseCertificate(block.Bytes); err == nil && now.Before(cert.NotAfter) {
+		bundle = append(bundle, old...)
+	}
+	return bundle
+}
@@ -0,0 +1,322 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Secret 只在 operator 所在的 namespace 中读写，权限由 config/rbac/webhook_cert_role.yaml 中的 Role 授予，不放到 ClusterRole 中
+// +kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=mutatingwebhookconfigurations;validatingwebhookconfigurations,verbs=get;update
+// +kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get;update
+
+const (
+	// CACertKey Secret 中保存 CA bundle 的 key，轮换期间包含新旧两个 CA
+	CACertKey = "ca.crt"
+	// CAKeyKey Secret 中保存当前 CA 私钥的 key
+	CAKeyKey = "ca.key"
+
+	// DefaultCAValidity CA 的有效期
+	DefaultCAValidity = 10 * 365 * 24 * time.Hour
+	// DefaultCertValidity 服务端证书的有效期
+	DefaultCertValidity = 365 * 24 * time.Hour
+	// DefaultRotateBefore 距离过期不足这个时间时重新签发
+	DefaultRotateBefore = 30 * 24 * time.Hour
+	// DefaultCheckInterval 检查证书是否需要轮换的间隔
+	DefaultCheckInterval = time.Hour
+)
+
+// ServiceDNSNames webhook Service 在集群内的 DNS 名称
+func ServiceDNSNames(service, namespace string) []string {
+	return []string{
+		fmt.Sprintf("%s.%s.svc", service, namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", service, namespace),
+	}
+}
+
+// Rotator 自己管理 webhook 证书：CA 和服务端证书保存在 Secret 中供所有副本共用，
+// 写入证书目录给 webhook server 使用，并把 CA bundle 注入到 webhook 配置和 CRD 的 conversion webhook
+type Rotator struct {
+	// Client 需要在 manager 启动之前使用，不能是带缓存的 client
+	Client client.Client
+	// Secret 保存证书的 Secret
+	Secret types.NamespacedName
+	// CertDir webhook server 读取证书的目录
+	CertDir  string
+	CertName string
+	KeyName  string
+	// DNSNames 服务端证书的 DNS 名称，一般是 ServiceDNSNames 的结果
+	DNSNames []string
+	// MutatingWebhooks 和 ValidatingWebhooks 需要注入 CA bundle 的 webhook 配置名称
+	MutatingWebhooks   []string
+	ValidatingWebhooks []string
+	// CRDs 使用 conversion webhook 的 CRD 名称
+	CRDs []string
+
+	CAValidity    time.Duration
+	CertValidity  time.Duration
+	RotateBefore  time.Duration
+	CheckInterval time.Duration
+
+	// now 测试中替换当前时间
+	now func() time.Time
+}
+
+func (r *Rotator) setDefaults() {
+	if r.CertName == "" {
+		r.CertName = corev1.TLSCertKey
+	}
+	if r.KeyName == "" {
+		r.KeyName = corev1.TLSPrivateKeyKey
+	}
+	if r.CAValidity <= 0 {
+		r.CAValidity = DefaultCAValidity
+	}
+	if r.CertValidity <= 0 {
+		r.CertValidity = DefaultCertValidity
+	}
+	if r.RotateBefore <= 0 {
+		r.RotateBefore = DefaultRotateBefore
+	}
+	if r.CheckInterval <= 0 {
+		r.CheckInterval = DefaultCheckInterval
+	}
+	if r.now == nil {
+		r.now = time.Now
+	}
+}
+
+// Start 定期检查并轮换证书，实现 manager.Runnable
+func (r *Rotator) Start(ctx context.Context) error {
+	r.setDefaults()
+	logger := log.FromContext(ctx).WithName("cert-rotator")
+	ticker := time.NewTicker(r.CheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := r.EnsureCertificates(ctx); err != nil {
+				logger.Error(err, "unable to rotate webhook certificates")
+			}
+		}
+	}
+}
+
+// NeedLeaderElection 每个副本的 webhook server 都需要证书
+func (r *Rotator) NeedLeaderElection() bool {
+	return false
+}
+
+// EnsureCertificates 证书不存在或者即将过期时重新签发，然后同步到证书目录和 CA bundle。
+// 需要在 webhook server 启动之前调用一次，保证证书文件已经存在
+func (r *Rotator) EnsureCertificates(ctx context.Context) error {
+	r.setDefaults()
+	var secret *corev1.Secret
+	// 多个副本同时启动时只有一个能写入 Secret，其余的重新读取后使用它生成的证书
+	err := retry.OnError(retry.DefaultRetry, func(err error) bool {
+		return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+	}, func() error {
+		var err error
+		secret, err = r.reconcileSecret(ctx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("unable to reconcile secret %s: %w", r.Secret, err)
+	}
+	if err := r.writeCertDir(secret); err != nil {
+		return fmt.Errorf("unable to write certificates to %s: %w", r.CertDir, err)
+	}
+	return r.injectCABundle(ctx, secret.Data[CACertKey])
+}
+
+// reconcileSecret 读取 Secret，需要时重新签发 CA 或服务端证书并写回
+func (r *Rotator) reconcileSecret(ctx context.Context) (*corev1.Secret, error) {
+	logger := log.FromContext(ctx).WithName("cert-rotator")
+	now := r.now()
+	secret := &corev1.Secret{}
+	exists := true
+	if err := r.Client.Get(ctx, r.Secret, secret); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return nil, err
+		}
+		exists = false
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: r.Secret.Name, Namespace: r.Secret.Namespace},
+			Type:       corev1.SecretTypeTLS,
+		}
+	}
+	if secret.Data == nil {
+		secret.Data = map[string][]byte{}
+	}
+
+	ca := &KeyPair{Cert: secret.Data[CACertKey], Key: secret.Data[CAKeyKey]}
+	_, keyErr := parsePrivateKey(ca.Key)
+	changed := false
+	if keyErr != nil || needsRotation(ca.Cert, nil, now, r.RotateBefore) {
+		logger.Info("generating webhook CA", "secret", r.Secret)
+		newCA, err := GenerateCA("aloys-application-operator-webhook-ca", now, r.CAValidity)
+		if err != nil {
+			return nil, err
+		}
+		secret.Data[CACertKey] = caBundle(newCA.Cert, ca.Cert, now)
+		secret.Data[CAKeyKey] = newCA.Key
+		ca = &KeyPair{Cert: newCA.Cert, Key: newCA.Key}
+		changed = true
+	}
+	serving := secret.Data[corev1.TLSCertKey]
+	if changed || needsRotation(serving, r.DNSNames, now, r.RotateBefore) || !verifiedBy(serving, ca.Cert, now) {
+		logger.Info("generating webhook serving certificate", "secret", r.Secret, "dnsNames", r.DNSNames)
+		cert, err := GenerateServingCert(ca, r.DNSNames, now, r.CertValidity)
+		if err != nil {
+			return nil, err
+		}
+		secret.Data[corev1.TLSCertKey] = cert.Cert
+		secret.Data[corev1.TLSPrivateKeyKey] = cert.Key
+		changed = true
+	}
+
+	switch {
+	case !changed:
+		return secret, nil
+	case exists:
+		return secret, r.Client.Update(ctx, secret)
+	default:
+		return secret, r.Client.Create(ctx, secret)
+	}
+}
+
+// writeCertDir 内容有变化时才写入，先写私钥再写证书，webhook server 在证书变化时重新加载
+func (r *Rotator) writeCertDir(secret *corev1.Secret) error {
+	if err := os.MkdirAll(r.CertDir, 0o700); err != nil {
+		return err
+	}
+	if err := writeFileIfChanged(filepath.Join(r.CertDir, r.KeyName), secret.Data[corev1.TLSPrivateKeyKey], 0o600); err != nil {
+		return err
+	}
+	return writeFileIfChanged(filepath.Join(r.CertDir, r.CertName), secret.Data[corev1.TLSCertKey], 0o644)
+}
+
+// writeFileIfChanged 通过重命名替换文件，避免读取到写了一半的内容
+func writeFileIfChanged(path string, data []byte, perm os.FileMode) error {
+	if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, data) {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// injectCABundle 把 CA bundle 写入 webhook 配置和 CRD，对象不存在时跳过
+func (r *Rotator) injectCABundle(ctx context.Context, bundle []byte) error {
+	logger := log.FromContext(ctx).WithName("cert-rotator")
+	inject := func(obj client.Object, name string, update func() bool) error {
+		return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			if err := r.Client.Get(ctx, types.NamespacedName{Name: name}, obj); err != nil {
+				if apierrors.IsNotFound(err) {
+					logger.Info("skipping CA bundle injection, object not found", "kind", fmt.Sprintf("%T", obj), "name", name)
+					return nil
+				}
+				return err
+			}
+			if !update() {
+				return nil
+			}
+			return r.Client.Update(ctx, obj)
+		})
+	}
+
+	for _, name := range r.MutatingWebhooks {
+		config := &admissionregistrationv1.MutatingWebhookConfiguration{}
+		err := inject(config, name, func() bool {
+			changed := false
+			for i := range config.Webhooks {
+				changed = setCABundle(&config.Webhooks[i].ClientConfig.CABundle, bundle) || changed
+			}
+			return changed
+		})
+		if err != nil {
+			return fmt.Errorf("unable to inject CA bundle into MutatingWebhookConfiguration %s: %w", name, err)
+		}
+	}
+	for _, name := range r.ValidatingWebhooks {
+		config := &admissionregistrationv1.ValidatingWebhookConfiguration{}
+		err := inject(config, name, func() bool {
+			changed := false
+			for i := range config.Webhooks {
+				changed = setCABundle(&config.Webhooks[i].ClientConfig.CABundle, bundle) || changed
+			}
+			return changed
+		})
+		if err != nil {
+			return fmt.Errorf("unable to inject CA bundle into ValidatingWebhookConfiguration %s: %w", name, err)
+		}
+	}
+	for _, name := range r.CRDs {
+		crd := &apiextensionsv1.CustomResourceDefinition{}
+		err := inject(crd, name, func() bool {
+			conversion := crd.Spec.Conversion
+			if conversion == nil || conversion.Strategy != apiextensionsv1.WebhookConverter ||
+				conversion.Webhook == nil || conversion.Webhook.ClientConfig == nil {
+				return false
+			}
+			return setCABundle(&conversion.Webhook.ClientConfig.CABundle, bundle)
+		})
+		if err != nil {
+			return fmt.Errorf("unable to inject CA bundle into CustomResourceDefinition %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setCABundle(target *[]byte, bundle []byte) bool {
+	if bytes.Equal(*target, bundle) {
+		return false
+	}
+	*target = bytes.Clone(bundle)
+	return true
+}
@@ -0,0 +1,169 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	apiextensionsv1 "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("Rotator", func() {
+	var (
+		ctx     context.Context
+		c       client.Client
+		rotator *Rotator
+		now     time.Time
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		now = time.Now()
+		testScheme := runtime.NewScheme()
+		Expect(clientgoscheme.AddToScheme(testScheme)).To(Succeed())
+		Expect(apiextensionsv1.AddToScheme(testScheme)).To(Succeed())
+		c = fake.NewClientBuilder().WithScheme(testScheme).WithObjects(
+			&admissionregistrationv1.MutatingWebhookConfiguration{
+				ObjectMeta: metav1.ObjectMeta{Name: "mutating"},
+				Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "mapplication-v1.kb.io"}},
+			},
+			&admissionregistrationv1.ValidatingWebhookConfiguration{
+				ObjectMeta: metav1.ObjectMeta{Name: "validating"},
+				Webhooks:   []admissionregistrationv1.ValidatingWebhook{{Name: "vapplication-v1.kb.io"}},
+			},
+			&apiextensionsv1.CustomResourceDefinition{
+				ObjectMeta: metav1.ObjectMeta{Name: "applications.apps.aloys.cn"},
+				Spec: apiextensionsv1.CustomResourceDefinitionSpec{
+					Conversion: &apiextensionsv1.CustomResourceConversion{
+						Strategy: apiextensionsv1.WebhookConverter,
+						Webhook: &apiextensionsv1.WebhookConversion{
+							ClientConfig: &apiextensionsv1.WebhookClientConfig{},
+						},
+					},
+				},
+			},
+		).Build()
+		rotator = &Rotator{
+			Client:             c,
+			Secret:             types.NamespacedName{Namespace: "system", Name: "webhook-server-cert"},
+			CertDir:            GinkgoT().TempDir(),
+			DNSNames:           ServiceDNSNames("webhook-service", "system"),
+			MutatingWebhooks:   []string{"mutating"},
+			ValidatingWebhooks: []string{"validating", "missing"},
+			CRDs:               []string{"applications.apps.aloys.cn"},
+			now:                func() time.Time { return now },
+		}
+	})
+
+	getSecret := func() *corev1.Secret {
+		secret := &corev1.Secret{}
+		Expect(c.Get(ctx, rotator.Secret, secret)).To(Succeed())
+		return secret
+	}
+
+	It("should generate certificates and inject the CA bundle", func() {
+		Expect(rotator.EnsureCertificates(ctx)).To(Succeed())
+
+		secret := getSecret()
+		bundle := secret.Data[CACertKey]
+		Expect(verifiedBy(secret.Data[corev1.TLSCertKey], bundle, now)).To(BeTrue())
+		cert, err := ParseCertificate(secret.Data[corev1.TLSCertKey])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cert.DNSNames).To(Equal([]string{"webhook-service.system.svc", "webhook-service.system.svc.cluster.local"}))
+
+		certFile, err := os.ReadFile(filepath.Join(rotator.CertDir, "tls.crt"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(certFile).To(Equal(secret.Data[corev1.TLSCertKey]))
+		_, err = tls.LoadX509KeyPair(filepath.Join(rotator.CertDir, "tls.crt"), filepath.Join(rotator.CertDir, "tls.key"))
+		Expect(err).NotTo(HaveOccurred())
+
+		mutating := &admissionregistrationv1.MutatingWebhookConfiguration{}
+		Expect(c.Get(ctx, types.NamespacedName{Name: "mutating"}, mutating)).To(Succeed())
+		Expect(mutating.Webhooks[0].ClientConfig.CABundle).To(Equal(bundle))
+		validating := &admissionregistrationv1.ValidatingWebhookConfiguration{}
+		Expect(c.Get(ctx, types.NamespacedName{Name: "validating"}, validating)).To(Succeed())
+		Expect(validating.Webhooks[0].ClientConfig.CABundle).To(Equal(bundle))
+		crd := &apiextensionsv1.CustomResourceDefinition{}
+		Expect(c.Get(ctx, types.NamespacedName{Name: "applications.apps.aloys.cn"}, crd)).To(Succeed())
+		Expect(crd.Spec.Conversion.Webhook.ClientConfig.CABundle).To(Equal(bundle))
+	})
+
+	It("should keep valid certificates", func() {
+		Expect(rotator.EnsureCertificates(ctx)).To(Succeed())
+		before := getSecret()
+
+		now = now.Add(24 * time.Hour)
+		Expect(rotator.EnsureCertificates(ctx)).To(Succeed())
+		Expect(getSecret().Data).To(Equal(before.Data))
+	})
+
+	It("should renew the serving certificate before it expires", func() {
+		Expect(rotator.EnsureCertificates(ctx)).To(Succeed())
+		before := getSecret()
+
+		now = now.Add(DefaultCertValidity - DefaultRotateBefore + time.Hour)
+		Expect(rotator.EnsureCertificates(ctx)).To(Succeed())
+		after := getSecret()
+		Expect(after.Data[corev1.TLSCertKey]).NotTo(Equal(before.Data[corev1.TLSCertKey]))
+		Expect(after.Data[CACertKey]).To(Equal(before.Data[CACertKey]))
+		Expect(verifiedBy(after.Data[corev1.TLSCertKey], after.Data[CACertKey], now)).To(BeTrue())
+
+		certFile, err := os.ReadFile(filepath.Join(rotator.CertDir, "tls.crt"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(certFile).To(Equal(after.Data[corev1.TLSCertKey]))
+	})
+
+	It("should keep the previous CA in the bundle when the CA is rotated", func() {
+		Expect(rotator.EnsureCertificates(ctx)).To(Succeed())
+		oldCA := getSecret().Data[CACertKey]
+
+		now = now.Add(DefaultCAValidity - DefaultRotateBefore + time.Hour)
+		Expect(rotator.EnsureCertificates(ctx)).To(Succeed())
+		after := getSecret()
+		Expect(after.Data[CACertKey]).To(HaveSuffix(string(oldCA)))
+		Expect(len(after.Data[CACertKey])).To(BeNumerically(">", len(oldCA)))
+		Expect(verifiedBy(after.Data[corev1.TLSCertKey], after.Data[CACertKey], now)).To(BeTrue())
+
+		mutating := &admissionregistrationv1.MutatingWebhookConfiguration{}
+		Expect(c.Get(ctx, types.NamespacedName{Name: "mutating"}, mutating)).To(Succeed())
+		Expect(mutating.Webhooks[0].ClientConfig.CABundle).To(Equal(after.Data[CACertKey]))
+	})
+
+	It("should reissue the serving certificate when the DNS names change", func() {
+		Expect(rotator.EnsureCertificates(ctx)).To(Succeed())
+
+		rotator.DNSNames = ServiceDNSNames("webhook-service", "other")
+		Expect(rotator.EnsureCertificates(ctx)).To(Succeed())
+		cert, err := ParseCertificate(getSecret().Data[corev1.TLSCertKey])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(cert.DNSNames).To(Equal(rotator.DNSNames))
+	})
+})
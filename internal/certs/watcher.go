@@ -0,0 +1,114 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/certwatcher"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// certificateExpiry 当前使用的服务端证书的过期时间
+var certificateExpiry = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "webhook_serving_certificate_expiration_timestamp_seconds",
+	Help: "The expiration time of the serving certificate currently used by the webhook server, in seconds since the Unix epoch.",
+})
+
+func init() {
+	metrics.Registry.MustRegister(certificateExpiry)
+}
+
+// Watcher 监听证书目录中的文件，证书被 cert-manager 或 Rotator 更新后 webhook server 不需要重启就能使用新证书
+type Watcher struct {
+	*certwatcher.CertWatcher
+
+	mu       sync.RWMutex
+	notAfter time.Time
+	// now 测试中替换当前时间
+	now func() time.Time
+}
+
+// NewWatcher 立即加载一次证书，文件必须已经存在
+func NewWatcher(certPath, keyPath string) (*Watcher, error) {
+	cw, err := certwatcher.New(certPath, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	w := &Watcher{CertWatcher: cw, now: time.Now}
+	cw.RegisterCallback(w.update)
+	return w, nil
+}
+
+// TLSOpt 让 webhook server 从 Watcher 获取证书，而不是自己读取证书目录
+func (w *Watcher) TLSOpt(c *tls.Config) {
+	c.GetCertificate = w.GetCertificate
+}
+
+// NeedLeaderElection 每个副本的 webhook server 都需要重新加载证书
+func (w *Watcher) NeedLeaderElection() bool {
+	return false
+}
+
+func (w *Watcher) update(cert tls.Certificate) {
+	leaf := cert.Leaf
+	if leaf == nil && len(cert.Certificate) > 0 {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return
+		}
+	}
+	if leaf == nil {
+		return
+	}
+	w.mu.Lock()
+	w.notAfter = leaf.NotAfter
+	w.mu.Unlock()
+	certificateExpiry.Set(float64(leaf.NotAfter.Unix()))
+}
+
+// NotAfter 当前证书的过期时间
+func (w *Watcher) NotAfter() time.Time {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.notAfter
+}
+
+// ExpiryChecker 证书已经过期或者在 window 内过期时 readiness 检查失败
+func (w *Watcher) ExpiryChecker(window time.Duration) healthz.Checker {
+	return func(_ *http.Request) error {
+		notAfter := w.NotAfter()
+		if notAfter.IsZero() {
+			return fmt.Errorf("webhook serving certificate has not been loaded")
+		}
+		now := w.now()
+		if !now.Before(notAfter) {
+			return fmt.Errorf("webhook serving certificate expired at %s", notAfter.UTC().Format(time.RFC3339))
+		}
+		if now.Add(window).After(notAfter) {
+			return fmt.Errorf("webhook serving certificate expires at %s, within %s", notAfter.UTC().Format(time.RFC3339), window)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Watcher", func() {
+	var (
+		dir      string
+		now      time.Time
+		certPath string
+		keyPath  string
+	)
+
+	writeServingCert := func(validity time.Duration) *KeyPair {
+		ca, err := GenerateCA("test-ca", now, DefaultCAValidity)
+		Expect(err).NotTo(HaveOccurred())
+		cert, err := GenerateServingCert(ca, []string{"webhook-service.system.svc"}, now, validity)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(writeFileIfChanged(keyPath, cert.Key, 0o600)).To(Succeed())
+		Expect(writeFileIfChanged(certPath, cert.Cert, 0o644)).To(Succeed())
+		return cert
+	}
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		now = time.Now().Truncate(time.Second)
+		certPath = filepath.Join(dir, "tls.crt")
+		keyPath = filepath.Join(dir, "tls.key")
+	})
+
+	It("should fail to start without certificates", func() {
+		_, err := NewWatcher(certPath, keyPath)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("should report the expiry of the loaded certificate", func() {
+		writeServingCert(48 * time.Hour)
+		w, err := NewWatcher(certPath, keyPath)
+		Expect(err).NotTo(HaveOccurred())
+		w.now = func() time.Time { return now }
+
+		Expect(w.NotAfter()).To(BeTemporally("==", now.Add(48*time.Hour)))
+		Expect(testutil.ToFloat64(certificateExpiry)).To(Equal(float64(now.Add(48 * time.Hour).Unix())))
+		Expect(w.ExpiryChecker(24 * time.Hour)(nil)).To(Succeed())
+		Expect(w.ExpiryChecker(72 * time.Hour)(nil)).To(MatchError(ContainSubstring("within 72h0m0s")))
+
+		w.now = func() time.Time { return now.Add(49 * time.Hour) }
+		Expect(w.ExpiryChecker(0)(nil)).To(MatchError(ContainSubstring("expired at")))
+	})
+
+	It("should reload renewed certificates without restarting", func() {
+		writeServingCert(time.Hour)
+		w, err := NewWatcher(certPath, keyPath)
+		Expect(err).NotTo(HaveOccurred())
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			defer GinkgoRecover()
+			Expect(w.Start(ctx)).To(Succeed())
+		}()
+
+		renewed := writeServingCert(48 * time.Hour)
+		expected, err := tls.X509KeyPair(renewed.Cert, renewed.Key)
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(func() []byte {
+			cert, err := w.GetCertificate(nil)
+			if err != nil {
+				return nil
+			}
+			if !bytes.Equal(cert.Certificate[0], expected.Certificate[0]) {
+				// 监听在 Start 之后才生效，没有生效前写入的变化需要再触发一次
+				Expect(os.WriteFile(certPath, renewed.Cert, 0o644)).To(Succeed())
+			}
+			return cert.Certificate[0]
+		}).Should(Equal(expected.Certificate[0]))
+		Eventually(w.NotAfter).Should(BeTemporally("==", now.Add(48*time.Hour)))
+
+		config := &tls.Config{}
+		w.TLSOpt(config)
+		Expect(config.GetCertificate).NotTo(BeNil())
+	})
+})
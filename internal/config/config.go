@@ -0,0 +1,240 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/client-go/tools/leaderelection"
+	"sigs.k8s.io/yaml"
+
+	"github.com/aloys.zy/aloys-application-operator-webhook/internal/certs"
+	"github.com/aloys.zy/aloys-application-operator-webhook/internal/sharding"
+)
+
+// New 返回填充了默认值的配置，和各个参数的默认值一致
+func New() *Configuration {
+	return &Configuration{
+		TypeMeta: metav1.TypeMeta{APIVersion: APIVersion, Kind: Kind},
+		Metrics: MetricsConfiguration{
+			BindAddress: "0",
+			Secure:      true,
+		},
+		Health: HealthConfiguration{
+			ProbeBindAddress:      ":8081",
+			ReconcileStuckTimeout: metav1.Duration{Duration: 10 * time.Minute},
+		},
+		Webhook: WebhookConfiguration{
+			Enabled:          true,
+			Port:             9443,
+			CertMode:         CertModeSelfManaged,
+			CertName:         "tls.crt",
+			KeyName:          "tls.key",
+			ServiceName:      "aloys-application-operator-webhook-webhook-service",
+			CertSecretName:   "webhook-server-cert",
+			CertRotateBefore: metav1.Duration{Duration: certs.DefaultRotateBefore},
+		},
+		Admission: AdmissionConfiguration{
+			DefaultReplicas:       1,
+			MaxReplicaDropPercent: 50,
+		},
+		// 和 controller-runtime 的默认值一致
+		LeaderElection: LeaderElectionConfiguration{
+			ResourceName:  "db092cec.aloys.cn",
+			LeaseDuration: metav1.Duration{Duration: 15 * time.Second},
+			RenewDeadline: metav1.Duration{Duration: 10 * time.Second},
+			RetryPeriod:   metav1.Duration{Duration: 2 * time.Second},
+		},
+		Sharding: ShardingConfiguration{
+			Group:         "aloys-application-operator",
+			LeaseDuration: metav1.Duration{Duration: sharding.DefaultLeaseDuration},
+			RenewInterval: metav1.Duration{Duration: sharding.DefaultRenewInterval},
+		},
+		Controller: ControllerConfiguration{
+			MaxConcurrentReconciles: 10,
+			RequeueInterval:         metav1.Duration{Duration: time.Minute},
+		},
+		Pprof: PprofConfiguration{
+			BindAddress: "localhost:6060",
+		},
+	}
+}
+
+// LoadFile 把配置文件合并到 c 中，文件中没有设置的字段保持原来的值
+func (c *Configuration) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// 先检查版本，避免把其他版本的字段按当前版本解析
+	typeMeta := &metav1.TypeMeta{}
+	if err := yaml.Unmarshal(data, typeMeta); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	if typeMeta.APIVersion != APIVersion || typeMeta.Kind != Kind {
+		return fmt.Errorf("invalid config file %s: expected apiVersion %s and kind %s, got %q and %q",
+			path, APIVersion, Kind, typeMeta.APIVersion, typeMeta.Kind)
+	}
+	if err := yaml.UnmarshalStrict(data, c); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// Default 填充依赖其他字段的默认值，在合并完配置文件和命令行参数之后调用
+func (c *Configuration) Default() {
+	if c.Webhook.CertDir == "" && c.Webhook.CertMode != CertModeDir {
+		// 和 controller-runtime 的默认目录一致，cert-manager 的 Secret 挂载在这里
+		c.Webhook.CertDir = filepath.Join(os.TempDir(), "k8s-webhook-server", "serving-certs")
+	}
+}
+
+// Validate 检查合并后的配置
+func (c *Configuration) Validate() error {
+	var allErrs field.ErrorList
+
+	healthPath := field.NewPath("health")
+	allErrs = append(allErrs, validateDuration(healthPath.Child("reconcileStuckTimeout"), c.Health.ReconcileStuckTimeout)...)
+
+	webhookPath := field.NewPath("webhook")
+	if c.Webhook.Port < 1 || c.Webhook.Port > 65535 {
+		allErrs = append(allErrs, field.Invalid(webhookPath.Child("port"), c.Webhook.Port, "must be between 1 and 65535"))
+	}
+	certModes := sets.New(CertModeSelfManaged, CertModeCertManager, CertModeDir)
+	if !certModes.Has(c.Webhook.CertMode) {
+		allErrs = append(allErrs, field.NotSupported(webhookPath.Child("certMode"), c.Webhook.CertMode, sets.List(certModes)))
+	}
+	if c.Webhook.CertMode == CertModeDir && c.Webhook.CertDir == "" {
+		allErrs = append(allErrs, field.Required(webhookPath.Child("certDir"), "required when certMode is dir"))
+	}
+	if c.Webhook.CertName == "" {
+		allErrs = append(allErrs, field.Required(webhookPath.Child("certName"), ""))
+	}
+	if c.Webhook.KeyName == "" {
+		allErrs = append(allErrs, field.Required(webhookPath.Child("keyName"), ""))
+	}
+	if c.Webhook.CertMode == CertModeSelfManaged {
+		if c.Webhook.ServiceName == "" {
+			allErrs = append(allErrs, field.Required(webhookPath.Child("serviceName"), "required when certMode is self-managed"))
+		}
+		if c.Webhook.CertSecretName == "" {
+			allErrs = append(allErrs, field.Required(webhookPath.Child("certSecretName"), "required when certMode is self-managed"))
+		}
+	}
+	allErrs = append(allErrs, validateDuration(webhookPath.Child("certRotateBefore"), c.Webhook.CertRotateBefore)...)
+	allErrs = append(allErrs, validateDuration(webhookPath.Child("certExpiryWindow"), c.Webhook.CertExpiryWindow)...)
+
+	admissionPath := field.NewPath("admission")
+	if c.Admission.DefaultReplicas < 0 {
+		allErrs = append(allErrs, field.Invalid(admissionPath.Child("defaultReplicas"), c.Admission.DefaultReplicas, "must be greater than or equal to 0"))
+	}
+	if c.Admission.MaxReplicas < 0 {
+		allErrs = append(allErrs, field.Invalid(admissionPath.Child("maxReplicas"), c.Admission.MaxReplicas, "must be greater than or equal to 0"))
+	}
+	if c.Admission.MaxReplicaDropPercent < 0 || c.Admission.MaxReplicaDropPercent > 100 {
+		allErrs = append(allErrs, field.Invalid(admissionPath.Child("maxReplicaDropPercent"), c.Admission.MaxReplicaDropPercent, "must be between 0 and 100"))
+	}
+	for from, to := range c.Admission.ImageMirrors {
+		if trimMirror(from) == "" || trimMirror(to) == "" {
+			allErrs = append(allErrs, field.Invalid(admissionPath.Child("imageMirrors").Key(from), to, "mirror source and target must not be empty"))
+		}
+	}
+
+	scopePath := field.NewPath("scope")
+	for i, namespace := range c.Scope.Namespaces {
+		for _, msg := range validation.IsDNS1123Label(namespace) {
+			allErrs = append(allErrs, field.Invalid(scopePath.Child("namespaces").Index(i), namespace, msg))
+		}
+	}
+	if _, err := labels.Parse(c.Scope.NamespaceSelector); err != nil {
+		allErrs = append(allErrs, field.Invalid(scopePath.Child("namespaceSelector"), c.Scope.NamespaceSelector, err.Error()))
+	}
+	if _, err := labels.Parse(c.Scope.ApplicationSelector); err != nil {
+		allErrs = append(allErrs, field.Invalid(scopePath.Child("applicationSelector"), c.Scope.ApplicationSelector, err.Error()))
+	}
+
+	if c.LeaderElection.LeaderElect {
+		allErrs = append(allErrs, validateLeaderElection(field.NewPath("leaderElection"), c.LeaderElection)...)
+	}
+
+	if c.Sharding.Enabled {
+		shardingPath := field.NewPath("sharding")
+		for _, msg := range validation.IsDNS1123Label(c.Sharding.Group) {
+			allErrs = append(allErrs, field.Invalid(shardingPath.Child("group"), c.Sharding.Group, msg))
+		}
+		if c.Sharding.LeaseDuration.Duration < time.Second {
+			allErrs = append(allErrs, field.Invalid(shardingPath.Child("leaseDuration"), c.Sharding.LeaseDuration.Duration.String(), "must be at least 1s"))
+		}
+		if c.Sharding.RenewInterval.Duration <= 0 || c.Sharding.RenewInterval.Duration >= c.Sharding.LeaseDuration.Duration {
+			allErrs = append(allErrs, field.Invalid(shardingPath.Child("renewInterval"), c.Sharding.RenewInterval.Duration.String(), "must be greater than 0 and less than leaseDuration"))
+		}
+		// 分片之后每个副本都在工作，不是 leader 的副本也应该 ready
+		if c.Health.RequireLeader {
+			allErrs = append(allErrs, field.Forbidden(healthPath.Child("requireLeader"), "may not be set when sharding is enabled"))
+		}
+	}
+
+	controllerPath := field.NewPath("controller")
+	if c.Controller.MaxConcurrentReconciles < 1 {
+		allErrs = append(allErrs, field.Invalid(controllerPath.Child("maxConcurrentReconciles"), c.Controller.MaxConcurrentReconciles, "must be greater than 0"))
+	}
+	if c.Controller.RequeueInterval.Duration <= 0 {
+		allErrs = append(allErrs, field.Invalid(controllerPath.Child("requeueInterval"), c.Controller.RequeueInterval.Duration.String(), "must be greater than 0"))
+	}
+
+	return allErrs.ToAggregate()
+}
+
+// validateLeaderElection 和 client-go 的 leaderelection 检查一致，在启动前给出字段路径
+func validateLeaderElection(fldPath *field.Path, le LeaderElectionConfiguration) field.ErrorList {
+	var allErrs field.ErrorList
+	if le.ResourceName == "" {
+		allErrs = append(allErrs, field.Required(fldPath.Child("resourceName"), "required when leaderElect is true"))
+	}
+	if le.ResourceNamespace != "" {
+		for _, msg := range validation.IsDNS1123Label(le.ResourceNamespace) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("resourceNamespace"), le.ResourceNamespace, msg))
+		}
+	}
+	if le.RetryPeriod.Duration <= 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("retryPeriod"), le.RetryPeriod.Duration.String(), "must be greater than 0"))
+	}
+	// leader 续约失败时需要留出重试的时间
+	if le.RenewDeadline.Duration <= time.Duration(leaderelection.JitterFactor*float64(le.RetryPeriod.Duration)) {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("renewDeadline"), le.RenewDeadline.Duration.String(),
+			fmt.Sprintf("must be greater than %v times retryPeriod", leaderelection.JitterFactor)))
+	}
+	if le.LeaseDuration.Duration <= le.RenewDeadline.Duration {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("leaseDuration"), le.LeaseDuration.Duration.String(), "must be greater than renewDeadline"))
+	}
+	return allErrs
+}
+
+func validateDuration(fldPath *field.Path, d metav1.Duration) field.ErrorList {
+	if d.Duration < 0 {
+		return field.ErrorList{field.Invalid(fldPath, d.Duration.String(), "must be greater than or equal to 0")}
+	}
+	return nil
+}
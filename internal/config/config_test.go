@@ -0,0 +1,159 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Configuration", func() {
+	writeFile := func(content string) string {
+		path := filepath.Join(GinkgoT().TempDir(), "config.yaml")
+		Expect(os.WriteFile(path, []byte(content), 0o600)).To(Succeed())
+		return path
+	}
+
+	It("should be valid with the defaults", func() {
+		cfg := New()
+		cfg.Default()
+		Expect(cfg.Validate()).To(Succeed())
+		Expect(cfg.Webhook.CertDir).To(Equal(filepath.Join(os.TempDir(), "k8s-webhook-server", "serving-certs")))
+	})
+
+	It("should merge the file into the defaults and let flags override it", func() {
+		path := writeFile(`apiVersion: config.apps.aloys.cn/v1alpha1
+kind: ManagerConfiguration
+webhook:
+  port: 10250
+  certMode: cert-manager
+admission:
+  maxReplicas: 20
+  allowedRegistries: [docker.io, registry.corp]
+  imageMirrors:
+    docker.io: mirror.corp/dockerhub
+controller:
+  requeueInterval: 30s
+featureGates:
+  PolicyRules: false
+  SidecarInjection: false
+`)
+		args := []string{"--max-replicas=50", "--allowed-registries=registry.corp", "--feature-gates=PolicyRules=true"}
+		cfg := New()
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		cfg.BindFlags(fs)
+		Expect(fs.Parse(args)).To(Succeed())
+		Expect(cfg.LoadFile(path)).To(Succeed())
+		Expect(fs.Parse(args)).To(Succeed())
+		cfg.Default()
+		Expect(cfg.Validate()).To(Succeed())
+
+		Expect(cfg.Webhook.Port).To(Equal(10250))
+		Expect(cfg.Webhook.CertMode).To(Equal(CertModeCertManager))
+		Expect(cfg.Admission.MaxReplicas).To(Equal(50))
+		Expect(cfg.Admission.AllowedRegistries).To(Equal([]string{"registry.corp"}))
+		Expect(cfg.Admission.ImageMirrors).To(Equal(map[string]string{"docker.io": "mirror.corp/dockerhub"}))
+		Expect(cfg.Controller.RequeueInterval.Duration).To(Equal(30 * time.Second))
+		// feature gate 按名称合并，命令行设置的优先
+		Expect(cfg.FeatureGates).To(Equal(map[string]bool{"PolicyRules": true, "SidecarInjection": false}))
+		// 文件和参数都没有设置的字段保持默认值
+		Expect(cfg.Admission.DefaultReplicas).To(Equal(1))
+		Expect(cfg.Controller.MaxConcurrentReconciles).To(Equal(10))
+	})
+
+	It("should normalize image mirrors and reject empty ones", func() {
+		cfg := New()
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		cfg.BindFlags(fs)
+		Expect(fs.Parse([]string{"--image-mirrors=docker.io/=mirror.corp/dockerhub/, ghcr.io=mirror.corp/ghcr"})).To(Succeed())
+		Expect(cfg.Admission.ImageMirrors).To(Equal(map[string]string{"docker.io": "mirror.corp/dockerhub", "ghcr.io": "mirror.corp/ghcr"}))
+		for _, value := range []string{"docker.io", "docker.io/=", "=mirror.corp", "/=mirror.corp"} {
+			Expect(fs.Parse([]string{"--image-mirrors=" + value})).To(MatchError(ContainSubstring("invalid image mirror")), value)
+		}
+
+		By("validating mirrors loaded from the file")
+		cfg.Admission.ImageMirrors = map[string]string{"docker.io": "/"}
+		cfg.Default()
+		Expect(cfg.Validate()).To(MatchError(ContainSubstring("admission.imageMirrors[docker.io]")))
+	})
+
+	It("should reject files of another version or with unknown fields", func() {
+		cfg := New()
+		Expect(cfg.LoadFile(writeFile("apiVersion: config.apps.aloys.cn/v1\nkind: ManagerConfiguration\n"))).
+			To(MatchError(ContainSubstring("expected apiVersion config.apps.aloys.cn/v1alpha1")))
+		Expect(cfg.LoadFile(writeFile("apiVersion: config.apps.aloys.cn/v1alpha1\nkind: ManagerConfiguration\nwebhook:\n  prot: 1\n"))).
+			To(MatchError(ContainSubstring(`unknown field "prot"`)))
+	})
+
+	It("should report every invalid field", func() {
+		cfg := New()
+		cfg.Webhook.Port = 0
+		cfg.Webhook.CertMode = "vault"
+		cfg.Admission.MaxReplicaDropPercent = 120
+		cfg.Controller.MaxConcurrentReconciles = 0
+		cfg.Scope.Namespaces = []string{"Team_A"}
+		cfg.Scope.ApplicationSelector = "apps.aloys.cn/controller-class in team-a"
+		cfg.Default()
+		err := cfg.Validate()
+		Expect(err).To(MatchError(ContainSubstring("webhook.port")))
+		Expect(err).To(MatchError(ContainSubstring(`webhook.certMode: Unsupported value: "vault"`)))
+		Expect(err).To(MatchError(ContainSubstring("admission.maxReplicaDropPercent")))
+		Expect(err).To(MatchError(ContainSubstring("controller.maxConcurrentReconciles")))
+		Expect(err).To(MatchError(ContainSubstring("scope.namespaces[0]")))
+		Expect(err).To(MatchError(ContainSubstring("scope.applicationSelector")))
+	})
+
+	It("should validate the leader election timings", func() {
+		cfg := New()
+		cfg.LeaderElection.LeaderElect = true
+		cfg.Default()
+		Expect(cfg.Validate()).To(Succeed())
+
+		cfg.LeaderElection.RenewDeadline.Duration = 20 * time.Second
+		cfg.LeaderElection.RetryPeriod.Duration = 20 * time.Second
+		err := cfg.Validate()
+		Expect(err).To(MatchError(ContainSubstring("leaderElection.leaseDuration: Invalid value: \"15s\": must be greater than renewDeadline")))
+		Expect(err).To(MatchError(ContainSubstring("leaderElection.renewDeadline")))
+	})
+
+	It("should validate sharding only when it is enabled", func() {
+		cfg := New()
+		cfg.Sharding.RenewInterval.Duration = time.Minute
+		cfg.Health.RequireLeader = true
+		cfg.Default()
+		Expect(cfg.Validate()).To(Succeed())
+
+		cfg.Sharding.Enabled = true
+		err := cfg.Validate()
+		Expect(err).To(MatchError(ContainSubstring("sharding.renewInterval")))
+		Expect(err).To(MatchError(ContainSubstring("health.requireLeader: Forbidden")))
+	})
+
+	It("should require a certificate directory in dir mode", func() {
+		cfg := New()
+		cfg.Webhook.CertMode = CertModeDir
+		cfg.Default()
+		Expect(cfg.Validate()).To(MatchError(ContainSubstring("webhook.certDir: Required value")))
+	})
+})
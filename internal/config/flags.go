@@ -0,0 +1,231 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aloys.zy/aloys-application-operator-webhook/internal/features"
+)
+
+// BindFlags 把命令行参数绑定到配置的字段上，参数的默认值就是字段当前的值。
+// 加载配置文件之后再解析一次命令行参数，显式设置的参数就会覆盖配置文件中的值
+func (c *Configuration) BindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Metrics.BindAddress, "metrics-bind-address", c.Metrics.BindAddress, "The address the metrics endpoint binds to. "+
+		"Use :8443 for HTTPS or :8080 for HTTP, or leave as 0 to disable the metrics service.")
+	fs.BoolVar(&c.Metrics.Secure, "metrics-secure", c.Metrics.Secure,
+		"If set, the metrics endpoint is served securely via HTTPS. Use --metrics-secure=false to use HTTP instead.")
+
+	fs.StringVar(&c.Health.ProbeBindAddress, "health-probe-bind-address", c.Health.ProbeBindAddress,
+		"The address the probe endpoint binds to.")
+	fs.BoolVar(&c.Health.RequireLeader, "readyz-require-leader", c.Health.RequireLeader,
+		"If set together with --leader-elect, replicas that are not the leader report not ready.")
+	fs.DurationVar(&c.Health.ReconcileStuckTimeout.Duration, "reconcile-stuck-timeout", c.Health.ReconcileStuckTimeout.Duration,
+		"The liveness check fails when a single reconcile runs longer than this duration. 0 disables the check.")
+
+	fs.BoolVar(&c.Webhook.Enabled, "enable-webhooks", c.Webhook.Enabled,
+		"Register the admission and conversion webhooks. ENABLE_WEBHOOKS=false also disables them.")
+	fs.IntVar(&c.Webhook.Port, "webhook-bind-port", c.Webhook.Port, "bind port to webhook server. default is 9443")
+	fs.StringVar(&c.Webhook.CertMode, "webhook-cert-mode", c.Webhook.CertMode,
+		"Where the webhook serving certificate comes from: self-managed (generated, rotated and injected by the manager), "+
+			"cert-manager (mounted from the Secret issued by cert-manager) or dir (provided by the user in --webhook-cert-dir).")
+	fs.StringVar(&c.Webhook.CertDir, "webhook-cert-dir", c.Webhook.CertDir,
+		"The directory holding the webhook serving certificate. Defaults to "+
+			"<tmp>/k8s-webhook-server/serving-certs, required when --webhook-cert-mode=dir.")
+	fs.StringVar(&c.Webhook.CertName, "webhook-cert-name", c.Webhook.CertName, "The webhook serving certificate file name.")
+	fs.StringVar(&c.Webhook.KeyName, "webhook-key-name", c.Webhook.KeyName, "The webhook serving key file name.")
+	fs.StringVar(&c.Webhook.ServiceName, "webhook-service-name", c.Webhook.ServiceName,
+		"The webhook Service the self-managed certificate is issued for.")
+	fs.StringVar(&c.Webhook.CertSecretName, "webhook-cert-secret-name", c.Webhook.CertSecretName,
+		"The Secret the self-managed CA and serving certificate are stored in, shared by all replicas.")
+	fs.DurationVar(&c.Webhook.CertRotateBefore.Duration, "webhook-cert-rotate-before", c.Webhook.CertRotateBefore.Duration,
+		"Renew the self-managed serving certificate when it expires within this duration.")
+	fs.DurationVar(&c.Webhook.CertExpiryWindow.Duration, "webhook-cert-expiry-window", c.Webhook.CertExpiryWindow.Duration,
+		"The readiness check fails when the webhook serving certificate expires within this duration. "+
+			"0 only fails once it has expired.")
+
+	fs.IntVar(&c.Admission.DefaultReplicas, "default-replicas", c.Admission.DefaultReplicas,
+		"The replicas applied to Applications that do not set one. "+
+			"Can be overridden per namespace with the apps.aloys.cn/default-replicas annotation.")
+	fs.IntVar(&c.Admission.MaxReplicas, "max-replicas", c.Admission.MaxReplicas,
+		"The maximum replicas allowed for an Application, 0 means unlimited. "+
+			"Can be overridden per namespace with the apps.aloys.cn/max-replicas annotation.")
+	fs.Var((*stringList)(&c.Admission.AllowedRegistries), "allowed-registries",
+		"Comma separated registries (or registry/path prefixes) Applications may pull images from, empty means unrestricted.")
+	fs.Var((*imageMirrors)(&c.Admission.ImageMirrors), "image-mirrors",
+		"Comma separated from=to mappings used to rewrite image references to a mirror, "+
+			"e.g. docker.io=mirror.corp/dockerhub.")
+	fs.StringVar(&c.Admission.ImageDigestFile, "image-digest-file", c.Admission.ImageDigestFile,
+		"A YAML file mapping image references to sha256 digests. When set, image tags are pinned to digests.")
+	fs.StringVar(&c.Admission.SidecarTemplateNamespace, "sidecar-template-namespace", c.Admission.SidecarTemplateNamespace,
+		"The namespace holding sidecar template ConfigMaps labelled apps.aloys.cn/sidecar-template=true. "+
+			"Sidecar injection is disabled when empty.")
+	fs.IntVar(&c.Admission.MaxReplicaDropPercent, "max-replica-drop-percent", c.Admission.MaxReplicaDropPercent,
+		"The largest replica drop, in percent, allowed in a single Application update without the "+
+			"apps.aloys.cn/acknowledge-scale-down=<new replicas> annotation. 0 disables the check.")
+
+	fs.Var((*stringList)(&c.Scope.Namespaces), "watch-namespaces",
+		"Comma separated namespaces the manager caches and reconciles, empty means all namespaces. "+
+			"Dependencies of an Application must live in one of these namespaces.")
+	fs.StringVar(&c.Scope.NamespaceSelector, "namespace-selector", c.Scope.NamespaceSelector,
+		"Only reconcile and admit Applications in namespaces matching this label selector, e.g. team=a.")
+	fs.StringVar(&c.Scope.ApplicationSelector, "application-selector", c.Scope.ApplicationSelector,
+		"Only reconcile and admit Applications matching this label selector, "+
+			"e.g. apps.aloys.cn/controller-class=team-a. Other Applications are left to other instances, "+
+			"which need a different --leader-election-id.")
+
+	fs.BoolVar(&c.LeaderElection.LeaderElect, "leader-elect", c.LeaderElection.LeaderElect,
+		"Enable leader election for controller manager. "+
+			"Enabling this will ensure there is only one active controller manager.")
+	fs.StringVar(&c.LeaderElection.ResourceName, "leader-election-id", c.LeaderElection.ResourceName,
+		"The name of the Lease used for leader election.")
+	fs.StringVar(&c.LeaderElection.ResourceNamespace, "leader-election-namespace", c.LeaderElection.ResourceNamespace,
+		"The namespace of the leader election Lease. Defaults to the namespace the manager runs in.")
+	fs.DurationVar(&c.LeaderElection.LeaseDuration.Duration, "leader-election-lease-duration", c.LeaderElection.LeaseDuration.Duration,
+		"How long standby replicas wait before taking over a Lease that has not been renewed.")
+	fs.DurationVar(&c.LeaderElection.RenewDeadline.Duration, "leader-election-renew-deadline", c.LeaderElection.RenewDeadline.Duration,
+		"How long the leader keeps retrying to renew the Lease before giving up leadership.")
+	fs.DurationVar(&c.LeaderElection.RetryPeriod.Duration, "leader-election-retry-period", c.LeaderElection.RetryPeriod.Duration,
+		"How long replicas wait between attempts to acquire or renew the Lease.")
+	fs.BoolVar(&c.LeaderElection.ReleaseOnCancel, "leader-election-release-on-cancel", c.LeaderElection.ReleaseOnCancel,
+		"Release the Lease when the manager stops, so that a new leader does not have to wait for the lease duration.")
+
+	fs.BoolVar(&c.Sharding.Enabled, "enable-sharding", c.Sharding.Enabled,
+		"Spread Applications across all replicas by hashing, instead of reconciling them on the leader only. "+
+			"Each replica renews a Lease in the operator namespace and Applications are rebalanced when replicas join or leave.")
+	fs.StringVar(&c.Sharding.Group, "shard-group", c.Sharding.Group,
+		"The name of the shard group, replicas of the same group share the Applications.")
+	fs.DurationVar(&c.Sharding.LeaseDuration.Duration, "shard-lease-duration", c.Sharding.LeaseDuration.Duration,
+		"A replica that has not renewed its shard Lease for this duration is removed from the group.")
+	fs.DurationVar(&c.Sharding.RenewInterval.Duration, "shard-renew-interval", c.Sharding.RenewInterval.Duration,
+		"How often a replica renews its shard Lease and refreshes the members of the group.")
+
+	fs.IntVar(&c.Controller.MaxConcurrentReconciles, "max-concurrent-reconciles", c.Controller.MaxConcurrentReconciles,
+		"The maximum number of Applications reconciled at the same time.")
+	fs.DurationVar(&c.Controller.RequeueInterval.Duration, "requeue-interval", c.Controller.RequeueInterval.Duration,
+		"How long to wait before retrying a failed reconcile or checking dependencies again.")
+	fs.BoolVar(&c.Controller.DryRun, "dry-run", c.Controller.DryRun,
+		"Report the changes the reconciler would make in the Application status and events without writing "+
+			"Deployments or Services. Single Applications can be previewed with the apps.aloys.cn/dry-run=true annotation.")
+
+	fs.Var((*boolMap)(&c.FeatureGates), "feature-gates",
+		"A set of key=value pairs that describe feature gates for alpha/beta features, merged with the featureGates "+
+			"of the config file. Options are:\n"+strings.Join(features.DefaultFeatureGate.KnownFeatures(), "\n"))
+	fs.BoolVar(&c.EnableHTTP2, "enable-http2", c.EnableHTTP2,
+		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	fs.BoolVar(&c.Pprof.Enabled, "enable-pprof", c.Pprof.Enabled, "Enable pprof profiling")
+	fs.StringVar(&c.Pprof.BindAddress, "pprof-addr", c.Pprof.BindAddress, "The address on which to expose the pprof handler")
+}
+
+// stringList 逗号分隔的列表，每次设置都替换整个列表
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	*l = items
+	return nil
+}
+
+// imageMirrors 逗号分隔的 from=to 镜像映射，每次设置都替换整个 map。
+// 去掉两边结尾的 /，from 或 to 为空时报错
+type imageMirrors map[string]string
+
+func (m *imageMirrors) String() string {
+	if m == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*m))
+	for k, v := range *m {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (m *imageMirrors) Set(value string) error {
+	items := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(pair, "=")
+		from, to = trimMirror(from), trimMirror(to)
+		if !ok || from == "" || to == "" {
+			return fmt.Errorf("invalid image mirror %q, expected from=to", pair)
+		}
+		items[from] = to
+	}
+	*m = items
+	return nil
+}
+
+// boolMap 逗号分隔的 key=bool，和已有的值合并，同一个 key 以后设置的为准
+type boolMap map[string]bool
+
+func (m *boolMap) String() string {
+	if m == nil {
+		return ""
+	}
+	pairs := make([]string, 0, len(*m))
+	for k, v := range *m {
+		pairs = append(pairs, k+"="+strconv.FormatBool(v))
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (m *boolMap) Set(value string) error {
+	if *m == nil {
+		*m = map[string]bool{}
+	}
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid mapping %q, expected key=true|false", pair)
+		}
+		enabled, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("invalid value of %s: %w", k, err)
+		}
+		(*m)[strings.TrimSpace(k)] = enabled
+	}
+	return nil
+}
+
+// trimMirror 镜像映射的两边不带结尾的 /，docker.io/ 和 docker.io 是同一个仓库
+func trimMirror(value string) string {
+	return strings.TrimSuffix(strings.TrimSpace(value), "/")
+}
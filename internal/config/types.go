@@ -0,0 +1,193 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package config defines the versioned configuration file of the manager.
+package config
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// APIVersion 配置文件的 apiVersion
+	APIVersion = "config.apps.aloys.cn/v1alpha1"
+	// Kind 配置文件的 kind
+	Kind = "ManagerConfiguration"
+)
+
+// webhook 证书的来源
+const (
+	// CertModeSelfManaged 自己生成 CA 和服务端证书，并注入 CA bundle
+	CertModeSelfManaged = "self-managed"
+	// CertModeCertManager 证书由 cert-manager 写入挂载的 Secret，CA bundle 由 cainjector 注入
+	CertModeCertManager = "cert-manager"
+	// CertModeDir 使用用户提供的证书目录，CA bundle 由用户自己维护
+	CertModeDir = "dir"
+)
+
+// Configuration 管理器的配置文件，命令行参数优先于配置文件
+type Configuration struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// Metrics metrics 服务
+	Metrics MetricsConfiguration `json:"metrics"`
+	// Health 健康检查
+	Health HealthConfiguration `json:"health"`
+	// Webhook webhook server 和证书
+	Webhook WebhookConfiguration `json:"webhook"`
+	// Admission defaulter 和 validator 的行为
+	Admission AdmissionConfiguration `json:"admission"`
+	// Scope 当前实例负责的 namespace 和 Application
+	Scope ScopeConfiguration `json:"scope"`
+	// LeaderElection 选主
+	LeaderElection LeaderElectionConfiguration `json:"leaderElection"`
+	// Sharding 多个副本按 Application 分片，同时调谐
+	Sharding ShardingConfiguration `json:"sharding"`
+	// Logging 日志
+	Logging LoggingConfiguration `json:"logging"`
+	// Controller 控制器调优
+	Controller ControllerConfiguration `json:"controller"`
+	// Pprof 性能分析
+	Pprof PprofConfiguration `json:"pprof"`
+	// EnableHTTP2 metrics 和 webhook server 是否启用 HTTP/2，默认关闭
+	EnableHTTP2 bool `json:"enableHTTP2"`
+	// FeatureGates 开启或关闭 alpha/beta 功能，没有设置的功能使用各自的默认值
+	FeatureGates map[string]bool `json:"featureGates,omitempty"`
+}
+
+// MetricsConfiguration metrics 服务
+type MetricsConfiguration struct {
+	// BindAddress 为 0 时不启动 metrics 服务
+	BindAddress string `json:"bindAddress"`
+	// Secure 是否通过 HTTPS 并进行认证鉴权
+	Secure bool `json:"secure"`
+}
+
+// HealthConfiguration 健康检查
+type HealthConfiguration struct {
+	// ProbeBindAddress healthz 和 readyz 的监听地址
+	ProbeBindAddress string `json:"probeBindAddress"`
+	// RequireLeader 开启选主时，不是 leader 的副本 readiness 检查失败
+	RequireLeader bool `json:"requireLeader"`
+	// ReconcileStuckTimeout 单次调谐超过这个时间 liveness 检查失败，0 表示不检查
+	ReconcileStuckTimeout metav1.Duration `json:"reconcileStuckTimeout"`
+}
+
+// WebhookConfiguration webhook server 和证书
+type WebhookConfiguration struct {
+	// Enabled 是否注册 webhook，环境变量 ENABLE_WEBHOOKS=false 也可以关闭
+	Enabled bool `json:"enabled"`
+	// Port 监听端口
+	Port int `json:"port"`
+	// CertMode self-managed、cert-manager 或 dir
+	CertMode string `json:"certMode"`
+	// CertDir 证书目录，为空时使用 <tmp>/k8s-webhook-server/serving-certs，dir 模式下必须设置
+	CertDir  string `json:"certDir"`
+	CertName string `json:"certName"`
+	KeyName  string `json:"keyName"`
+	// ServiceName self-managed 模式下证书签发给这个 Service
+	ServiceName string `json:"serviceName"`
+	// CertSecretName self-managed 模式下保存 CA 和证书的 Secret
+	CertSecretName string `json:"certSecretName"`
+	// CertRotateBefore self-managed 模式下距离过期不足这个时间时重新签发
+	CertRotateBefore metav1.Duration `json:"certRotateBefore"`
+	// CertExpiryWindow 证书在这个时间内过期时 readiness 检查失败
+	CertExpiryWindow metav1.Duration `json:"certExpiryWindow"`
+}
+
+// AdmissionConfiguration defaulter 和 validator 的行为
+type AdmissionConfiguration struct {
+	// DefaultReplicas 没有设置副本数时使用的值
+	DefaultReplicas int `json:"defaultReplicas"`
+	// MaxReplicas 允许的最大副本数，0 表示不限制
+	MaxReplicas int `json:"maxReplicas"`
+	// AllowedRegistries 允许拉取镜像的仓库，为空表示不限制
+	AllowedRegistries []string `json:"allowedRegistries,omitempty"`
+	// ImageMirrors 镜像地址前缀的替换规则
+	ImageMirrors map[string]string `json:"imageMirrors,omitempty"`
+	// ImageDigestFile 镜像到 digest 的映射文件
+	ImageDigestFile string `json:"imageDigestFile"`
+	// SidecarTemplateNamespace sidecar 模板所在的 namespace，为空时不注入
+	SidecarTemplateNamespace string `json:"sidecarTemplateNamespace"`
+	// MaxReplicaDropPercent 单次更新允许下降的副本数比例，0 表示不限制
+	MaxReplicaDropPercent int `json:"maxReplicaDropPercent"`
+}
+
+// ScopeConfiguration 当前实例负责的范围，多个实例可以按 namespace 或者标签划分同一个集群
+type ScopeConfiguration struct {
+	// Namespaces 只缓存这些 namespace 中的对象，为空表示所有 namespace
+	Namespaces []string `json:"namespaces,omitempty"`
+	// NamespaceSelector 只处理标签匹配的 namespace 中的 Application
+	NamespaceSelector string `json:"namespaceSelector,omitempty"`
+	// ApplicationSelector 只处理标签匹配的 Application，例如 apps.aloys.cn/controller-class=team-a
+	ApplicationSelector string `json:"applicationSelector,omitempty"`
+}
+
+// LeaderElectionConfiguration 选主
+type LeaderElectionConfiguration struct {
+	// LeaderElect 是否开启选主
+	LeaderElect bool `json:"leaderElect"`
+	// ResourceName 选主使用的 Lease 名称
+	ResourceName string `json:"resourceName"`
+	// ResourceNamespace Lease 所在的 namespace，为空时使用 operator 所在的 namespace
+	ResourceNamespace string `json:"resourceNamespace,omitempty"`
+	// LeaseDuration standby 副本等待这个时间后才会尝试抢占没有续约的 Lease
+	LeaseDuration metav1.Duration `json:"leaseDuration"`
+	// RenewDeadline leader 在这个时间内续约失败就放弃 leader
+	RenewDeadline metav1.Duration `json:"renewDeadline"`
+	// RetryPeriod 每次尝试获取或者续约 Lease 的间隔
+	RetryPeriod metav1.Duration `json:"retryPeriod"`
+	// ReleaseOnCancel 退出时主动释放 Lease，新的 leader 不需要等待 LeaseDuration
+	ReleaseOnCancel bool `json:"releaseOnCancel"`
+}
+
+// ShardingConfiguration 多个副本分片调谐 Application，开启后 controller 不再依赖选主
+type ShardingConfiguration struct {
+	// Enabled 是否开启分片
+	Enabled bool `json:"enabled"`
+	// Group 分组的名称，也是每个副本 Lease 名称的前缀
+	Group string `json:"group"`
+	// LeaseDuration 超过这个时间没有续约的副本被移出分组
+	LeaseDuration metav1.Duration `json:"leaseDuration"`
+	// RenewInterval 续约和刷新成员的间隔，需要小于 LeaseDuration
+	RenewInterval metav1.Duration `json:"renewInterval"`
+}
+
+// LoggingConfiguration 日志，对应 --zap-* 参数
+type LoggingConfiguration struct {
+	// Level debug、info、error 或者表示详细程度的正整数
+	Level string `json:"level,omitempty"`
+	// Development 开发模式
+	Development bool `json:"development,omitempty"`
+}
+
+// ControllerConfiguration 控制器调优
+type ControllerConfiguration struct {
+	// MaxConcurrentReconciles 同时执行的最大调谐数量
+	MaxConcurrentReconciles int `json:"maxConcurrentReconciles"`
+	// RequeueInterval 调谐失败或者等待依赖时重新入队的间隔
+	RequeueInterval metav1.Duration `json:"requeueInterval"`
+	// DryRun 只在 status 和事件中报告会执行的变更，不写入 Deployment/Service
+	DryRun bool `json:"dryRun"`
+}
+
+// PprofConfiguration 性能分析
+type PprofConfiguration struct {
+	// Enabled 是否启用 pprof
+	Enabled bool `json:"enabled"`
+	// BindAddress pprof 的监听地址
+	BindAddress string `json:"bindAddress"`
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+)
+
+const (
+	// AnnotationAdopt 已经存在的 Deployment/Service 带有这个注解并且值为 Application 名称时，允许 Application 接管
+	AnnotationAdopt = "apps.aloys.cn/adopt"
+	// ConditionTypeConflict 同名的子资源已经存在但不属于当前 Application
+	ConditionTypeConflict = "Conflict"
+)
+
+// canAdopt 没有其他 controller 的对象才能接管，并且需要 spec.adopt 或者对象上匹配的注解
+func canAdopt(application *appv1.Application, obj client.Object) bool {
+	if metav1.GetControllerOf(obj) != nil {
+		return false
+	}
+	return application.Spec.Adopt || obj.GetAnnotations()[AnnotationAdopt] == application.Name
+}
+
+// reconcileOwnership 接管允许接管的同名子资源，返回不能接管的对象。
+// 存在冲突时不能把别人的对象当成自己的来调谐，也不能覆盖它的状态
+func (r *ApplicationReconciler) reconcileOwnership(ctx context.Context, application *appv1.Application) ([]string, error) {
+	setupLog := log.FromContext(ctx).WithName("reconcileOwnership")
+	var conflicts []string
+	for _, desired := range desiredObjects(application) {
+		live := emptyLike(desired)
+		if err := r.Get(ctx, client.ObjectKeyFromObject(desired), live); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		if metav1.IsControlledBy(live, application) {
+			continue
+		}
+		kind := kindOf(desired)
+		if !canAdopt(application, live) {
+			conflicts = append(conflicts, describeConflict(kind, live))
+			continue
+		}
+		if err := ctrl.SetControllerReference(application, live, r.Scheme); err != nil {
+			return nil, err
+		}
+		if err := r.Update(ctx, live); err != nil {
+			setupLog.Error(err, "Failed to adopt the object.", "kind", kind, "name", live.GetName())
+			return nil, err
+		}
+		setupLog.Info("Adopted the existing object", "kind", kind, "name", live.GetName())
+		r.Recorder.Eventf(application, corev1.EventTypeNormal, "Adopted", "Adopted the existing %s %s", kind, live.GetName())
+	}
+	return conflicts, nil
+}
+
+// describeConflict 冲突对象的描述，例如 Deployment shop-deployment (controlled by ReplicaSet other)
+func describeConflict(kind string, live client.Object) string {
+	conflict := kind + " " + live.GetName()
+	if owner := metav1.GetControllerOf(live); owner != nil {
+		conflict += fmt.Sprintf(" (controlled by %s %s)", owner.Kind, owner.Name)
+	}
+	return conflict
+}
+
+// setConflictCondition 没有冲突时删除 Conflict condition，冲突的对象变化时记录事件
+func setConflictCondition(application *appv1.Application, conflicts []string, recorder record.EventRecorder) {
+	if len(conflicts) == 0 {
+		meta.RemoveStatusCondition(&application.Status.Conditions, ConditionTypeConflict)
+		return
+	}
+	condition := metav1.Condition{
+		Type:   ConditionTypeConflict,
+		Status: metav1.ConditionTrue,
+		Reason: "ObjectNotOwned",
+		Message: fmt.Sprintf("%s already exist and are not owned by the Application, set spec.adopt or annotate them with %s=%s to adopt them",
+			strings.Join(conflicts, ", "), AnnotationAdopt, application.Name),
+		ObservedGeneration: application.Generation,
+	}
+	previous := meta.FindStatusCondition(application.Status.Conditions, ConditionTypeConflict)
+	if previous == nil || previous.Message != condition.Message {
+		recorder.Event(application, corev1.EventTypeWarning, "Conflict", condition.Message)
+	}
+	meta.SetStatusCondition(&application.Status.Conditions, condition)
+}
@@ -23,6 +23,7 @@ import (
 
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/tools/record"
@@ -31,10 +32,16 @@ import (
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	appv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+	"github.com/aloys.zy/aloys-application-operator-webhook/internal/health"
+	"github.com/aloys.zy/aloys-application-operator-webhook/internal/scope"
+	"github.com/aloys.zy/aloys-application-operator-webhook/internal/sharding"
 )
 
 // ApplicationReconciler reconciles a Application object
@@ -42,6 +49,16 @@ type ApplicationReconciler struct {
 	client.Client
 	Scheme   *runtime.Scheme
 	Recorder record.EventRecorder
+	// Tracker 记录正在执行的调谐，供 liveness 检查发现卡住的调谐，为 nil 时不记录
+	Tracker *health.ReconcileTracker
+	// MaxConcurrentReconciles 同时执行的最大调谐数量，为 0 时使用 10
+	MaxConcurrentReconciles int
+	// Scope 只调谐属于当前实例的 Application，为 nil 时调谐所有 Application
+	Scope *scope.Scope
+	// DryRun 只计算并报告变更，不写入子资源，单个 Application 可以通过 apps.aloys.cn/dry-run 注解开启
+	DryRun bool
+	// Sharder 多个副本分片时只调谐分配给当前副本的 Application，为 nil 时只在 leader 上调谐所有 Application
+	Sharder *sharding.Sharder
 }
 
 // +kubebuilder:rbac:groups=apps.aloys.cn,resources=applications,verbs=get;list;watch;create;update;patch;delete
@@ -52,12 +69,13 @@ type ApplicationReconciler struct {
 // +kubebuilder:rbac:groups=apps,resources=deployments/status,verbs=get
 // +kubebuilder:rbac:groups=core,resources=services,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=core,resources=services/status,verbs=get
+// +kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
 
 // CounterReconcileApplication 记录当前调谐的轮次
 var CounterReconcileApplication int64
 
-// GenericRequeueDuration 这个是每次重试的时间间隔（修改到配置文件中）
-const GenericRequeueDuration = 1 * time.Minute
+// GenericRequeueDuration 这个是每次重试的时间间隔，通过配置文件的 controller.requeueInterval 修改
+var GenericRequeueDuration = 1 * time.Minute
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -75,6 +93,14 @@ func (r *ApplicationReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	// setupLog.V(1).Info("11111")  // 1是 debug
 
 	// TODO(user): your log here
+	if r.Tracker != nil {
+		defer r.Tracker.Begin(req.NamespacedName.String())()
+	}
+	// 成员变化时由 enqueueAssigned 重新触发，这里不需要重试
+	if !r.Sharder.Owns(req.NamespacedName.String()) {
+		setupLog.V(1).Info("Skipping Application assigned to another shard", "name", req.NamespacedName)
+		return ctrl.Result{}, nil
+	}
 	// 调谐逻辑是并发的，我设置的是10，当时多个goroutine同时运行的时候，日志比较乱，这里增加了一个100毫秒的等待，并且添加了一个当前调谐次数的打印
 	// time.NewTicker 函数用于创建一个新的定时器（ticker），它会定期发送时间信号到一个通道（channel）。<-time.NewTicker(1000 * time.Millisecond).C 这一行代码的作用是从这个定时器的通道中接收时间信号。
 	<-time.NewTicker(1000 * time.Millisecond).C
@@ -96,27 +122,130 @@ func (r *ApplicationReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	}
 	// a := application.GetResourceVersion()
 
+	// 依赖项、deployment 和 service 的事件也会触发调谐，这里统一跳过其他实例负责的 Application
+	inScope, err := r.Scope.Contains(ctx, r.Client, application)
+	if err != nil {
+		setupLog.Error(err, "Failed to check the scope of Application.", "name", req.Name)
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	if !inScope {
+		setupLog.V(1).Info("Skipping Application outside the scope of this instance", "name", req.NamespacedName)
+		return ctrl.Result{}, nil
+	}
+
+	// 依赖的 Application 没有全部 Ready 之前，不创建也不更新当前应用的工作负载
+	// 依赖项 Ready 状态变化时会通过 findDependents 重新触发调谐，这里的 RequeueAfter 只是兜底
+	blocking, err := r.blockingDependencies(ctx, application)
+	if err != nil {
+		setupLog.Error(err, "Failed to check dependencies.", "name", req.Name)
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	if len(blocking) > 0 {
+		oldStatus := application.Status.DeepCopy()
+		setWaitingForDependenciesCondition(application, blocking)
+		if err := r.updateStatus(ctx, application, oldStatus); err != nil {
+			setupLog.Error(err, "Failed to update the Application status.", "name", req.Name)
+			return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+		}
+		setupLog.Info("Waiting for dependencies", "name", req.Name, "blocking", blocking)
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, nil
+	}
+
+	// 预览模式下只记录会执行的变更，不创建子资源，也不更新工作负载的状态
+	if r.dryRun(application) {
+		return r.reconcilePlan(ctx, application)
+	}
+
+	// 同名的子资源已经存在但不属于当前 Application 时，只有允许接管才继续调谐
+	// 对象上的注解变化不会触发调谐，这里的 RequeueAfter 用来发现新加的注解
+	conflicts, err := r.reconcileOwnership(ctx, application)
+	if err != nil {
+		setupLog.Error(err, "Failed to reconcile ownership.", "name", req.Name)
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	if len(conflicts) > 0 {
+		oldStatus := application.Status.DeepCopy()
+		setConflictCondition(application, conflicts, r.Recorder)
+		if err := r.updateStatus(ctx, application, oldStatus); err != nil {
+			setupLog.Error(err, "Failed to update the Application status.", "name", req.Name)
+			return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+		}
+		setupLog.Info("Refusing to reconcile objects not owned by the Application", "name", req.Name, "conflicts", conflicts)
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, nil
+	}
+
 	// 多次使用这个变量，提前声明，但是都是在栈上进行的操作，感觉性能影响非常小 var result ctrl.Result var err error
-	if result, err := r.reconcileDeployment(ctx, application); err != nil {
-		setupLog.Error(err, "Failed to reconcile deployment.", "name", req.Name)
-		return result, err
+	// 只声明了 components 的应用不需要默认的 deployment/service
+	if hasDefaultWorkload(application) {
+		if result, err := r.reconcileDeployment(ctx, application); err != nil {
+			setupLog.Error(err, "Failed to reconcile deployment.", "name", req.Name)
+			return result, err
+		}
+		if result, err := r.reconcileService(ctx, application); err != nil {
+			setupLog.Error(err, "Failed to reconcile service.", "name", req.Name)
+			return result, err
+		}
 	}
-	if result, err := r.reconcileService(ctx, application); err != nil {
-		setupLog.Error(err, "Failed to reconcile service.", "name", req.Name)
+	// 上面的步骤可能已经更新过一次状态，这里记录一下，后面的组件状态和 conditions 统一比较后再更新
+	oldStatus := application.Status.DeepCopy()
+	if result, err := r.reconcileComponents(ctx, application); err != nil {
+		setupLog.Error(err, "Failed to reconcile components.", "name", req.Name)
 		return result, err
 	}
+	if err := r.pruneChildren(ctx, application); err != nil {
+		setupLog.Error(err, "Failed to prune stale child objects.", "name", req.Name)
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	// 子资源被手工修改时按 spec.driftPolicy 恢复或者记录，修改组件的模板、副本数和 service 也通过这里更新到已经存在的子资源
+	if err := r.reconcileDrift(ctx, application); err != nil {
+		setupLog.Error(err, "Failed to reconcile drift.", "name", req.Name)
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	setWaitingForDependenciesCondition(application, nil)
+	setConflictCondition(application, nil, r.Recorder)
+	setReadyCondition(application)
+	clearPlan(application)
+	if err := r.updateStatus(ctx, application, oldStatus); err != nil {
+		setupLog.Error(err, "Failed to update the Application status.", "name", req.Name)
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
 	// 如果没有发生任何 error，返回一个空的Result，表示没有需要重试的操作，控制器可以结束当前的 reconcile loop，并开始下一个 reconcile loop。
 	setupLog.Info("Finished a reconcile", "number", CounterReconcileApplication)
 	return ctrl.Result{}, nil
 }
 
+// updateStatus 状态和调谐前的快照不一致时才更新，避免无意义的请求
+func (r *ApplicationReconciler) updateStatus(ctx context.Context, application *appv1.Application, oldStatus *appv1.ApplicationStatus) error {
+	if equality.Semantic.DeepEqual(*oldStatus, application.Status) {
+		return nil
+	}
+	return r.Status().Update(ctx, application)
+}
+
+func (r *ApplicationReconciler) maxConcurrentReconciles() int {
+	if r.MaxConcurrentReconciles > 0 {
+		return r.MaxConcurrentReconciles
+	}
+	return 10
+}
+
 // SetupWithManager sets up the controller with the Manager.
 // 监听到什么事件的时候需要触发调谐，是根据这里的配置进行过滤
 func (r *ApplicationReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	setupLog := ctrl.Log.WithName("SetupWithManager")
-	return ctrl.NewControllerManagedBy(mgr).
+	// 建立 spec.dependsOn 的索引，被依赖的应用变化时可以快速找到依赖它的应用
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &appv1.Application{}, dependsOnIndexField, dependsOnIndexer); err != nil {
+		return err
+	}
+	options := controller.Options{MaxConcurrentReconciles: r.maxConcurrentReconciles()}
+	if r.Sharder != nil {
+		// 分片之后每个副本都调谐分配给自己的 Application，不需要等待选主
+		needLeaderElection := false
+		options.NeedLeaderElection = &needLeaderElection
+	}
+	bldr := ctrl.NewControllerManagedBy(mgr).
 		// 监听到 Application 创建、更新、删除事件，返回true表示触发调谐
-		For(&appv1.Application{}, builder.WithPredicates(predicate.Funcs{
+		For(&appv1.Application{}, builder.WithPredicates(r.Scope.Predicate(), predicate.Funcs{
 			// create 是肯定要触发的
 			CreateFunc: func(e event.CreateEvent) bool {
 				setupLog.Info("The Application has been Created.", "name", e.Object.GetName())
@@ -128,6 +257,10 @@ func (r *ApplicationReconciler) SetupWithManager(mgr ctrl.Manager) error {
 				if e.ObjectNew.GetResourceVersion() == e.ObjectOld.GetResourceVersion() {
 					return false
 				}
+				// 开启或关闭预览模式时需要重新调谐
+				if e.ObjectNew.GetAnnotations()[AnnotationDryRun] != e.ObjectOld.GetAnnotations()[AnnotationDryRun] {
+					return true
+				}
 				// 如果新旧spec字段相同也不触发调谐
 				if reflect.DeepEqual(e.ObjectNew.(*appv1.Application).Spec, e.ObjectOld.(*appv1.Application).Spec) {
 					return false
@@ -144,6 +277,10 @@ func (r *ApplicationReconciler) SetupWithManager(mgr ctrl.Manager) error {
 			},
 		})).
 		Named("application").
+		// 被依赖的 Application 创建、删除或 Ready 状态变化时，重新调谐依赖它的应用
+		Watches(&appv1.Application{}, handler.EnqueueRequestsFromMapFunc(r.findDependents), builder.WithPredicates(predicate.Funcs{
+			UpdateFunc: readyConditionChanged,
+		})).
 		// 额外监听资源，这些资源的变化也会触发调谐
 		Owns(&appsv1.Deployment{}, builder.WithPredicates(predicate.Funcs{
 			// application 创建的时候会自动创建，不需要这个监听在出发调谐
@@ -155,9 +292,11 @@ func (r *ApplicationReconciler) SetupWithManager(mgr ctrl.Manager) error {
 				if e.ObjectNew.GetResourceVersion() == e.ObjectOld.GetResourceVersion() {
 					return false
 				}
-				// 如果新旧spec字段相同也不触发调谐
+				// 如果新旧spec和status字段都相同也不触发调谐
 				// 这里要断言的类型应该是需要监听的类型，不能断言Application
-				if reflect.DeepEqual(e.ObjectNew.(*appsv1.Deployment).Spec, e.ObjectOld.(*appsv1.Deployment).Spec) {
+				// status 的变化也需要调谐，Application 的 Ready condition 依赖 deployment 的可用副本数
+				newDp, oldDp := e.ObjectNew.(*appsv1.Deployment), e.ObjectOld.(*appsv1.Deployment)
+				if reflect.DeepEqual(newDp.Spec, oldDp.Spec) && reflect.DeepEqual(newDp.Status, oldDp.Status) {
 					return false
 				}
 				// 其他情况下进行调谐
@@ -201,6 +340,28 @@ func (r *ApplicationReconciler) SetupWithManager(mgr ctrl.Manager) error {
 			},
 		})).
 		// MaxConcurrentReconciles 表示控制器同时处理的最大并发调谐（reconciliation）数量，默认是1，就是每次可以支持的最大goroutine数量，这个决定了单位时间内处理事件的能力。和系统资源有关
-		WithOptions(controller.Options{MaxConcurrentReconciles: 10}).
-		Complete(r)
+		WithOptions(options)
+	if r.Sharder != nil {
+		// 分组的成员变化时，重新调谐分配给当前副本的 Application
+		bldr = bldr.WatchesRawSource(source.Channel(r.Sharder.Events(), handler.EnqueueRequestsFromMapFunc(r.enqueueAssigned)))
+	}
+	return bldr.Complete(r)
+}
+
+// enqueueAssigned 返回分配给当前副本的所有 Application，并记录数量
+func (r *ApplicationReconciler) enqueueAssigned(ctx context.Context, _ client.Object) []reconcile.Request {
+	applications := &appv1.ApplicationList{}
+	if err := r.List(ctx, applications); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list Applications for rebalancing.")
+		return nil
+	}
+	var requests []reconcile.Request
+	for i := range applications.Items {
+		key := client.ObjectKeyFromObject(&applications.Items[i])
+		if r.Sharder.Owns(key.String()) {
+			requests = append(requests, reconcile.Request{NamespacedName: key})
+		}
+	}
+	r.Sharder.RecordAssigned(len(requests))
+	return requests
 }
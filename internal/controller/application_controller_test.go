@@ -21,13 +21,25 @@ import (
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/component-base/featuregate"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	appv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+	"github.com/aloys.zy/aloys-application-operator-webhook/internal/features"
+	"github.com/aloys.zy/aloys-application-operator-webhook/internal/scope"
 )
 
 var _ = Describe("Application Controller", func() {
@@ -81,4 +93,645 @@ var _ = Describe("Application Controller", func() {
 			// Example: If you expect a certain status condition after reconciliation, verify it here.
 		})
 	})
+
+	Context("When reconciling a multi-component Application", func() {
+		var (
+			fakeClient client.Client
+			reconciler *ApplicationReconciler
+			key        = types.NamespacedName{Name: "shop", Namespace: "default"}
+		)
+
+		BeforeEach(func() {
+			application := &appv1.Application{
+				ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace},
+				Spec: appv1.ApplicationSpec{
+					Components: []appv1.ComponentSpec{
+						{
+							Name:       "frontend",
+							Deployment: newDeploymentTemplate("nginx:1.27"),
+							Service: &appv1.ServiceTemplate{ServiceSpec: corev1.ServiceSpec{
+								Ports: []corev1.ServicePort{{Port: 80}},
+							}},
+						},
+						{
+							Name:       "worker",
+							Deployment: newDeploymentTemplate("busybox:1.36"),
+						},
+					},
+				},
+			}
+			fakeClient, reconciler, _ = newFakeReconciler(application)
+		})
+
+		It("should create one Deployment/Service pair per component", func() {
+			_, err := reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+
+			dp := &appsv1.Deployment{}
+			Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "shop-frontend", Namespace: "default"}, dp)).To(Succeed())
+			Expect(dp.Spec.Template.Labels).To(HaveKeyWithValue(LabelComponent, "frontend"))
+			Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "shop-worker", Namespace: "default"}, &appsv1.Deployment{})).To(Succeed())
+
+			svc := &corev1.Service{}
+			Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "shop-frontend", Namespace: "default"}, svc)).To(Succeed())
+			Expect(svc.Spec.Selector).To(Equal(dp.Spec.Template.Labels))
+			err = fakeClient.Get(ctx, types.NamespacedName{Name: "shop-worker", Namespace: "default"}, &corev1.Service{})
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+
+			By("not creating the default deployment for a components-only Application")
+			err = fakeClient.Get(ctx, types.NamespacedName{Name: "shop-deployment", Namespace: "default"}, &appsv1.Deployment{})
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("should aggregate component readiness into the Ready condition", func() {
+			_, err := reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+
+			application := &appv1.Application{}
+			Expect(fakeClient.Get(ctx, key, application)).To(Succeed())
+			Expect(application.Status.Components).To(HaveLen(2))
+			Expect(meta.IsStatusConditionFalse(application.Status.Conditions, ConditionTypeReady)).To(BeTrue())
+
+			By("marking every component deployment as available")
+			for _, name := range []string{"shop-frontend", "shop-worker"} {
+				dp := &appsv1.Deployment{}
+				Expect(fakeClient.Get(ctx, types.NamespacedName{Name: name, Namespace: "default"}, dp)).To(Succeed())
+				dp.Status.Replicas = 1
+				dp.Status.AvailableReplicas = 1
+				Expect(fakeClient.Status().Update(ctx, dp)).To(Succeed())
+			}
+			_, err = reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.Get(ctx, key, application)).To(Succeed())
+			Expect(meta.IsStatusConditionTrue(application.Status.Conditions, ConditionTypeReady)).To(BeTrue())
+		})
+
+		It("should update edited components and delete removed ones", func() {
+			_, err := reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("editing the frontend and removing the worker")
+			application := &appv1.Application{}
+			Expect(fakeClient.Get(ctx, key, application)).To(Succeed())
+			replicas := int32(2)
+			application.Spec.Components[0].Deployment.Replicas = &replicas
+			application.Spec.Components[0].Deployment.Template.Spec.Containers[0].Image = "nginx:1.28"
+			application.Spec.Components[0].Service.Ports[0].Port = 8080
+			application.Spec.Components = application.Spec.Components[:1]
+			Expect(fakeClient.Update(ctx, application)).To(Succeed())
+			_, err = reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+
+			dp := &appsv1.Deployment{}
+			Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "shop-frontend", Namespace: "default"}, dp)).To(Succeed())
+			Expect(*dp.Spec.Replicas).To(Equal(int32(2)))
+			Expect(dp.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:1.28"))
+			svc := &corev1.Service{}
+			Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "shop-frontend", Namespace: "default"}, svc)).To(Succeed())
+			Expect(svc.Spec.Ports[0].Port).To(Equal(int32(8080)))
+			err = fakeClient.Get(ctx, types.NamespacedName{Name: "shop-worker", Namespace: "default"}, &appsv1.Deployment{})
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+			Expect(fakeClient.Get(ctx, key, application)).To(Succeed())
+			Expect(application.Status.Components).To(HaveLen(1))
+		})
+		It("should delete the Service of a component once it is removed", func() {
+			_, err := reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			svcKey := types.NamespacedName{Name: "shop-frontend", Namespace: "default"}
+			Expect(fakeClient.Get(ctx, svcKey, &corev1.Service{})).To(Succeed())
+
+			application := &appv1.Application{}
+			Expect(fakeClient.Get(ctx, key, application)).To(Succeed())
+			application.Spec.Components[0].Service = nil
+			Expect(fakeClient.Update(ctx, application)).To(Succeed())
+			_, err = reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			err = fakeClient.Get(ctx, svcKey, &corev1.Service{})
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+			Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "shop-frontend", Namespace: "default"}, &appsv1.Deployment{})).To(Succeed())
+		})
+	})
+
+	Context("When reconciling an Application in dry-run mode", func() {
+		It("should report the planned changes without applying them", func() {
+			key := types.NamespacedName{Name: "shop", Namespace: "default"}
+			application := &appv1.Application{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        key.Name,
+					Namespace:   key.Namespace,
+					Annotations: map[string]string{AnnotationDryRun: "true"},
+				},
+				Spec: appv1.ApplicationSpec{
+					Components: []appv1.ComponentSpec{{
+						Name:       "frontend",
+						Deployment: newDeploymentTemplate("nginx:1.27"),
+						Service: &appv1.ServiceTemplate{ServiceSpec: corev1.ServiceSpec{
+							Ports: []corev1.ServicePort{{Port: 80}},
+						}},
+					}},
+				},
+			}
+			fakeClient, reconciler, recorder := newFakeReconciler(application)
+
+			_, err := reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			err = fakeClient.Get(ctx, types.NamespacedName{Name: "shop-frontend", Namespace: "default"}, &appsv1.Deployment{})
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+			Expect(fakeClient.Get(ctx, key, application)).To(Succeed())
+			Expect(application.Status.Plan).NotTo(BeNil())
+			Expect(application.Status.Plan.Changes).To(ConsistOf(
+				appv1.PlannedChange{Action: appv1.PlannedActionCreate, Kind: "Deployment", Name: "shop-frontend"},
+				appv1.PlannedChange{Action: appv1.PlannedActionCreate, Kind: "Service", Name: "shop-frontend"},
+			))
+			Expect(meta.IsStatusConditionTrue(application.Status.Conditions, ConditionTypeDryRun)).To(BeTrue())
+			Expect(recorder.Events).To(Receive(ContainSubstring("would create Deployment shop-frontend")))
+
+			By("not recording the same plan twice")
+			_, err = reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recorder.Events).NotTo(Receive())
+
+			By("applying the changes once the annotation is removed")
+			delete(application.Annotations, AnnotationDryRun)
+			Expect(fakeClient.Update(ctx, application)).To(Succeed())
+			_, err = reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "shop-frontend", Namespace: "default"}, &appsv1.Deployment{})).To(Succeed())
+			Expect(fakeClient.Get(ctx, key, application)).To(Succeed())
+			Expect(application.Status.Plan).To(BeNil())
+			Expect(meta.FindStatusCondition(application.Status.Conditions, ConditionTypeDryRun)).To(BeNil())
+		})
+		It("should report unowned child objects as conflicts", func() {
+			key := types.NamespacedName{Name: "legacy", Namespace: "default"}
+			application := &appv1.Application{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        key.Name,
+					Namespace:   key.Namespace,
+					UID:         "legacy-uid",
+					Annotations: map[string]string{AnnotationDryRun: "true"},
+				},
+				Spec: appv1.ApplicationSpec{Deployment: newDeploymentTemplate("nginx:1.27")},
+			}
+			legacy := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: "legacy-deployment", Namespace: "default"},
+				Spec:       newDeploymentTemplate("nginx:1.25").DeploymentSpec,
+			}
+			fakeClient, reconciler, recorder := newFakeReconciler(application, legacy)
+
+			_, err := reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.Get(ctx, key, application)).To(Succeed())
+			Expect(application.Status.Plan.Changes).To(ConsistOf(
+				appv1.PlannedChange{Action: appv1.PlannedActionCreate, Kind: "Service", Name: "legacy-service"},
+			))
+			condition := meta.FindStatusCondition(application.Status.Conditions, ConditionTypeConflict)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Message).To(ContainSubstring("Deployment legacy-deployment"))
+			Expect(recorder.Events).To(Receive(ContainSubstring("Conflict")))
+			Expect(fakeClient.Get(ctx, client.ObjectKeyFromObject(legacy), legacy)).To(Succeed())
+			Expect(legacy.OwnerReferences).To(BeEmpty())
+		})
+	})
+
+	Context("When a child object drifts from the desired state", func() {
+		It("should report the drift in Report mode and correct it in Enforce mode", func() {
+			key := types.NamespacedName{Name: "shop", Namespace: "default"}
+			application := &appv1.Application{
+				ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace},
+				Spec: appv1.ApplicationSpec{
+					Components:  []appv1.ComponentSpec{{Name: "frontend", Deployment: newDeploymentTemplate("nginx:1.27")}},
+					DriftPolicy: appv1.DriftPolicyReport,
+				},
+			}
+			fakeClient, reconciler, recorder := newFakeReconciler(application)
+			dpKey := types.NamespacedName{Name: "shop-frontend", Namespace: "default"}
+
+			_, err := reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.Get(ctx, key, application)).To(Succeed())
+			Expect(meta.IsStatusConditionFalse(application.Status.Conditions, ConditionTypeDrifted)).To(BeTrue())
+
+			By("hand-patching the Deployment")
+			dp := &appsv1.Deployment{}
+			Expect(fakeClient.Get(ctx, dpKey, dp)).To(Succeed())
+			replicas := int32(3)
+			dp.Spec.Replicas = &replicas
+			dp.Spec.Template.Spec.Containers[0].Image = "nginx:1.27-debug"
+			Expect(fakeClient.Update(ctx, dp)).To(Succeed())
+			for len(recorder.Events) > 0 {
+				<-recorder.Events
+			}
+
+			_, err = reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.Get(ctx, key, application)).To(Succeed())
+			condition := meta.FindStatusCondition(application.Status.Conditions, ConditionTypeDrifted)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+			Expect(condition.Message).To(Equal("Deployment shop-frontend: spec.replicas, spec.template.spec.containers[main].image"))
+			Expect(recorder.Events).To(Receive(ContainSubstring("DriftDetected")))
+			Expect(fakeClient.Get(ctx, dpKey, dp)).To(Succeed())
+			Expect(*dp.Spec.Replicas).To(Equal(int32(3)))
+
+			By("planning the correction in dry-run mode")
+			application.Spec.DriftPolicy = appv1.DriftPolicyEnforce
+			Expect(fakeClient.Update(ctx, application)).To(Succeed())
+			reconciler.DryRun = true
+			_, err = reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.Get(ctx, key, application)).To(Succeed())
+			Expect(application.Status.Plan.Changes).To(ConsistOf(appv1.PlannedChange{
+				Action: appv1.PlannedActionUpdate,
+				Kind:   "Deployment",
+				Name:   "shop-frontend",
+				Fields: []string{"spec.replicas", "spec.template.spec.containers[main].image"},
+			}))
+
+			By("restoring the Deployment in Enforce mode")
+			reconciler.DryRun = false
+			_, err = reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.Get(ctx, dpKey, dp)).To(Succeed())
+			Expect(*dp.Spec.Replicas).To(Equal(int32(1)))
+			Expect(dp.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:1.27"))
+			Expect(fakeClient.Get(ctx, key, application)).To(Succeed())
+			Expect(meta.FindStatusCondition(application.Status.Conditions, ConditionTypeDrifted)).To(BeNil())
+		})
+	})
+
+	Context("When the Application changes under every drift policy", func() {
+		for _, policy := range []appv1.DriftPolicy{appv1.DriftPolicyEnforce, appv1.DriftPolicyReport, appv1.DriftPolicyIgnore} {
+			It("should apply spec changes and only treat hand edits by the "+string(policy)+" policy", func() {
+				key := types.NamespacedName{Name: "shop", Namespace: "default"}
+				application := &appv1.Application{
+					ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace},
+					Spec: appv1.ApplicationSpec{
+						Components: []appv1.ComponentSpec{{
+							Name:       "frontend",
+							Deployment: newDeploymentTemplate("nginx:1.27"),
+							Service: &appv1.ServiceTemplate{ServiceSpec: corev1.ServiceSpec{
+								Ports: []corev1.ServicePort{{Port: 80}},
+							}},
+						}},
+						DriftPolicy: policy,
+					},
+				}
+				fakeClient, reconciler, _ := newFakeReconciler(application)
+				childKey := types.NamespacedName{Name: "shop-frontend", Namespace: "default"}
+				_, err := reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+				Expect(err).NotTo(HaveOccurred())
+
+				By("editing the image, replicas and port in the Application")
+				Expect(fakeClient.Get(ctx, key, application)).To(Succeed())
+				replicas := int32(3)
+				application.Spec.Components[0].Deployment.Replicas = &replicas
+				application.Spec.Components[0].Deployment.Template.Spec.Containers[0].Image = "nginx:1.28"
+				application.Spec.Components[0].Service.Ports[0].Port = 8080
+				Expect(fakeClient.Update(ctx, application)).To(Succeed())
+				_, err = reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+				Expect(err).NotTo(HaveOccurred())
+				dp := &appsv1.Deployment{}
+				Expect(fakeClient.Get(ctx, childKey, dp)).To(Succeed())
+				Expect(*dp.Spec.Replicas).To(Equal(int32(3)))
+				Expect(dp.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:1.28"))
+				svc := &corev1.Service{}
+				Expect(fakeClient.Get(ctx, childKey, svc)).To(Succeed())
+				Expect(svc.Spec.Ports[0].Port).To(Equal(int32(8080)))
+
+				By("hand-editing the Deployment")
+				dp.Spec.Template.Spec.Containers[0].Image = "nginx:1.28-debug"
+				Expect(fakeClient.Update(ctx, dp)).To(Succeed())
+				_, err = reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(fakeClient.Get(ctx, childKey, dp)).To(Succeed())
+				Expect(fakeClient.Get(ctx, key, application)).To(Succeed())
+				drifted := meta.FindStatusCondition(application.Status.Conditions, ConditionTypeDrifted)
+				switch policy {
+				case appv1.DriftPolicyEnforce:
+					Expect(dp.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:1.28"))
+					Expect(drifted).To(BeNil())
+				case appv1.DriftPolicyReport:
+					Expect(dp.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:1.28-debug"))
+					Expect(drifted.Message).To(Equal("Deployment shop-frontend: spec.template.spec.containers[main].image"))
+				case appv1.DriftPolicyIgnore:
+					Expect(dp.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:1.28-debug"))
+					Expect(drifted).To(BeNil())
+				}
+			})
+		}
+	})
+
+	Context("When comparing child objects defaulted by the API server", func() {
+		It("should ignore defaults and catch hand-patched fields outside the containers", func() {
+			key := types.NamespacedName{Name: "shop", Namespace: "default"}
+			template := newDeploymentTemplate("nginx:1.27")
+			template.Template.Spec.Containers[0].Env = []corev1.EnvVar{{
+				Name:      "POD_NAME",
+				ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}},
+			}}
+			application := &appv1.Application{
+				ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace},
+				Spec: appv1.ApplicationSpec{
+					Components:  []appv1.ComponentSpec{{Name: "frontend", Deployment: template}},
+					DriftPolicy: appv1.DriftPolicyReport,
+				},
+			}
+			fakeClient, reconciler, recorder := newFakeReconciler(application)
+			dpKey := types.NamespacedName{Name: "shop-frontend", Namespace: "default"}
+			_, err := reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+
+			By("restarting the Deployment on top of the defaults filled in by the API server")
+			dp := &appsv1.Deployment{}
+			Expect(fakeClient.Get(ctx, dpKey, dp)).To(Succeed())
+			Expect(dp.Spec.Template.Spec.Containers[0].Env[0].ValueFrom.FieldRef.APIVersion).To(Equal("v1"))
+			dp.Spec.Template.Annotations = map[string]string{"kubectl.kubernetes.io/restartedAt": "2024-10-01T00:00:00Z"}
+			Expect(fakeClient.Update(ctx, dp)).To(Succeed())
+			_, err = reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.Get(ctx, key, application)).To(Succeed())
+			Expect(meta.IsStatusConditionFalse(application.Status.Conditions, ConditionTypeDrifted)).To(BeTrue())
+
+			By("hand-patching the securityContext")
+			Expect(fakeClient.Get(ctx, dpKey, dp)).To(Succeed())
+			privileged := true
+			dp.Spec.Template.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{Privileged: &privileged}
+			Expect(fakeClient.Update(ctx, dp)).To(Succeed())
+			_, err = reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.Get(ctx, key, application)).To(Succeed())
+			condition := meta.FindStatusCondition(application.Status.Conditions, ConditionTypeDrifted)
+			Expect(condition.Message).To(Equal("Deployment shop-frontend: spec.template.spec.containers[main].securityContext"))
+
+			By("restoring it in Enforce mode without touching the restart annotation")
+			application.Spec.DriftPolicy = appv1.DriftPolicyEnforce
+			Expect(fakeClient.Update(ctx, application)).To(Succeed())
+			_, err = reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.Get(ctx, dpKey, dp)).To(Succeed())
+			Expect(dp.Spec.Template.Spec.Containers[0].SecurityContext).To(BeNil())
+			Expect(dp.Spec.Template.Annotations).To(HaveKey("kubectl.kubernetes.io/restartedAt"))
+			for len(recorder.Events) > 0 {
+				<-recorder.Events
+			}
+			_, err = reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recorder.Events).NotTo(Receive(ContainSubstring("DriftCorrected")))
+		})
+	})
+
+	Context("When reconciler feature gates are flipped", func() {
+		var (
+			fakeClient client.Client
+			reconciler *ApplicationReconciler
+			key        = types.NamespacedName{Name: "shop", Namespace: "default"}
+			dpKey      = types.NamespacedName{Name: "shop-frontend", Namespace: "default"}
+		)
+
+		BeforeEach(func() {
+			application := &appv1.Application{
+				ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace},
+				Spec: appv1.ApplicationSpec{
+					Components: []appv1.ComponentSpec{{Name: "frontend", Deployment: newDeploymentTemplate("nginx:1.27")}},
+				},
+			}
+			fakeClient, reconciler, _ = newFakeReconciler(application)
+			_, err := reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("should leave the replicas to an autoscaler only when Autoscaling is enabled", func() {
+			scaleTo := func(replicas int32) {
+				dp := &appsv1.Deployment{}
+				Expect(fakeClient.Get(ctx, dpKey, dp)).To(Succeed())
+				dp.Spec.Replicas = &replicas
+				Expect(fakeClient.Update(ctx, dp)).To(Succeed())
+			}
+			replicasAfterReconcile := func() int32 {
+				_, err := reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+				Expect(err).NotTo(HaveOccurred())
+				dp := &appsv1.Deployment{}
+				Expect(fakeClient.Get(ctx, dpKey, dp)).To(Succeed())
+				return *dp.Spec.Replicas
+			}
+
+			scaleTo(5)
+			Expect(replicasAfterReconcile()).To(Equal(int32(1)))
+
+			setFeatureGate(features.Autoscaling, true)
+			scaleTo(5)
+			Expect(replicasAfterReconcile()).To(Equal(int32(5)))
+		})
+	})
+
+	Context("When the child objects already exist", func() {
+		It("should refuse to take them over until adoption is allowed", func() {
+			key := types.NamespacedName{Name: "legacy", Namespace: "default"}
+			application := &appv1.Application{
+				ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace, UID: "legacy-uid"},
+				Spec:       appv1.ApplicationSpec{Deployment: newDeploymentTemplate("nginx:1.27")},
+			}
+			dpKey := types.NamespacedName{Name: "legacy-deployment", Namespace: "default"}
+			legacy := &appsv1.Deployment{
+				ObjectMeta: metav1.ObjectMeta{Name: dpKey.Name, Namespace: dpKey.Namespace},
+				Spec:       newDeploymentTemplate("nginx:1.25").DeploymentSpec,
+			}
+			fakeClient, reconciler, _ := newFakeReconciler(application, legacy)
+
+			_, err := reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.Get(ctx, key, application)).To(Succeed())
+			condition := meta.FindStatusCondition(application.Status.Conditions, ConditionTypeConflict)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Message).To(ContainSubstring("Deployment legacy-deployment"))
+			Expect(application.Status.Workflow).To(Equal(appsv1.DeploymentStatus{}))
+			Expect(fakeClient.Get(ctx, dpKey, legacy)).To(Succeed())
+			Expect(legacy.OwnerReferences).To(BeEmpty())
+			Expect(legacy.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:1.25"))
+			err = fakeClient.Get(ctx, types.NamespacedName{Name: "legacy-service", Namespace: "default"}, &corev1.Service{})
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+
+			By("annotating the Deployment for adoption")
+			legacy.Annotations = map[string]string{AnnotationAdopt: key.Name}
+			Expect(fakeClient.Update(ctx, legacy)).To(Succeed())
+			_, err = reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.Get(ctx, dpKey, legacy)).To(Succeed())
+			Expect(metav1.IsControlledBy(legacy, application)).To(BeTrue())
+			Expect(legacy.Spec.Template.Spec.Containers[0].Image).To(Equal("nginx:1.27"))
+			Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "legacy-service", Namespace: "default"}, &corev1.Service{})).To(Succeed())
+			Expect(fakeClient.Get(ctx, key, application)).To(Succeed())
+			Expect(meta.FindStatusCondition(application.Status.Conditions, ConditionTypeConflict)).To(BeNil())
+		})
+
+		It("should never adopt objects controlled by someone else", func() {
+			key := types.NamespacedName{Name: "legacy", Namespace: "default"}
+			application := &appv1.Application{
+				ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace, UID: "legacy-uid"},
+				Spec:       appv1.ApplicationSpec{Deployment: newDeploymentTemplate("nginx:1.27"), Adopt: true},
+			}
+			controller := true
+			svc := &corev1.Service{ObjectMeta: metav1.ObjectMeta{
+				Name:      "legacy-service",
+				Namespace: "default",
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: "example.com/v1", Kind: "Gateway", Name: "edge", UID: "edge-uid", Controller: &controller,
+				}},
+			}}
+			fakeClient, reconciler, _ := newFakeReconciler(application, svc)
+
+			_, err := reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.Get(ctx, key, application)).To(Succeed())
+			condition := meta.FindStatusCondition(application.Status.Conditions, ConditionTypeConflict)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Message).To(ContainSubstring("Service legacy-service (controlled by Gateway edge)"))
+		})
+	})
+
+	Context("When reconciling an Application with dependencies", func() {
+		It("should wait until every dependency is Ready", func() {
+			key := types.NamespacedName{Name: "web", Namespace: "default"}
+			application := &appv1.Application{
+				ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace},
+				Spec: appv1.ApplicationSpec{
+					Components: []appv1.ComponentSpec{{Name: "frontend", Deployment: newDeploymentTemplate("nginx:1.27")}},
+					DependsOn:  []appv1.ApplicationReference{{Name: "db", Namespace: "data"}},
+				},
+			}
+			dependency := &appv1.Application{ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "data"}}
+			fakeClient, reconciler, _ := newFakeReconciler(application, dependency)
+
+			_, err := reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.Get(ctx, key, application)).To(Succeed())
+			condition := meta.FindStatusCondition(application.Status.Conditions, ConditionTypeWaitingForDependencies)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+			Expect(condition.Message).To(ContainSubstring("data/db"))
+			err = fakeClient.Get(ctx, types.NamespacedName{Name: "web-frontend", Namespace: "default"}, &appsv1.Deployment{})
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+
+			By("finding the dependent Application from the dependency")
+			Expect(reconciler.findDependents(ctx, dependency)).To(ConsistOf(reconcile.Request{NamespacedName: key}))
+
+			By("marking the dependency as Ready")
+			meta.SetStatusCondition(&dependency.Status.Conditions, metav1.Condition{Type: ConditionTypeReady, Status: metav1.ConditionTrue, Reason: "AllComponentsReady"})
+			Expect(fakeClient.Status().Update(ctx, dependency)).To(Succeed())
+			_, err = reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-frontend", Namespace: "default"}, &appsv1.Deployment{})).To(Succeed())
+			Expect(fakeClient.Get(ctx, key, application)).To(Succeed())
+			Expect(meta.IsStatusConditionFalse(application.Status.Conditions, ConditionTypeWaitingForDependencies)).To(BeTrue())
+		})
+
+		It("should report dependencies outside the watched namespaces", func() {
+			key := types.NamespacedName{Name: "web", Namespace: "default"}
+			application := &appv1.Application{
+				ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace},
+				Spec: appv1.ApplicationSpec{
+					Components: []appv1.ComponentSpec{{Name: "frontend", Deployment: newDeploymentTemplate("nginx:1.27")}},
+					DependsOn:  []appv1.ApplicationReference{{Name: "db", Namespace: "data"}},
+				},
+			}
+			fakeClient, reconciler, _ := newFakeReconciler(application)
+			appScope, err := scope.New([]string{"default"}, "", "")
+			Expect(err).NotTo(HaveOccurred())
+			reconciler.Scope = appScope
+
+			_, err = reconciler.Reconcile(ctx, reconcile.Request{NamespacedName: key})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fakeClient.Get(ctx, key, application)).To(Succeed())
+			condition := meta.FindStatusCondition(application.Status.Conditions, ConditionTypeWaitingForDependencies)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Message).To(Equal("Blocked by: data/db (outside the operator's scope)"))
+		})
+	})
 })
+
+// newFakeReconciler 使用 fake client 的 reconciler，和 manager 中一样建立 spec.dependsOn 的索引
+func newFakeReconciler(objs ...client.Object) (client.Client, *ApplicationReconciler, *record.FakeRecorder) {
+	testScheme := runtime.NewScheme()
+	Expect(clientgoscheme.AddToScheme(testScheme)).To(Succeed())
+	Expect(appv1.AddToScheme(testScheme)).To(Succeed())
+	fakeClient := fake.NewClientBuilder().
+		WithScheme(testScheme).
+		WithObjects(objs...).
+		WithStatusSubresource(&appv1.Application{}).
+		WithIndex(&appv1.Application{}, dependsOnIndexField, dependsOnIndexer).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+				simulateDefaults(obj)
+				return c.Create(ctx, obj, opts...)
+			},
+			Update: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.UpdateOption) error {
+				simulateDefaults(obj)
+				return c.Update(ctx, obj, opts...)
+			},
+		}).
+		Build()
+	recorder := record.NewFakeRecorder(64)
+	return fakeClient, &ApplicationReconciler{Client: fakeClient, Scheme: testScheme, Recorder: recorder}, recorder
+}
+
+// simulateDefaults 像 apiserver 一样为写入的子资源填充一部分默认值，包括 dry-run 的请求，
+// 用来验证默认值不会被当成漂移
+func simulateDefaults(obj client.Object) {
+	switch obj := obj.(type) {
+	case *appsv1.Deployment:
+		if obj.Spec.Replicas == nil {
+			replicas := int32(1)
+			obj.Spec.Replicas = &replicas
+		}
+		podSpec := &obj.Spec.Template.Spec
+		if podSpec.DNSPolicy == "" {
+			podSpec.DNSPolicy = corev1.DNSClusterFirst
+		}
+		for i := range podSpec.Containers {
+			container := &podSpec.Containers[i]
+			if container.ImagePullPolicy == "" {
+				container.ImagePullPolicy = corev1.PullIfNotPresent
+			}
+			if container.TerminationMessagePath == "" {
+				container.TerminationMessagePath = corev1.TerminationMessagePathDefault
+			}
+			for _, env := range container.Env {
+				if env.ValueFrom != nil && env.ValueFrom.FieldRef != nil && env.ValueFrom.FieldRef.APIVersion == "" {
+					env.ValueFrom.FieldRef.APIVersion = "v1"
+				}
+			}
+		}
+	case *corev1.Service:
+		if obj.Spec.Type == "" {
+			obj.Spec.Type = corev1.ServiceTypeClusterIP
+		}
+		if obj.Spec.SessionAffinity == "" {
+			obj.Spec.SessionAffinity = corev1.ServiceAffinityNone
+		}
+		for i := range obj.Spec.Ports {
+			if obj.Spec.Ports[i].Protocol == "" {
+				obj.Spec.Ports[i].Protocol = corev1.ProtocolTCP
+			}
+		}
+	}
+}
+
+// setFeatureGate 在当前用例中设置 feature gate，结束后恢复原来的值
+func setFeatureGate(feature featuregate.Feature, enabled bool) {
+	previous := features.Enabled(feature)
+	Expect(features.DefaultMutableFeatureGate.SetFromMap(map[string]bool{string(feature): enabled})).To(Succeed())
+	DeferCleanup(func() {
+		Expect(features.DefaultMutableFeatureGate.SetFromMap(map[string]bool{string(feature): previous})).To(Succeed())
+	})
+}
+
+// newDeploymentTemplate 测试使用的单容器 pod 模板
+func newDeploymentTemplate(image string) appv1.DeploymentTemplate {
+	replicas := int32(1)
+	return appv1.DeploymentTemplate{DeploymentSpec: appsv1.DeploymentSpec{
+		Replicas: &replicas,
+		Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "main", Image: image}},
+		}},
+	}}
+}
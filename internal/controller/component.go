@@ -0,0 +1,184 @@
+package controller
+
+import (
+	"context"
+
+	appv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// LabelInstance 和 LabelComponent 是组件 pod 在没有指定 selector 时默认使用的标签
+	LabelInstance  = "app.kubernetes.io/instance"
+	LabelComponent = "app.kubernetes.io/component"
+)
+
+// hasDefaultWorkload 判断是否需要调谐 spec.deployment/spec.service 对应的 <app>-deployment 和 <app>-service
+// 只声明了 components 的应用不再创建默认的那一对资源
+func hasDefaultWorkload(application *appv1.Application) bool {
+	return len(application.Spec.Components) == 0 || len(application.Spec.Deployment.Template.Spec.Containers) > 0
+}
+
+// componentName 组件子资源的名称，Deployment 和 Service 同名：<app>-<component>
+func componentName(application *appv1.Application, component *appv1.ComponentSpec) string {
+	return application.Name + "-" + component.Name
+}
+
+// componentLabels 组件 pod 的标签，优先使用组件自己声明的 selector
+func componentLabels(application *appv1.Application, component *appv1.ComponentSpec) map[string]string {
+	if component.Deployment.Selector != nil && len(component.Deployment.Selector.MatchLabels) > 0 {
+		labels := make(map[string]string, len(component.Deployment.Selector.MatchLabels))
+		for k, v := range component.Deployment.Selector.MatchLabels {
+			labels[k] = v
+		}
+		return labels
+	}
+	return map[string]string{
+		LabelInstance:  application.Name,
+		LabelComponent: component.Name,
+	}
+}
+
+// reconcileComponents 为每个组件调谐一对 Deployment/Service，并汇总到 application.Status.Components
+// 这里只修改内存中的状态，最后由 Reconcile 统一更新
+func (r *ApplicationReconciler) reconcileComponents(ctx context.Context, application *appv1.Application) (ctrl.Result, error) {
+	statuses := make([]appv1.ComponentStatus, 0, len(application.Spec.Components))
+	for i := range application.Spec.Components {
+		component := &application.Spec.Components[i]
+		status := appv1.ComponentStatus{Name: component.Name}
+
+		dp, err := r.reconcileComponentDeployment(ctx, application, component)
+		if err != nil {
+			return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+		}
+		status.Workflow = dp.Status
+
+		if component.Service != nil {
+			svc, err := r.reconcileComponentService(ctx, application, component)
+			if err != nil {
+				return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+			}
+			status.Network = svc.Status.DeepCopy()
+		}
+		statuses = append(statuses, status)
+	}
+	if len(statuses) == 0 {
+		statuses = nil
+	}
+	application.Status.Components = statuses
+	return ctrl.Result{}, nil
+}
+
+func (r *ApplicationReconciler) reconcileComponentDeployment(ctx context.Context, application *appv1.Application, component *appv1.ComponentSpec) (*appsv1.Deployment, error) {
+	setupLog := log.FromContext(ctx).WithName("reconcileComponentDeployment")
+	appNamespace := application.Namespace
+	appName := componentName(application, component)
+
+	dp := &appsv1.Deployment{}
+	err := r.Get(ctx, client.ObjectKey{Namespace: appNamespace, Name: appName}, dp)
+	// 已经存在，直接返回用于记录状态
+	if err == nil {
+		setupLog.V(1).Info("The component deployment has already exist.", "DeploymentNamespace", appNamespace, "DeploymentName", appName)
+		return dp, nil
+	}
+	if !errors.IsNotFound(err) {
+		setupLog.Error(err, "Failed to get the component Deployment.", "DeploymentNamespace", appNamespace, "DeploymentName", appName)
+		return nil, err
+	}
+
+	newDp := desiredComponentDeployment(application, component)
+	if err := ctrl.SetControllerReference(application, newDp, r.Scheme); err != nil {
+		setupLog.Error(err, "Failed to set the owner reference for the component Deployment.", "DeploymentNamespace", appNamespace, "DeploymentName", appName)
+		return nil, err
+	}
+	if err := r.Create(ctx, newDp); err != nil {
+		setupLog.Error(err, "Failed to create the component Deployment.", "DeploymentNamespace", appNamespace, "DeploymentName", appName)
+		return nil, err
+	}
+	setupLog.Info("The component Deployment has been created.", "DeploymentNamespace", appNamespace, "DeploymentName", appName)
+	r.Recorder.Eventf(application, corev1.EventTypeNormal, "Modified", "Component %s deployment create: deployment Name:%s deployment Namespace:%s", component.Name, newDp.Name, newDp.Namespace)
+	return newDp, nil
+}
+
+func (r *ApplicationReconciler) reconcileComponentService(ctx context.Context, application *appv1.Application, component *appv1.ComponentSpec) (*corev1.Service, error) {
+	setupLog := log.FromContext(ctx).WithName("reconcileComponentService")
+	appNamespace := application.Namespace
+	appName := componentName(application, component)
+
+	svc := &corev1.Service{}
+	err := r.Get(ctx, client.ObjectKey{Namespace: appNamespace, Name: appName}, svc)
+	if err == nil {
+		setupLog.V(1).Info("The component service has already exist.", "ServiceNamespace", appNamespace, "ServiceName", appName)
+		return svc, nil
+	}
+	if !errors.IsNotFound(err) {
+		setupLog.Error(err, "Failed to get the component Service.", "ServiceNamespace", appNamespace, "ServiceName", appName)
+		return nil, err
+	}
+
+	svc = desiredComponentService(application, component)
+	if err := ctrl.SetControllerReference(application, svc, r.Scheme); err != nil {
+		setupLog.Error(err, "Failed to set the owner reference for the component Service.", "ServiceNamespace", appNamespace, "ServiceName", appName)
+		return nil, err
+	}
+	if err := r.Create(ctx, svc); err != nil {
+		setupLog.Error(err, "Failed to create the component Service.", "ServiceNamespace", appNamespace, "ServiceName", appName)
+		return nil, err
+	}
+	setupLog.Info("The component Service has been created.", "ServiceNamespace", appNamespace, "ServiceName", appName)
+	return svc, nil
+}
+
+// staleChildren 属于 Application 但不在期望状态中的子资源，例如已经从 spec.components 中移除的组件
+func (r *ApplicationReconciler) staleChildren(ctx context.Context, application *appv1.Application) ([]client.Object, error) {
+	desired := make(map[string]bool)
+	for _, obj := range desiredObjects(application) {
+		desired[kindOf(obj)+"/"+obj.GetName()] = true
+	}
+	deployments := &appsv1.DeploymentList{}
+	if err := r.List(ctx, deployments, client.InNamespace(application.Namespace)); err != nil {
+		return nil, err
+	}
+	services := &corev1.ServiceList{}
+	if err := r.List(ctx, services, client.InNamespace(application.Namespace)); err != nil {
+		return nil, err
+	}
+	var children []client.Object
+	for i := range deployments.Items {
+		children = append(children, &deployments.Items[i])
+	}
+	for i := range services.Items {
+		children = append(children, &services.Items[i])
+	}
+	var stale []client.Object
+	for _, obj := range children {
+		if metav1.IsControlledBy(obj, application) && !desired[kindOf(obj)+"/"+obj.GetName()] {
+			stale = append(stale, obj)
+		}
+	}
+	return stale, nil
+}
+
+// pruneChildren 删除 staleChildren，组件移除之后不再继续运行
+func (r *ApplicationReconciler) pruneChildren(ctx context.Context, application *appv1.Application) error {
+	setupLog := log.FromContext(ctx).WithName("pruneChildren")
+	stale, err := r.staleChildren(ctx, application)
+	if err != nil {
+		return err
+	}
+	for _, obj := range stale {
+		if err := r.Delete(ctx, obj); client.IgnoreNotFound(err) != nil {
+			setupLog.Error(err, "Failed to delete the stale child object.", "kind", kindOf(obj), "name", obj.GetName())
+			return err
+		}
+		setupLog.Info("The stale child object has been deleted.", "kind", kindOf(obj), "name", obj.GetName())
+		r.Recorder.Eventf(application, corev1.EventTypeNormal, "Pruned", "%s %s deleted, it is no longer part of the Application", kindOf(obj), obj.GetName())
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+
+	appv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// ConditionTypeReady 所有工作负载（默认 deployment 和所有组件）都已就绪
+	ConditionTypeReady = "Ready"
+)
+
+// deploymentReady 判断 deployment 的可用副本数是否满足期望副本数
+func deploymentReady(status appsv1.DeploymentStatus, replicas *int32) bool {
+	desired := int32(1)
+	if replicas != nil {
+		desired = *replicas
+	}
+	return status.AvailableReplicas >= desired && status.UnavailableReplicas == 0
+}
+
+// setReadyCondition 根据默认 deployment 和各组件的状态聚合出 Ready condition
+func setReadyCondition(application *appv1.Application) {
+	var notReady []string
+	if hasDefaultWorkload(application) && !deploymentReady(application.Status.Workflow, application.Spec.Deployment.Replicas) {
+		notReady = append(notReady, application.Name+"-deployment")
+	}
+	for i := range application.Spec.Components {
+		component := &application.Spec.Components[i]
+		ready := false
+		for _, status := range application.Status.Components {
+			if status.Name == component.Name {
+				ready = deploymentReady(status.Workflow, component.Deployment.Replicas)
+				break
+			}
+		}
+		if !ready {
+			notReady = append(notReady, component.Name)
+		}
+	}
+
+	condition := metav1.Condition{
+		Type:               ConditionTypeReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             "AllComponentsReady",
+		Message:            "All workloads are available",
+		ObservedGeneration: application.Generation,
+	}
+	if len(notReady) > 0 {
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "ComponentsNotReady"
+		condition.Message = fmt.Sprintf("Waiting for: %s", strings.Join(notReady, ", "))
+	}
+	meta.SetStatusCondition(&application.Status.Conditions, condition)
+}
@@ -0,0 +1,109 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	appv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	// ConditionTypeWaitingForDependencies 依赖的 Application 还没有全部 Ready
+	ConditionTypeWaitingForDependencies = "WaitingForDependencies"
+
+	// dependsOnIndexField 索引 spec.dependsOn，值为被依赖应用的 namespace/name，用于反查依赖它的应用
+	dependsOnIndexField = ".spec.dependsOn"
+)
+
+// dependsOnIndexer 为每个 Application 生成其依赖项的索引值
+func dependsOnIndexer(obj client.Object) []string {
+	application, ok := obj.(*appv1.Application)
+	if !ok || len(application.Spec.DependsOn) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(application.Spec.DependsOn))
+	for _, ref := range application.Spec.DependsOn {
+		keys = append(keys, ref.NamespacedName(application.Namespace).String())
+	}
+	return keys
+}
+
+// blockingDependencies 返回还没有 Ready 的依赖项，不存在的依赖和当前实例范围之外的依赖同样视为阻塞
+func (r *ApplicationReconciler) blockingDependencies(ctx context.Context, application *appv1.Application) ([]string, error) {
+	var blocking []string
+	for _, ref := range application.Spec.DependsOn {
+		key := ref.NamespacedName(application.Namespace)
+		// 缓存中没有其他 namespace 的对象，读取会一直失败
+		if !r.Scope.CachesNamespace(key.Namespace) {
+			blocking = append(blocking, key.String()+" (outside the operator's scope)")
+			continue
+		}
+		dependency := &appv1.Application{}
+		if err := r.Get(ctx, key, dependency); err != nil {
+			if errors.IsNotFound(err) {
+				blocking = append(blocking, key.String()+" (not found)")
+				continue
+			}
+			return nil, err
+		}
+		if !meta.IsStatusConditionTrue(dependency.Status.Conditions, ConditionTypeReady) {
+			blocking = append(blocking, key.String())
+		}
+	}
+	return blocking, nil
+}
+
+// setWaitingForDependenciesCondition 记录阻塞当前应用的依赖项
+func setWaitingForDependenciesCondition(application *appv1.Application, blocking []string) {
+	if len(application.Spec.DependsOn) == 0 {
+		meta.RemoveStatusCondition(&application.Status.Conditions, ConditionTypeWaitingForDependencies)
+		return
+	}
+	condition := metav1.Condition{
+		Type:               ConditionTypeWaitingForDependencies,
+		Status:             metav1.ConditionFalse,
+		Reason:             "DependenciesReady",
+		Message:            "All dependencies are ready",
+		ObservedGeneration: application.Generation,
+	}
+	if len(blocking) > 0 {
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "DependenciesNotReady"
+		condition.Message = fmt.Sprintf("Blocked by: %s", strings.Join(blocking, ", "))
+	}
+	meta.SetStatusCondition(&application.Status.Conditions, condition)
+}
+
+// findDependents 被依赖的 Application 发生变化时，找出所有依赖它的应用重新调谐
+func (r *ApplicationReconciler) findDependents(ctx context.Context, obj client.Object) []reconcile.Request {
+	dependents := &appv1.ApplicationList{}
+	key := client.ObjectKeyFromObject(obj).String()
+	if err := r.List(ctx, dependents, client.MatchingFields{dependsOnIndexField: key}); err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list dependent Applications.", "dependency", key)
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(dependents.Items))
+	for i := range dependents.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&dependents.Items[i])})
+	}
+	return requests
+}
+
+// readyConditionChanged 只有 Ready condition 的状态发生变化才需要通知依赖方
+func readyConditionChanged(e event.UpdateEvent) bool {
+	oldApp, okOld := e.ObjectOld.(*appv1.Application)
+	newApp, okNew := e.ObjectNew.(*appv1.Application)
+	if !okOld || !okNew {
+		return false
+	}
+	return meta.IsStatusConditionTrue(oldApp.Status.Conditions, ConditionTypeReady) !=
+		meta.IsStatusConditionTrue(newApp.Status.Conditions, ConditionTypeReady)
+}
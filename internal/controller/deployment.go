@@ -52,13 +52,7 @@ func (r *ApplicationReconciler) reconcileDeployment(ctx context.Context, applica
 		setupLog.Error(err, "Failed to get the Deployment,will request after a short time.", "DeploymentNamespace", appNamespace, "DeploymentName", appName)
 		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
 	}
-	newDp := &appsv1.Deployment{}
-	newDp.SetName(appName)
-	newDp.SetNamespace(appNamespace)
-	newDp.SetLabels(application.Labels)
-	newDp.Spec = application.Spec.Deployment.DeploymentSpec
-	newDp.Spec.Selector.MatchLabels = application.Spec.Deployment.Selector.MatchLabels
-	newDp.Spec.Template.SetLabels(application.Spec.Deployment.Selector.MatchLabels)
+	newDp := desiredDeployment(application)
 	// 设置 OwnerReference，使 dp 成为 Application 的子资源
 	if err := ctrl.SetControllerReference(application, newDp, r.Scheme); err != nil {
 		setupLog.Error(err, "Failed to set the owner reference for the Deployment.", "DeploymentNamespace", appNamespace, "DeploymentName", appName)
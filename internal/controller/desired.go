@@ -0,0 +1,137 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	appv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+	"github.com/aloys.zy/aloys-application-operator-webhook/internal/features"
+)
+
+// AnnotationAppliedHash 子资源上记录最后一次按 Application 写入的期望状态的哈希。
+// 和当前的期望状态不同说明 Application 修改了，相同时子资源上的差异才是手工修改的漂移
+const AnnotationAppliedHash = "apps.aloys.cn/applied-hash"
+
+// 期望的子资源只由 Application 决定，创建、预览和比较漂移都使用这里的结果，
+// OwnerReference 需要 Scheme，由调用方设置
+
+// desiredDeployment spec.deployment 对应的 <app>-deployment
+func desiredDeployment(application *appv1.Application) *appsv1.Deployment {
+	dp := &appsv1.Deployment{}
+	dp.SetName(application.Name + "-deployment")
+	dp.SetNamespace(application.Namespace)
+	dp.SetLabels(application.Labels)
+	dp.Spec = *application.Spec.Deployment.DeploymentSpec.DeepCopy()
+	if dp.Spec.Selector == nil {
+		dp.Spec.Selector = &metav1.LabelSelector{}
+	}
+	dp.Spec.Template.SetLabels(dp.Spec.Selector.MatchLabels)
+	setAppliedHash(dp)
+	return dp
+}
+
+// desiredService spec.service 对应的 <app>-service
+func desiredService(application *appv1.Application) *corev1.Service {
+	svc := &corev1.Service{}
+	svc.SetName(application.Name + "-service")
+	svc.SetNamespace(application.Namespace)
+	svc.SetLabels(application.Labels)
+	svc.Spec = *application.Spec.Service.ServiceSpec.DeepCopy()
+	svc.Spec.Selector = application.Labels
+	setAppliedHash(svc)
+	return svc
+}
+
+// desiredComponentDeployment 组件对应的 <app>-<component> Deployment
+func desiredComponentDeployment(application *appv1.Application, component *appv1.ComponentSpec) *appsv1.Deployment {
+	labels := componentLabels(application, component)
+	dp := &appsv1.Deployment{}
+	dp.SetName(componentName(application, component))
+	dp.SetNamespace(application.Namespace)
+	dp.SetLabels(application.Labels)
+	dp.Spec = *component.Deployment.DeploymentSpec.DeepCopy()
+	dp.Spec.Selector = &metav1.LabelSelector{MatchLabels: labels}
+	dp.Spec.Template.SetLabels(labels)
+	setAppliedHash(dp)
+	return dp
+}
+
+// desiredComponentService 组件对应的 <app>-<component> Service，只选中该组件自己的 pod
+func desiredComponentService(application *appv1.Application, component *appv1.ComponentSpec) *corev1.Service {
+	svc := &corev1.Service{}
+	svc.SetName(componentName(application, component))
+	svc.SetNamespace(application.Namespace)
+	svc.SetLabels(application.Labels)
+	svc.Spec = *component.Service.ServiceSpec.DeepCopy()
+	svc.Spec.Selector = componentLabels(application, component)
+	setAppliedHash(svc)
+	return svc
+}
+
+// desiredObjects Application 的所有子资源，顺序和 Reconcile 中的调谐顺序一致
+func desiredObjects(application *appv1.Application) []client.Object {
+	var objs []client.Object
+	if hasDefaultWorkload(application) {
+		objs = append(objs, desiredDeployment(application), desiredService(application))
+	}
+	for i := range application.Spec.Components {
+		component := &application.Spec.Components[i]
+		objs = append(objs, desiredComponentDeployment(application, component))
+		if component.Service != nil {
+			objs = append(objs, desiredComponentService(application, component))
+		}
+	}
+	return objs
+}
+
+// setAppliedHash 在期望的对象上记录自己的哈希，创建和更新子资源时一起写入
+func setAppliedHash(obj client.Object) {
+	obj.SetAnnotations(map[string]string{AnnotationAppliedHash: appliedHash(obj)})
+}
+
+// appliedHash 计算写入子资源的标签和 spec 的哈希。
+// 开启 Autoscaling 时副本数交给自动扩缩容控制器，不参与计算
+func appliedHash(obj client.Object) string {
+	content := map[string]interface{}{"labels": obj.GetLabels()}
+	switch obj := obj.(type) {
+	case *appsv1.Deployment:
+		spec := obj.Spec.DeepCopy()
+		if features.Enabled(features.Autoscaling) {
+			spec.Replicas = nil
+		}
+		content["spec"] = spec
+	case *corev1.Service:
+		content["spec"] = obj.Spec
+	}
+	// 这里的类型都可以序列化，不会返回 error
+	data, _ := json.Marshal(content)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// specChanged 子资源最后一次写入之后 Application 修改了期望状态，或者子资源还没有按 Application 写入过
+func specChanged(desired, live client.Object) bool {
+	return live.GetAnnotations()[AnnotationAppliedHash] != desired.GetAnnotations()[AnnotationAppliedHash]
+}
@@ -0,0 +1,290 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+	"github.com/aloys.zy/aloys-application-operator-webhook/internal/features"
+)
+
+// ConditionTypeDrifted Report 模式下记录子资源和期望的状态是否一致
+const ConditionTypeDrifted = "Drifted"
+
+// driftPolicy 旧对象没有这个字段，按 Enforce 处理
+func driftPolicy(application *appv1.Application) appv1.DriftPolicy {
+	if application.Spec.DriftPolicy == "" {
+		return appv1.DriftPolicyEnforce
+	}
+	return application.Spec.DriftPolicy
+}
+
+// objectDrift 一个子资源中和期望的状态不一致的字段
+type objectDrift struct {
+	Kind   string
+	Name   string
+	Fields []string
+}
+
+// reconcileDrift 把 Application 的修改更新到已经存在的子资源，这部分不受 driftPolicy 影响。
+// 子资源上记录的哈希和期望状态一致时，剩下的差异是手工修改的漂移，Enforce 时恢复，Report 时只记录 condition 和事件。
+// 这里只修改内存中的状态，最后由 Reconcile 统一更新
+func (r *ApplicationReconciler) reconcileDrift(ctx context.Context, application *appv1.Application) error {
+	setupLog := log.FromContext(ctx).WithName("reconcileDrift")
+	policy := driftPolicy(application)
+	var drifts []objectDrift
+	for _, desired := range desiredObjects(application) {
+		live := emptyLike(desired)
+		if err := r.Get(ctx, client.ObjectKeyFromObject(desired), live); err != nil {
+			// 刚刚创建的对象可能还没有出现在缓存中，下次调谐再比较
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return err
+		}
+		kind, name := kindOf(desired), desired.GetName()
+		if specChanged(desired, live) {
+			applyDesired(desired, live)
+			if err := r.Update(ctx, live); err != nil {
+				setupLog.Error(err, "Failed to update the child object.", "kind", kind, "name", name)
+				return err
+			}
+			setupLog.Info("Updated the child object to match the Application", "kind", kind, "name", name)
+			r.Recorder.Eventf(application, corev1.EventTypeNormal, "Updated", "%s %s updated to match the Application", kind, name)
+			continue
+		}
+		if policy == appv1.DriftPolicyIgnore {
+			continue
+		}
+		fields, err := r.driftedFields(ctx, desired, live)
+		if err != nil {
+			setupLog.Error(err, "Failed to compare the child object.", "kind", kind, "name", name)
+			return err
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		if policy == appv1.DriftPolicyReport {
+			drifts = append(drifts, objectDrift{Kind: kind, Name: name, Fields: fields})
+			continue
+		}
+		applyDesired(desired, live)
+		if err := r.Update(ctx, live); err != nil {
+			setupLog.Error(err, "Failed to correct the drift.", "kind", kind, "name", name)
+			return err
+		}
+		setupLog.Info("Corrected the drift", "kind", kind, "name", name, "fields", fields)
+		r.Recorder.Eventf(application, corev1.EventTypeNormal, "DriftCorrected", "%s %s restored: %s", kind, name, strings.Join(fields, ", "))
+	}
+	if policy != appv1.DriftPolicyReport {
+		meta.RemoveStatusCondition(&application.Status.Conditions, ConditionTypeDrifted)
+		return nil
+	}
+	setDriftedCondition(application, drifts, r.Recorder)
+	return nil
+}
+
+// setDriftedCondition 只在漂移的内容变化时记录事件，避免每次调谐都产生重复的事件
+func setDriftedCondition(application *appv1.Application, drifts []objectDrift, recorder record.EventRecorder) {
+	condition := metav1.Condition{
+		Type:               ConditionTypeDrifted,
+		Status:             metav1.ConditionFalse,
+		Reason:             "InSync",
+		Message:            "the child objects match the desired state",
+		ObservedGeneration: application.Generation,
+	}
+	if len(drifts) > 0 {
+		items := make([]string, 0, len(drifts))
+		for _, drift := range drifts {
+			items = append(items, fmt.Sprintf("%s %s: %s", drift.Kind, drift.Name, strings.Join(drift.Fields, ", ")))
+		}
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "DriftDetected"
+		condition.Message = strings.Join(items, "; ")
+	}
+	previous := meta.FindStatusCondition(application.Status.Conditions, ConditionTypeDrifted)
+	if len(drifts) > 0 && (previous == nil || previous.Message != condition.Message) {
+		recorder.Event(application, corev1.EventTypeWarning, "DriftDetected", condition.Message)
+	}
+	meta.SetStatusCondition(&application.Status.Conditions, condition)
+}
+
+// driftedFields 返回 live 中和期望状态不一致的字段路径，例如 spec.template.spec.containers[main].image。
+// 把期望状态写入 live 的副本后通过 server-side dry-run 更新，apiserver 填充默认值之后的结果和 live 比较，
+// 默认值、apiserver 分配和其他控制器写入的字段都不算漂移
+func (r *ApplicationReconciler) driftedFields(ctx context.Context, desired, live client.Object) ([]string, error) {
+	candidate := live.DeepCopyObject().(client.Object)
+	applyDesired(desired, candidate)
+	if err := r.Update(ctx, candidate, client.DryRunAll); err != nil {
+		return nil, err
+	}
+	wantContent, err := runtime.DefaultUnstructuredConverter.ToUnstructured(candidate)
+	if err != nil {
+		return nil, err
+	}
+	gotContent, err := runtime.DefaultUnstructuredConverter.ToUnstructured(live)
+	if err != nil {
+		return nil, err
+	}
+	return diffPaths("spec", wantContent["spec"], gotContent["spec"]), nil
+}
+
+// keepAllocated 复制 apiserver 分配的 clusterIP、nodePort 等字段，没有在期望状态中声明时保持实际的值
+func keepAllocated(want, got *corev1.ServiceSpec) {
+	if want.ClusterIP == "" {
+		want.ClusterIP = got.ClusterIP
+	}
+	if len(want.ClusterIPs) == 0 {
+		want.ClusterIPs = got.ClusterIPs
+	}
+	if len(want.IPFamilies) == 0 {
+		want.IPFamilies = got.IPFamilies
+	}
+	if want.IPFamilyPolicy == nil {
+		want.IPFamilyPolicy = got.IPFamilyPolicy
+	}
+	if want.HealthCheckNodePort == 0 {
+		want.HealthCheckNodePort = got.HealthCheckNodePort
+	}
+	for i := range want.Ports {
+		port := &want.Ports[i]
+		if port.NodePort != 0 {
+			continue
+		}
+		for _, existing := range got.Ports {
+			if existing.Port == port.Port && portProtocol(existing) == portProtocol(*port) {
+				port.NodePort = existing.NodePort
+			}
+		}
+	}
+}
+
+// portProtocol 没有指定协议的端口由 apiserver 默认为 TCP
+func portProtocol(port corev1.ServicePort) corev1.Protocol {
+	if port.Protocol == "" {
+		return corev1.ProtocolTCP
+	}
+	return port.Protocol
+}
+
+// diffPaths 逐层比较 unstructured 的内容，列表中的元素有 name 时用 name 标识，否则使用下标
+func diffPaths(path string, want, got interface{}) []string {
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			return []string{path}
+		}
+		keys := make([]string, 0, len(w)+len(g))
+		for k := range w {
+			keys = append(keys, k)
+		}
+		for k := range g {
+			if _, ok := w[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		var paths []string
+		for _, k := range keys {
+			paths = append(paths, diffPaths(path+"."+k, w[k], g[k])...)
+		}
+		return paths
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok || len(w) != len(g) {
+			return []string{path}
+		}
+		var paths []string
+		for i := range w {
+			key := listKey(w[i], i)
+			if key != listKey(g[i], i) {
+				return []string{path}
+			}
+			paths = append(paths, diffPaths(path+"["+key+"]", w[i], g[i])...)
+		}
+		return paths
+	default:
+		if !reflect.DeepEqual(want, got) {
+			return []string{path}
+		}
+		return nil
+	}
+}
+
+func listKey(item interface{}, index int) string {
+	if m, ok := item.(map[string]interface{}); ok {
+		if name, ok := m["name"].(string); ok && name != "" {
+			return name
+		}
+	}
+	return strconv.Itoa(index)
+}
+
+// applyDesired 把期望的标签和 spec 写入 live 并记录哈希，不能修改的 selector、apiserver 分配的字段
+// 和其他控制器写入的模板标签注解保持不变。开启 Autoscaling 时保留实际的副本数
+func applyDesired(desired, live client.Object) {
+	live.SetLabels(mergeKeys(live.GetLabels(), desired.GetLabels()))
+	live.SetAnnotations(mergeKeys(live.GetAnnotations(), desired.GetAnnotations()))
+	switch desired := desired.(type) {
+	case *appsv1.Deployment:
+		dp := live.(*appsv1.Deployment)
+		spec := desired.Spec.DeepCopy()
+		spec.Selector = dp.Spec.Selector
+		if features.Enabled(features.Autoscaling) && dp.Spec.Replicas != nil {
+			spec.Replicas = dp.Spec.Replicas
+		}
+		spec.Template.Labels = mergeKeys(dp.Spec.Template.Labels, spec.Template.Labels)
+		spec.Template.Annotations = mergeKeys(dp.Spec.Template.Annotations, spec.Template.Annotations)
+		dp.Spec = *spec
+	case *corev1.Service:
+		svc := live.(*corev1.Service)
+		spec := desired.Spec.DeepCopy()
+		keepAllocated(spec, &svc.Spec)
+		svc.Spec = *spec
+	}
+}
+
+// mergeKeys 在 base 的副本上覆盖 overrides 中的键
+func mergeKeys(base, overrides map[string]string) map[string]string {
+	if len(base) == 0 && len(overrides) == 0 {
+		return nil
+	}
+	merged := maps.Clone(base)
+	if merged == nil {
+		merged = make(map[string]string, len(overrides))
+	}
+	maps.Copy(merged, overrides)
+	return merged
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	appv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+)
+
+const (
+	// AnnotationDryRun 为 true 时只预览这个 Application 的变更，不写入子资源
+	AnnotationDryRun = "apps.aloys.cn/dry-run"
+	// ConditionTypeDryRun 预览模式下记录是否有待执行的变更
+	ConditionTypeDryRun = "DryRun"
+)
+
+// dryRun 管理器开启了预览模式，或者 Application 带有预览注解
+func (r *ApplicationReconciler) dryRun(application *appv1.Application) bool {
+	return r.DryRun || application.Annotations[AnnotationDryRun] == "true"
+}
+
+// reconcilePlan 预览模式下的调谐：计算需要执行的变更，记录到 status 和事件中，不修改任何子资源。
+// 不能接管的对象和实际调谐一样通过 Conflict condition 报告
+func (r *ApplicationReconciler) reconcilePlan(ctx context.Context, application *appv1.Application) (ctrl.Result, error) {
+	setupLog := log.FromContext(ctx).WithName("reconcilePlan")
+	changes, conflicts, err := r.planChanges(ctx, application)
+	if err != nil {
+		setupLog.Error(err, "Failed to plan the changes.", "name", application.Name)
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	oldStatus := application.Status.DeepCopy()
+	setPlan(application, changes)
+	setConflictCondition(application, conflicts, r.Recorder)
+	if err := r.updateStatus(ctx, application, oldStatus); err != nil {
+		setupLog.Error(err, "Failed to update the Application status.", "name", application.Name)
+		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
+	}
+	// 只在变更内容变化时记录事件，避免每次调谐都产生重复的事件
+	if !equality.Semantic.DeepEqual(oldStatus.Plan, application.Status.Plan) {
+		r.Recorder.Event(application, corev1.EventTypeNormal, "DryRun", "Dry run: "+summarizePlan(changes))
+	}
+	setupLog.Info("Planned the changes without applying them", "name", application.Name, "changes", len(changes))
+	return ctrl.Result{}, nil
+}
+
+// planChanges 和实际调谐的逻辑一致：不存在的子资源需要创建，接管的子资源、Application 修改过的子资源
+// 和 Enforce 模式下漂移的子资源需要更新，不再属于 Application 的子资源需要删除。
+// 同名但不能接管的对象不会被修改，作为冲突单独返回
+func (r *ApplicationReconciler) planChanges(ctx context.Context, application *appv1.Application) ([]appv1.PlannedChange, []string, error) {
+	var (
+		changes   []appv1.PlannedChange
+		conflicts []string
+	)
+	for _, desired := range desiredObjects(application) {
+		live := emptyLike(desired)
+		err := r.Get(ctx, client.ObjectKeyFromObject(desired), live)
+		if errors.IsNotFound(err) {
+			changes = append(changes, appv1.PlannedChange{Action: appv1.PlannedActionCreate, Kind: kindOf(desired), Name: desired.GetName()})
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		var fields []string
+		if !metav1.IsControlledBy(live, application) {
+			if !canAdopt(application, live) {
+				conflicts = append(conflicts, describeConflict(kindOf(desired), live))
+				continue
+			}
+			fields = append(fields, "metadata.ownerReferences")
+		}
+		// Application 的修改总是会更新到子资源，手工修改的漂移只在 Enforce 时恢复
+		if specChanged(desired, live) || driftPolicy(application) == appv1.DriftPolicyEnforce {
+			drifted, err := r.driftedFields(ctx, desired, live)
+			if err != nil {
+				return nil, nil, err
+			}
+			fields = append(fields, drifted...)
+		}
+		if len(fields) > 0 {
+			changes = append(changes, appv1.PlannedChange{Action: appv1.PlannedActionUpdate, Kind: kindOf(desired), Name: desired.GetName(), Fields: fields})
+		}
+	}
+	stale, err := r.staleChildren(ctx, application)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, obj := range stale {
+		changes = append(changes, appv1.PlannedChange{Action: appv1.PlannedActionDelete, Kind: kindOf(obj), Name: obj.GetName()})
+	}
+	return changes, conflicts, nil
+}
+
+// setPlan 记录预览结果和 DryRun condition
+func setPlan(application *appv1.Application, changes []appv1.PlannedChange) {
+	application.Status.Plan = &appv1.PlanStatus{ObservedGeneration: application.Generation, Changes: changes}
+	condition := metav1.Condition{
+		Type:               ConditionTypeDryRun,
+		Status:             metav1.ConditionTrue,
+		Reason:             "ChangesPending",
+		Message:            summarizePlan(changes),
+		ObservedGeneration: application.Generation,
+	}
+	if len(changes) == 0 {
+		condition.Reason = "NoChanges"
+	}
+	meta.SetStatusCondition(&application.Status.Conditions, condition)
+}
+
+// clearPlan 关闭预览模式后删除上一次的预览结果
+func clearPlan(application *appv1.Application) {
+	application.Status.Plan = nil
+	meta.RemoveStatusCondition(&application.Status.Conditions, ConditionTypeDryRun)
+}
+
+// summarizePlan 用于事件和 condition 的消息，例如 would create Deployment shop-deployment
+func summarizePlan(changes []appv1.PlannedChange) string {
+	if len(changes) == 0 {
+		return "no changes, the child objects match the desired state"
+	}
+	items := make([]string, 0, len(changes))
+	for _, change := range changes {
+		item := fmt.Sprintf("%s %s %s", strings.ToLower(string(change.Action)), change.Kind, change.Name)
+		if len(change.Fields) > 0 {
+			item += " (" + strings.Join(change.Fields, ", ") + ")"
+		}
+		items = append(items, item)
+	}
+	return "would " + strings.Join(items, "; ")
+}
+
+func kindOf(obj client.Object) string {
+	switch obj.(type) {
+	case *appsv1.Deployment:
+		return "Deployment"
+	case *corev1.Service:
+		return "Service"
+	default:
+		return fmt.Sprintf("%T", obj)
+	}
+}
+
+// emptyLike 返回同类型的空对象，读取时不会残留期望对象中的字段
+func emptyLike(obj client.Object) client.Object {
+	switch obj.(type) {
+	case *appsv1.Deployment:
+		return &appsv1.Deployment{}
+	case *corev1.Service:
+		return &corev1.Service{}
+	default:
+		return obj.DeepCopyObject().(client.Object)
+	}
+}
@@ -51,11 +51,7 @@ func (r *ApplicationReconciler) reconcileService(ctx context.Context, applicatio
 		setupLog.Error(err, "Failed to get the Service,will request after a short time.", "ServiceNamespace", appNamespace, "ServiceName", appName)
 		return ctrl.Result{RequeueAfter: GenericRequeueDuration}, err
 	}
-	svc.SetName(appName)
-	svc.SetNamespace(appNamespace)
-	svc.SetLabels(application.Labels)
-	svc.Spec = application.Spec.Service.ServiceSpec
-	svc.Spec.Selector = application.Labels
+	svc = desiredService(application)
 	// 设置 OwnerReference，使 svc 成为 Application 的子资源
 	if err := ctrl.SetControllerReference(application, svc, r.Scheme); err != nil {
 		setupLog.Error(err, "Failed to set the owner reference for the Service.", "ServiceNamespace", appNamespace, "ServiceName", appName)
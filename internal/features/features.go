@@ -0,0 +1,91 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package features defines the feature gates of the operator.
+package features
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/component-base/featuregate"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// 新增的行为先以 Alpha（默认关闭）加入，稳定后升级为 Beta（默认开启），最后成为 GA 并锁定为开启
+const (
+	// SidecarInjection 按 apps.aloys.cn/inject-sidecars 注解注入 ConfigMap 中的 sidecar 模板
+	SidecarInjection featuregate.Feature = "SidecarInjection"
+	// SecurityHardening defaulter 为容器注入受限的 securityContext
+	SecurityHardening featuregate.Feature = "SecurityHardening"
+	// PolicyRules validator 执行策略中的 CEL 规则
+	PolicyRules featuregate.Feature = "PolicyRules"
+
+	// Autoscaling 已经存在的 Deployment 的副本数交给 HPA 等自动扩缩容控制器，reconciler 不再恢复 spec.replicas
+	Autoscaling featuregate.Feature = "Autoscaling"
+)
+
+var defaultFeatureGates = map[featuregate.Feature]featuregate.FeatureSpec{
+	SidecarInjection:  {Default: true, PreRelease: featuregate.Beta},
+	SecurityHardening: {Default: true, PreRelease: featuregate.Beta},
+	PolicyRules:       {Default: true, PreRelease: featuregate.Beta},
+	Autoscaling:       {Default: false, PreRelease: featuregate.Alpha},
+}
+
+// DefaultMutableFeatureGate 启动时通过 --feature-gates 或者配置文件中的 featureGates 设置
+var DefaultMutableFeatureGate = featuregate.NewFeatureGate()
+
+// DefaultFeatureGate 只读的 feature gate，业务代码通过它判断功能是否开启
+var DefaultFeatureGate featuregate.FeatureGate = DefaultMutableFeatureGate
+
+// featureEnabled 每个 feature gate 的开启状态，方便按集群对比灰度进度
+var featureEnabled = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "application_operator_feature_enabled",
+	Help: "Whether a feature gate of the operator is enabled (1) or disabled (0).",
+}, []string{"name", "stage"})
+
+func init() {
+	utilruntime.Must(DefaultMutableFeatureGate.Add(defaultFeatureGates))
+	metrics.Registry.MustRegister(featureEnabled)
+}
+
+// Enabled 功能是否开启
+func Enabled(f featuregate.Feature) bool {
+	return DefaultFeatureGate.Enabled(f)
+}
+
+// Status 每个功能当前是否开启，用于启动日志
+func Status() map[string]bool {
+	status := make(map[string]bool, len(defaultFeatureGates))
+	for name := range defaultFeatureGates {
+		status[string(name)] = Enabled(name)
+	}
+	return status
+}
+
+// RecordMetrics 在设置完 feature gate 之后调用，记录每个功能的状态
+func RecordMetrics() {
+	for name, spec := range defaultFeatureGates {
+		stage := string(spec.PreRelease)
+		if spec.PreRelease == featuregate.GA {
+			stage = "GA"
+		}
+		value := 0.0
+		if Enabled(name) {
+			value = 1
+		}
+		featureEnabled.WithLabelValues(string(name), stage).Set(value)
+	}
+}
@@ -0,0 +1,56 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package features
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+var _ = Describe("Feature gates", func() {
+	AfterEach(func() {
+		Expect(DefaultMutableFeatureGate.SetFromMap(map[string]bool{string(PolicyRules): true})).To(Succeed())
+	})
+
+	It("should enable beta features by default", func() {
+		Expect(Enabled(SidecarInjection)).To(BeTrue())
+		Expect(Enabled(SecurityHardening)).To(BeTrue())
+		Expect(Enabled(PolicyRules)).To(BeTrue())
+	})
+
+	It("should disable alpha features by default", func() {
+		Expect(Enabled(Autoscaling)).To(BeFalse())
+		Expect(Enabled(Autoscaling)).To(BeFalse())
+	})
+
+	It("should reject unknown features", func() {
+		// 设置失败后 gate 中会留下未知的 key，在副本上测试
+		gate := DefaultMutableFeatureGate.DeepCopy()
+		Expect(gate.SetFromMap(map[string]bool{"BlueGreen": true})).
+			To(MatchError(ContainSubstring("unrecognized feature gate: BlueGreen")))
+	})
+
+	It("should record the state of every feature", func() {
+		Expect(DefaultMutableFeatureGate.Set("PolicyRules=false")).To(Succeed())
+		RecordMetrics()
+		Expect(testutil.ToFloat64(featureEnabled.WithLabelValues("PolicyRules", "BETA"))).To(Equal(0.0))
+		Expect(testutil.ToFloat64(featureEnabled.WithLabelValues("SidecarInjection", "BETA"))).To(Equal(1.0))
+		Expect(testutil.ToFloat64(featureEnabled.WithLabelValues("Autoscaling", "ALPHA"))).To(Equal(0.0))
+		Expect(Status()).To(HaveKeyWithValue("PolicyRules", false))
+	})
+})
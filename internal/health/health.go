@@ -0,0 +1,98 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package health provides the readiness and liveness checks of the manager.
+package health
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+// CacheSyncer manager 的 cache 实现了这个接口
+type CacheSyncer interface {
+	WaitForCacheSync(ctx context.Context) bool
+}
+
+// CacheSyncChecker informer 全部同步完成之前 readiness 检查失败，每次检查最多等待 timeout
+func CacheSyncChecker(c CacheSyncer, timeout time.Duration) healthz.Checker {
+	return func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), timeout)
+		defer cancel()
+		if !c.WaitForCacheSync(ctx) {
+			return errors.New("informer caches have not synced")
+		}
+		return nil
+	}
+}
+
+// LeaderChecker 当前副本成为 leader 之前 readiness 检查失败，elected 一般是 mgr.Elected()
+func LeaderChecker(elected <-chan struct{}) healthz.Checker {
+	return func(_ *http.Request) error {
+		select {
+		case <-elected:
+			return nil
+		default:
+			return errors.New("not the leader")
+		}
+	}
+}
+
+// ReconcileTracker 记录正在执行的调谐，用来发现卡住的调谐循环
+type ReconcileTracker struct {
+	mu       sync.Mutex
+	inflight map[string]time.Time
+	// now 测试中替换当前时间
+	now func() time.Time
+}
+
+// NewReconcileTracker 创建一个 ReconcileTracker
+func NewReconcileTracker() *ReconcileTracker {
+	return &ReconcileTracker{inflight: map[string]time.Time{}, now: time.Now}
+}
+
+// Begin 标记 key 的调谐开始，返回的函数在调谐结束时调用
+func (t *ReconcileTracker) Begin(key string) func() {
+	t.mu.Lock()
+	t.inflight[key] = t.now()
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		delete(t.inflight, key)
+		t.mu.Unlock()
+	}
+}
+
+// Checker 有调谐执行超过 timeout 时 liveness 检查失败，kubelet 会重启卡住的进程
+func (t *ReconcileTracker) Checker(timeout time.Duration) healthz.Checker {
+	return func(_ *http.Request) error {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		now := t.now()
+		for key, started := range t.inflight {
+			if elapsed := now.Sub(started); elapsed > timeout {
+				return fmt.Errorf("reconcile of %s has been running for %s, longer than %s", key, elapsed.Round(time.Second), timeout)
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"context"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+type fakeCache struct {
+	synced bool
+}
+
+func (c *fakeCache) WaitForCacheSync(ctx context.Context) bool {
+	if !c.synced {
+		<-ctx.Done()
+	}
+	return c.synced
+}
+
+var _ = Describe("Checks", func() {
+	req := httptest.NewRequest("GET", "/readyz", nil)
+
+	It("should report informer caches that have not synced", func() {
+		c := &fakeCache{}
+		check := CacheSyncChecker(c, 10*time.Millisecond)
+		Expect(check(req)).To(MatchError("informer caches have not synced"))
+
+		c.synced = true
+		Expect(check(req)).To(Succeed())
+	})
+
+	It("should report ready only after being elected", func() {
+		elected := make(chan struct{})
+		check := LeaderChecker(elected)
+		Expect(check(req)).To(MatchError("not the leader"))
+
+		close(elected)
+		Expect(check(req)).To(Succeed())
+	})
+
+	It("should report leadership once elected", func() {
+		elected := make(chan struct{})
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			Expect((&LeaderReporter{Elected: elected}).Start(ctx)).To(Succeed())
+		}()
+		Consistently(func() float64 { return testutil.ToFloat64(leader) }, 50*time.Millisecond).Should(BeZero())
+
+		close(elected)
+		Eventually(func() float64 { return testutil.ToFloat64(leader) }).Should(Equal(1.0))
+
+		cancel()
+		Eventually(done).Should(BeClosed())
+		Expect(testutil.ToFloat64(leader)).To(BeZero())
+	})
+
+	It("should detect a stuck reconcile", func() {
+		now := time.Now()
+		tracker := NewReconcileTracker()
+		tracker.now = func() time.Time { return now }
+		check := tracker.Checker(time.Minute)
+
+		done := tracker.Begin("default/shop")
+		now = now.Add(30 * time.Second)
+		Expect(check(req)).To(Succeed())
+
+		now = now.Add(time.Minute)
+		Expect(check(req)).To(MatchError(ContainSubstring("reconcile of default/shop has been running for 1m30s")))
+
+		done()
+		Expect(check(req)).To(Succeed())
+	})
+})
@@ -0,0 +1,59 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package health
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// leader 当前副本是否是 leader，没有开启选主时每个副本都是 leader
+var leader = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "application_operator_leader",
+	Help: "Whether this replica is the leader (1) or a standby (0). Replicas without leader election report 1.",
+})
+
+func init() {
+	metrics.Registry.MustRegister(leader)
+}
+
+// LeaderReporter 成为 leader 之后把 application_operator_leader 设置为 1，退出时恢复为 0
+type LeaderReporter struct {
+	// Elected 成为 leader 时关闭，一般是 mgr.Elected()
+	Elected <-chan struct{}
+}
+
+// Start 实现 manager.Runnable
+func (l *LeaderReporter) Start(ctx context.Context) error {
+	leader.Set(0)
+	defer leader.Set(0)
+	select {
+	case <-ctx.Done():
+		return nil
+	case <-l.Elected:
+		leader.Set(1)
+	}
+	<-ctx.Done()
+	return nil
+}
+
+// NeedLeaderElection standby 副本也需要上报 0
+func (l *LeaderReporter) NeedLeaderElection() bool {
+	return false
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package scope restricts a manager instance to a subset of namespaces and Applications,
+// so that several instances can run in the same cluster.
+package scope
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// LabelControllerClass 区分不同实例负责的 Application，配合 --application-selector 使用
+const LabelControllerClass = "apps.aloys.cn/controller-class"
+
+// Scope 当前实例负责的范围，nil 表示负责整个集群
+type Scope struct {
+	// Namespaces 只缓存和处理这些 namespace，为空表示所有 namespace
+	Namespaces sets.Set[string]
+	// NamespaceSelector 只处理标签匹配的 namespace 中的对象
+	NamespaceSelector labels.Selector
+	// ApplicationSelector 只处理标签匹配的 Application
+	ApplicationSelector labels.Selector
+}
+
+// New 解析选择器，所有参数都为空时返回 nil
+func New(namespaces []string, namespaceSelector, applicationSelector string) (*Scope, error) {
+	if len(namespaces) == 0 && namespaceSelector == "" && applicationSelector == "" {
+		return nil, nil
+	}
+	nsSelector, err := labels.Parse(namespaceSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid namespace selector %q: %w", namespaceSelector, err)
+	}
+	appSelector, err := labels.Parse(applicationSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid application selector %q: %w", applicationSelector, err)
+	}
+	return &Scope{
+		Namespaces:          sets.New(namespaces...),
+		NamespaceSelector:   nsSelector,
+		ApplicationSelector: appSelector,
+	}, nil
+}
+
+// CacheOptions 把 manager 的缓存限制在 Namespaces 中。
+// namespace 选择器在 namespace 创建和修改标签时会变化，没法用于限制缓存，只在处理对象时过滤
+func (s *Scope) CacheOptions() cache.Options {
+	if s == nil || s.Namespaces.Len() == 0 {
+		return cache.Options{}
+	}
+	defaultNamespaces := make(map[string]cache.Config, s.Namespaces.Len())
+	for _, namespace := range sets.List(s.Namespaces) {
+		defaultNamespaces[namespace] = cache.Config{}
+	}
+	return cache.Options{DefaultNamespaces: defaultNamespaces}
+}
+
+// CachesNamespace 缓存中是否有这个 namespace 的对象，缓存之外的对象不能通过 manager 的 client 读取
+func (s *Scope) CachesNamespace(namespace string) bool {
+	return s == nil || s.Namespaces.Len() == 0 || s.Namespaces.Has(namespace)
+}
+
+// Predicate 过滤不属于当前实例的 Application 事件，只检查不需要读取集群的条件
+func (s *Scope) Predicate() predicate.Predicate {
+	return predicate.NewPredicateFuncs(s.matchesObject)
+}
+
+// Contains 对象是否属于当前实例，设置了 NamespaceSelector 时通过 reader 读取 namespace 的标签
+func (s *Scope) Contains(ctx context.Context, reader client.Reader, obj client.Object) (bool, error) {
+	if !s.matchesObject(obj) {
+		return false, nil
+	}
+	if s == nil || s.NamespaceSelector.Empty() {
+		return true, nil
+	}
+	ns := &corev1.Namespace{}
+	if err := reader.Get(ctx, client.ObjectKey{Name: obj.GetNamespace()}, ns); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+	return s.NamespaceSelector.Matches(labels.Set(ns.Labels)), nil
+}
+
+func (s *Scope) matchesObject(obj client.Object) bool {
+	if s == nil {
+		return true
+	}
+	if s.Namespaces.Len() > 0 && !s.Namespaces.Has(obj.GetNamespace()) {
+		return false
+	}
+	return s.ApplicationSelector.Matches(labels.Set(obj.GetLabels()))
+}
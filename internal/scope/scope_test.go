@@ -0,0 +1,93 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package scope
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	appv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+)
+
+var _ = Describe("Scope", func() {
+	ctx := context.Background()
+
+	newApplication := func(namespace string, labels map[string]string) *appv1.Application {
+		return &appv1.Application{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "shop", Labels: labels}}
+	}
+
+	It("should cover the whole cluster without any restriction", func() {
+		s, err := New(nil, "", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s).To(BeNil())
+		Expect(s.CacheOptions().DefaultNamespaces).To(BeNil())
+		Expect(s.Contains(ctx, nil, newApplication("default", nil))).To(BeTrue())
+		Expect(s.CachesNamespace("default")).To(BeTrue())
+	})
+
+	It("should reject invalid selectors", func() {
+		_, err := New(nil, "team in a", "")
+		Expect(err).To(MatchError(ContainSubstring("invalid namespace selector")))
+		_, err = New(nil, "", "!!")
+		Expect(err).To(MatchError(ContainSubstring("invalid application selector")))
+	})
+
+	It("should restrict the cache to the watched namespaces", func() {
+		s, err := New([]string{"team-a", "shared"}, "", "")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.CacheOptions().DefaultNamespaces).To(HaveLen(2))
+		Expect(s.CacheOptions().DefaultNamespaces).To(HaveKey("team-a"))
+		Expect(s.Contains(ctx, nil, newApplication("team-a", nil))).To(BeTrue())
+		Expect(s.Contains(ctx, nil, newApplication("team-b", nil))).To(BeFalse())
+		Expect(s.CachesNamespace("shared")).To(BeTrue())
+		Expect(s.CachesNamespace("team-b")).To(BeFalse())
+	})
+
+	It("should only match Applications of its controller class", func() {
+		s, err := New(nil, "", LabelControllerClass+"=team-a")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(s.CacheOptions().DefaultNamespaces).To(BeNil())
+		ownApplication := newApplication("default", map[string]string{LabelControllerClass: "team-a"})
+		otherApplication := newApplication("default", map[string]string{LabelControllerClass: "team-b"})
+		Expect(s.Contains(ctx, nil, ownApplication)).To(BeTrue())
+		Expect(s.Contains(ctx, nil, otherApplication)).To(BeFalse())
+		Expect(s.Contains(ctx, nil, newApplication("default", nil))).To(BeFalse())
+		Expect(s.Predicate().Generic(event.GenericEvent{Object: ownApplication})).To(BeTrue())
+		Expect(s.Predicate().Generic(event.GenericEvent{Object: otherApplication})).To(BeFalse())
+	})
+
+	It("should match namespaces by their labels", func() {
+		s, err := New(nil, "team=a", "")
+		Expect(err).NotTo(HaveOccurred())
+		reader := fake.NewClientBuilder().WithObjects(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"team": "a"}}},
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b", Labels: map[string]string{"team": "b"}}},
+		).Build()
+		Expect(s.Contains(ctx, reader, newApplication("team-a", nil))).To(BeTrue())
+		Expect(s.Contains(ctx, reader, newApplication("team-b", nil))).To(BeFalse())
+		// namespace 已经被删除
+		Expect(s.Contains(ctx, reader, newApplication("team-c", nil))).To(BeFalse())
+		// 不读取集群的过滤条件不检查 namespace 的标签
+		Expect(s.Predicate().Generic(event.GenericEvent{Object: newApplication("team-b", nil)})).To(BeTrue())
+	})
+})
@@ -0,0 +1,289 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package sharding spreads Applications across several active replicas.
+// Every replica renews its own Lease, the live Leases of a group are the members of the group,
+// and each Application is assigned to one member by rendezvous hashing.
+package sharding
+
+import (
+	"context"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// +kubebuilder:rbac:groups=coordination.k8s.io,resources=leases,verbs=get;list;watch;create;update;delete
+
+const (
+	// LabelShardGroup 同一组副本的 Lease 带有这个标签
+	LabelShardGroup = "apps.aloys.cn/shard-group"
+
+	// DefaultLeaseDuration 超过这个时间没有续约的副本被移出分组
+	DefaultLeaseDuration = 15 * time.Second
+	// DefaultRenewInterval 续约和刷新成员的间隔
+	DefaultRenewInterval = 5 * time.Second
+)
+
+var (
+	shardMembers = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "application_operator_shard_members",
+		Help: "Number of live replicas in the shard group seen by this replica.",
+	})
+	shardApplications = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "application_operator_shard_applications",
+		Help: "Number of Applications assigned to the shard, recorded on every rebalance.",
+	}, []string{"shard"})
+	shardRebalances = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "application_operator_shard_rebalances_total",
+		Help: "Number of times the members of the shard group changed.",
+	})
+)
+
+func init() {
+	metrics.Registry.MustRegister(shardMembers, shardApplications, shardRebalances)
+}
+
+// Sharder 维护当前副本的 Lease 和分组的成员，判断 Application 是否分配给当前副本
+type Sharder struct {
+	// Client 写入当前副本的 Lease
+	Client client.Client
+	// Reader 读取 Lease，使用不带缓存的 reader，避免缓存集群中所有的 Lease
+	Reader client.Reader
+	// Namespace Lease 所在的 namespace，一般是 operator 所在的 namespace
+	Namespace string
+	// Group 分组的名称，同一组的副本分担所有的 Application
+	Group string
+	// Identity 当前副本的名称，一般是 Pod 名称
+	Identity string
+
+	LeaseDuration time.Duration
+	RenewInterval time.Duration
+
+	events chan event.GenericEvent
+
+	mu      sync.RWMutex
+	members []string
+
+	// now 测试中替换当前时间
+	now func() time.Time
+}
+
+// New 创建一个 Sharder，在 manager 启动之前把 Events 注册到 controller 上
+func New(c client.Client, reader client.Reader, namespace, group, identity string) *Sharder {
+	return &Sharder{
+		Client:    c,
+		Reader:    reader,
+		Namespace: namespace,
+		Group:     group,
+		Identity:  identity,
+		// 还没有处理的事件已经会触发一次重新分配，不需要更大的缓冲
+		events: make(chan event.GenericEvent, 1),
+	}
+}
+
+func (s *Sharder) setDefaults() {
+	if s.LeaseDuration <= 0 {
+		s.LeaseDuration = DefaultLeaseDuration
+	}
+	if s.RenewInterval <= 0 {
+		s.RenewInterval = DefaultRenewInterval
+	}
+	if s.now == nil {
+		s.now = time.Now
+	}
+}
+
+// Events 分组的成员变化时发送一个事件，controller 收到后重新调谐分配给当前副本的 Application
+func (s *Sharder) Events() <-chan event.GenericEvent {
+	return s.events
+}
+
+// Start 定期续约并刷新成员，退出时删除 Lease，其他副本不需要等 Lease 过期就能接手，实现 manager.Runnable
+func (s *Sharder) Start(ctx context.Context) error {
+	s.setDefaults()
+	logger := log.FromContext(ctx).WithName("sharder")
+	ticker := time.NewTicker(s.RenewInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.sync(ctx); err != nil {
+			logger.Error(err, "unable to sync the shard group", "group", s.Group)
+		}
+		select {
+		case <-ctx.Done():
+			releaseCtx, cancel := context.WithTimeout(context.Background(), s.RenewInterval)
+			defer cancel()
+			if err := s.release(releaseCtx); err != nil {
+				logger.Error(err, "unable to release the shard lease", "group", s.Group)
+			}
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// NeedLeaderElection 每个副本都要参与分片
+func (s *Sharder) NeedLeaderElection() bool {
+	return false
+}
+
+// Owns key 是否分配给当前副本，key 为 namespace/name。
+// 还没有拿到成员时不处理任何 Application，拿到之后会通过 Events 触发调谐；s 为 nil 时不分片
+func (s *Sharder) Owns(key string) bool {
+	if s == nil {
+		return true
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.members) > 0 && owner(s.members, key) == s.Identity
+}
+
+// Members 当前分组中存活的副本
+func (s *Sharder) Members() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.members)
+}
+
+// RecordAssigned 记录分配给当前副本的 Application 数量
+func (s *Sharder) RecordAssigned(count int) {
+	shardApplications.WithLabelValues(s.Identity).Set(float64(count))
+}
+
+// sync 续约当前副本的 Lease，再根据所有存活的 Lease 刷新成员
+func (s *Sharder) sync(ctx context.Context) error {
+	if err := s.renew(ctx); err != nil {
+		return err
+	}
+	leases := &coordinationv1.LeaseList{}
+	if err := s.Reader.List(ctx, leases, client.InNamespace(s.Namespace), client.MatchingLabels{LabelShardGroup: s.Group}); err != nil {
+		return err
+	}
+	now := s.now()
+	var members []string
+	for i := range leases.Items {
+		if identity, ok := liveHolder(&leases.Items[i], now); ok {
+			members = append(members, identity)
+		}
+	}
+	sort.Strings(members)
+	s.setMembers(members)
+	return nil
+}
+
+func (s *Sharder) renew(ctx context.Context) error {
+	now := metav1.NewMicroTime(s.now())
+	leaseSeconds := int32(s.LeaseDuration.Seconds())
+	lease := &coordinationv1.Lease{}
+	err := s.Reader.Get(ctx, client.ObjectKey{Namespace: s.Namespace, Name: s.leaseName()}, lease)
+	if apierrors.IsNotFound(err) {
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: s.Namespace,
+				Name:      s.leaseName(),
+				Labels:    map[string]string{LabelShardGroup: s.Group},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       &s.Identity,
+				LeaseDurationSeconds: &leaseSeconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		return s.Client.Create(ctx, lease)
+	}
+	if err != nil {
+		return err
+	}
+	lease.Spec.HolderIdentity = &s.Identity
+	lease.Spec.LeaseDurationSeconds = &leaseSeconds
+	lease.Spec.RenewTime = &now
+	return s.Client.Update(ctx, lease)
+}
+
+func (s *Sharder) release(ctx context.Context) error {
+	lease := &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Namespace: s.Namespace, Name: s.leaseName()}}
+	return client.IgnoreNotFound(s.Client.Delete(ctx, lease))
+}
+
+func (s *Sharder) leaseName() string {
+	return s.Group + "-" + s.Identity
+}
+
+// setMembers 成员变化时重新分配，不阻塞等待 controller 处理事件
+func (s *Sharder) setMembers(members []string) {
+	s.mu.Lock()
+	changed := !slices.Equal(s.members, members)
+	s.members = members
+	s.mu.Unlock()
+	shardMembers.Set(float64(len(members)))
+	if !changed {
+		return
+	}
+	shardRebalances.Inc()
+	lease := &coordinationv1.Lease{ObjectMeta: metav1.ObjectMeta{Namespace: s.Namespace, Name: s.leaseName()}}
+	select {
+	case s.events <- event.GenericEvent{Object: lease}:
+	default:
+	}
+}
+
+// liveHolder Lease 在有效期内时返回持有者
+func liveHolder(lease *coordinationv1.Lease, now time.Time) (string, bool) {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || spec.RenewTime == nil || spec.LeaseDurationSeconds == nil {
+		return "", false
+	}
+	expiry := spec.RenewTime.Add(time.Duration(*spec.LeaseDurationSeconds) * time.Second)
+	return *spec.HolderIdentity, now.Before(expiry)
+}
+
+// owner 使用 rendezvous hashing 选出 key 的副本，成员变化时只有增加或减少的副本上的 Application 需要迁移
+func owner(members []string, key string) string {
+	var selected string
+	var highest uint64
+	for _, member := range members {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(member))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(key))
+		if score := mix(h.Sum64()); selected == "" || score > highest {
+			selected, highest = member, score
+		}
+	}
+	return selected
+}
+
+// mix FNV 的高位对输入最后几个字节不敏感，打散之后再比较，见 splitmix64
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
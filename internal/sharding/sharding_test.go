@@ -0,0 +1,125 @@
+/*
+Copyright 2024 Aloys.Zhou.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package sharding
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+var _ = Describe("Sharder", func() {
+	var (
+		ctx     context.Context
+		c       client.Client
+		now     time.Time
+		sharder func(identity string) *Sharder
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		c = fake.NewClientBuilder().Build()
+		now = time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+		sharder = func(identity string) *Sharder {
+			s := New(c, c, "operator-system", "apps", identity)
+			s.now = func() time.Time { return now }
+			s.setDefaults()
+			return s
+		}
+	})
+
+	It("should not own anything before it knows the members", func() {
+		Expect(sharder("a").Owns("default/shop")).To(BeFalse())
+		var s *Sharder
+		Expect(s.Owns("default/shop")).To(BeTrue())
+	})
+
+	It("should assign every Application to exactly one live replica", func() {
+		a, b := sharder("a"), sharder("b")
+		Expect(a.sync(ctx)).To(Succeed())
+		Expect(b.sync(ctx)).To(Succeed())
+		Expect(a.sync(ctx)).To(Succeed())
+		Expect(a.Members()).To(Equal([]string{"a", "b"}))
+		Expect(b.Members()).To(Equal([]string{"a", "b"}))
+
+		owned := map[string]int{}
+		for i := range 100 {
+			key := fmt.Sprintf("default/app-%d", i)
+			Expect(a.Owns(key)).NotTo(Equal(b.Owns(key)), key)
+			if a.Owns(key) {
+				owned["a"]++
+			} else {
+				owned["b"]++
+			}
+		}
+		Expect(owned["a"]).To(BeNumerically(">", 20))
+		Expect(owned["b"]).To(BeNumerically(">", 20))
+	})
+
+	It("should rebalance when a replica stops renewing its lease", func() {
+		a, b := sharder("a"), sharder("b")
+		Expect(a.sync(ctx)).To(Succeed())
+		Expect(b.sync(ctx)).To(Succeed())
+		Expect(a.sync(ctx)).To(Succeed())
+		Eventually(a.Events()).Should(Receive())
+
+		now = now.Add(DefaultLeaseDuration + time.Second)
+		Expect(a.sync(ctx)).To(Succeed())
+		Expect(a.Members()).To(Equal([]string{"a"}))
+		Expect(a.Events()).To(Receive())
+		Expect(a.Owns("default/shop")).To(BeTrue())
+	})
+
+	It("should only move Applications of the replica that joined", func() {
+		a, b, d := sharder("a"), sharder("b"), sharder("d")
+		Expect(a.sync(ctx)).To(Succeed())
+		Expect(b.sync(ctx)).To(Succeed())
+		Expect(a.sync(ctx)).To(Succeed())
+		before := map[string]bool{}
+		for i := range 100 {
+			key := fmt.Sprintf("default/app-%d", i)
+			before[key] = a.Owns(key)
+		}
+		Expect(d.sync(ctx)).To(Succeed())
+		Expect(a.sync(ctx)).To(Succeed())
+		for key, owned := range before {
+			// 新副本只会拿走 a 原来的一部分，不会把 b 的 Application 分给 a
+			if a.Owns(key) {
+				Expect(owned).To(BeTrue(), key)
+			}
+		}
+	})
+
+	It("should delete its lease when released", func() {
+		a := sharder("a")
+		Expect(a.sync(ctx)).To(Succeed())
+		leases := &coordinationv1.LeaseList{}
+		Expect(c.List(ctx, leases, client.MatchingLabels{LabelShardGroup: "apps"})).To(Succeed())
+		Expect(leases.Items).To(HaveLen(1))
+		Expect(*leases.Items[0].Spec.HolderIdentity).To(Equal("a"))
+
+		Expect(a.release(ctx)).To(Succeed())
+		Expect(c.List(ctx, leases, client.MatchingLabels{LabelShardGroup: "apps"})).To(Succeed())
+		Expect(leases.Items).To(BeEmpty())
+	})
+})
@@ -20,28 +20,75 @@ import (
 	"context"
 	"fmt"
 
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
 
 	appsv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+	"github.com/aloys.zy/aloys-application-operator-webhook/internal/features"
+	"github.com/aloys.zy/aloys-application-operator-webhook/internal/scope"
 )
 
 // nolint:unused
 // log is for logging in this package.
 var applicationlog = logf.Log.WithName("application-resource")
 
+// Options holds the cluster-wide webhook settings, namespaces may override them with annotations.
+type Options struct {
+	// DefaultReplicas 未指定副本数时的默认值
+	DefaultReplicas int32
+	// MaxReplicas 允许的最大副本数，0 表示不限制
+	MaxReplicas int32
+	// AllowedRegistries 全局的镜像仓库白名单，为空表示不限制
+	AllowedRegistries []string
+	// ImageMirrors 把镜像改写到镜像仓库，key 为仓库地址或者带路径的前缀
+	ImageMirrors map[string]string
+	// ImageResolver 把镜像的 tag 固定为 digest，为空时不解析
+	ImageResolver ImageResolver
+	// SidecarNamespace 存放 sidecar 模板 ConfigMap 的 namespace，为空时不支持注入
+	SidecarNamespace string
+	// MaxReplicaDropPercent 单次更新允许下降的副本数比例，超过时需要确认注解，0 表示不限制
+	MaxReplicaDropPercent int32
+	// Scope 当前实例负责的 Application，其他实例的 Application 直接放行，为 nil 时处理所有 Application
+	Scope *scope.Scope
+}
+
+// +kubebuilder:rbac:groups=core,resources=namespaces,verbs=get;list;watch
+
 // SetupApplicationWebhookWithManager registers the webhook for Application in the manager.
-func SetupApplicationWebhookWithManager(mgr ctrl.Manager) error {
+func SetupApplicationWebhookWithManager(mgr ctrl.Manager, opts Options) error {
+	replicaPolicy := ReplicaPolicy{
+		DefaultReplicas: opts.DefaultReplicas,
+		MaxReplicas:     opts.MaxReplicas,
+		Enforcement:     appsv1.ReplicasEnforcementDeny,
+	}
 	// 使用 NewWebhookManagedBy 方法创建一个新的 webhook，并设置了验证器和默认值处理器
 	return ctrl.NewWebhookManagedBy(mgr).For(&appsv1.Application{}).
 		// WithValidator数据验证
-		WithValidator(&ApplicationCustomValidator{}).
+		// 校验依赖环需要读取其他 Application，副本数策略需要读取 namespace
+		WithValidator(&ApplicationCustomValidator{
+			Client:                mgr.GetClient(),
+			ReplicaPolicy:         replicaPolicy,
+			AllowedRegistries:     opts.AllowedRegistries,
+			MaxReplicaDropPercent: opts.MaxReplicaDropPercent,
+			Scope:                 opts.Scope,
+		}).
 		// WithDefaulter数据修改
 		// 自定义字段初始化后再校验 ApplicationCustomDefaulter这个实例随后被注册到 webhook 中，以确保每当一个新的 Application 资源被创建或更新时，都会调用这个 defaulter 来设置默认值
-		WithDefaulter(&ApplicationCustomDefaulter{DefaultReplicas: 1}).
+		WithDefaulter(&ApplicationCustomDefaulter{
+			DefaultReplicas:  opts.DefaultReplicas,
+			MaxReplicas:      opts.MaxReplicas,
+			Client:           mgr.GetClient(),
+			ImageMirrors:     opts.ImageMirrors,
+			ImageResolver:    opts.ImageResolver,
+			SidecarNamespace: opts.SidecarNamespace,
+			Scope:            opts.Scope,
+		}).
 		Complete()
 }
 
@@ -59,7 +106,20 @@ type ApplicationCustomDefaulter struct {
 
 	// 可以自定义一些字段内容，在Default内进行使用
 	DefaultReplicas int32 `json:"-"`
+	// MaxReplicas 用于限制默认值不超过上限，0 表示不限制
+	MaxReplicas int32 `json:"-"`
 	// DefaultImage    string `json:"-"`
+
+	// Client 用于读取 namespace 上的副本数策略注解，为空时只使用上面的全局配置
+	Client client.Reader `json:"-"`
+	// ImageMirrors 镜像仓库的映射，为空时不改写镜像
+	ImageMirrors map[string]string `json:"-"`
+	// ImageResolver 把镜像的 tag 固定为 digest，为空时不解析
+	ImageResolver ImageResolver `json:"-"`
+	// SidecarNamespace 存放 sidecar 模板 ConfigMap 的 namespace
+	SidecarNamespace string `json:"-"`
+	// Scope 不属于当前实例的 Application 不做任何修改
+	Scope *scope.Scope `json:"-"`
 }
 
 // 确保ApplicationCustomDefaulter 结构体实现了 CustomDefaulter 接口
@@ -73,17 +133,55 @@ func (d *ApplicationCustomDefaulter) Default(ctx context.Context, obj runtime.Ob
 		return fmt.Errorf("expected an Application object but got %T", obj)
 	}
 	applicationlog.Info("Defaulting for Application", "name", application.GetName())
+	if inScope, err := d.Scope.Contains(ctx, d.Client, application); err != nil || !inScope {
+		return err
+	}
 
 	// TODO(user): fill in your defaulting logic.
-	// 设置默认副本数量
-	if application.Spec.Deployment.Replicas == nil {
-		application.Spec.Deployment.Replicas = &d.DefaultReplicas
+	// 设置默认副本数量，只填充未指定的值，超过上限的副本数交给 validator 处理，不修改用户的意图
+	ns, err := getNamespace(ctx, d.Client, application.Namespace)
+	if err != nil {
+		return err
+	}
+	// 平台团队通过 ApplicationPolicy/ClusterApplicationPolicy 配置的默认值
+	sources, err := listPolicies(ctx, d.Client, ns)
+	if err != nil {
+		return err
+	}
+	policy, err := resolveReplicaPolicy(ns, ReplicaPolicy{
+		DefaultReplicas: d.DefaultReplicas,
+		MaxReplicas:     d.MaxReplicas,
+	}, sources)
+	if err != nil {
+		return err
 	}
-	// 判断副本数量，并限制最大值为 8
-	if *application.Spec.Deployment.Replicas > 9 {
-		maxReplicas := int32(8)                             // 创建一个 int32 类型的变量
-		application.Spec.Deployment.Replicas = &maxReplicas // 将其地址赋值给 Replicas
-		applicationlog.Info("Setting default replicas for application.", "ApplicationName", application.Name, "NewReplicas", d.DefaultReplicas)
+	defaultReplicas(application, policy)
+	applyPolicyDefaults(application, sources)
+	// 按注解注入 sidecar，后面的镜像改写、资源规格和 securityContext 同样作用于 sidecar。
+	// 注解中去掉的模板也要处理，删除之前注入的容器
+	names := sidecarNames(application)
+	if features.Enabled(features.SidecarInjection) && (len(names) > 0 || application.Annotations[AnnotationInjectedSidecars] != "") {
+		var templates []*sidecarTemplate
+		if len(names) > 0 {
+			if templates, err = loadSidecarTemplates(ctx, d.Client, d.SidecarNamespace, names); err != nil {
+				return err
+			}
+		}
+		injectSidecars(application, names, templates)
+	}
+	// 为没有设置 requests/limits 的容器填充资源规格
+	profile, err := resolveResourceProfile(application, ns, sources)
+	if err != nil {
+		return err
+	}
+	applyResourceProfile(application, profile)
+	// 注入受限的 securityContext，可以通过 apps.aloys.cn/security-hardening=disabled 关闭
+	if features.Enabled(features.SecurityHardening) {
+		applySecurityDefaults(application)
+	}
+	// 改写镜像仓库并固定 digest，validator 看到的是改写后的镜像
+	if err := rewriteImages(ctx, application, d.ImageMirrors, d.ImageResolver); err != nil {
+		return err
 	}
 	// // 追加标签
 	// labels := make(map[string]string)
@@ -92,10 +190,9 @@ func (d *ApplicationCustomDefaulter) Default(ctx context.Context, obj runtime.Ob
 	return nil
 }
 
-// TODO(user): change verbs to "verbs=create;update;delete" if you want to enable deletion validation.
 // NOTE: The 'path' attribute must follow a specific pattern and should not be modified directly here.
 // Modifying the path for an invalid path can cause API server errors; failing to locate the webhook.
-// +kubebuilder:webhook:path=/validate-apps-aloys-cn-v1-application,mutating=false,failurePolicy=fail,sideEffects=None,groups=apps.aloys.cn,resources=applications,verbs=create;update,versions=v1,name=vapplication-v1.kb.io,admissionReviewVersions=v1
+// +kubebuilder:webhook:path=/validate-apps-aloys-cn-v1-application,mutating=false,failurePolicy=fail,sideEffects=None,groups=apps.aloys.cn,resources=applications,verbs=create;update;delete,versions=v1,name=vapplication-v1.kb.io,admissionReviewVersions=v1
 
 // ApplicationCustomValidator struct is responsible for validating the Application resource
 // when it is created, updated, or deleted.
@@ -104,6 +201,17 @@ func (d *ApplicationCustomDefaulter) Default(ctx context.Context, obj runtime.Ob
 // as this struct is used only for temporary operations and does not need to be deeply copied.
 type ApplicationCustomValidator struct {
 	// TODO(user): Add more fields as needed for validation
+
+	// Client 用于读取被依赖的 Application 和 namespace 上的策略注解，为空时只检查自依赖
+	Client client.Reader `json:"-"`
+	// ReplicaPolicy 全局的副本数上限，namespace 注解可以覆盖
+	ReplicaPolicy ReplicaPolicy `json:"-"`
+	// AllowedRegistries 全局的镜像仓库白名单，策略资源上的白名单会再单独校验
+	AllowedRegistries []string `json:"-"`
+	// MaxReplicaDropPercent 单次更新允许下降的副本数比例，0 表示不限制
+	MaxReplicaDropPercent int32 `json:"-"`
+	// Scope 不属于当前实例的 Application 不做校验，由负责它的实例校验
+	Scope *scope.Scope `json:"-"`
 }
 
 // 确保ApplicationCustomValidator 结构体实现了 CustomValidator 接口
@@ -116,10 +224,23 @@ func (v *ApplicationCustomValidator) ValidateCreate(ctx context.Context, obj run
 		return nil, fmt.Errorf("expected a Application object but got %T", obj)
 	}
 	applicationlog.Info("Validation for Application upon creation", "name", application.GetName())
+	if inScope, err := v.Scope.Contains(ctx, v.Client, application); err != nil || !inScope {
+		return nil, err
+	}
 
-	// TODO(user): fill in your validation logic upon object creation.
+	// 汇总所有的字段错误一次性返回，方便用户一次修改完
+	allErrs := validateApplication(application)
+	allErrs = append(allErrs, v.validateDependencies(ctx, application)...)
+	policyErrs, warnings, err := v.validatePolicies(ctx, application)
+	if err != nil {
+		return nil, err
+	}
+	allErrs = append(allErrs, policyErrs...)
+	if len(allErrs) > 0 {
+		return warnings, apierrors.NewInvalid(applicationGroupKind, application.Name, allErrs)
+	}
 
-	return nil, nil
+	return warnings, nil
 }
 
 // ValidateUpdate implements webhook.CustomValidator so a webhook will be registered for the type Application.
@@ -128,11 +249,74 @@ func (v *ApplicationCustomValidator) ValidateUpdate(ctx context.Context, oldObj,
 	if !ok {
 		return nil, fmt.Errorf("expected a Application object for the newObj but got %T", newObj)
 	}
+	oldApplication, ok := oldObj.(*appsv1.Application)
+	if !ok {
+		return nil, fmt.Errorf("expected a Application object for the oldObj but got %T", oldObj)
+	}
 	applicationlog.Info("Validation for Application upon update", "name", application.GetName())
+	// 按新对象判断，修改标签把 Application 交给其他实例时由新的实例负责校验
+	if inScope, err := v.Scope.Contains(ctx, v.Client, application); err != nil || !inScope {
+		return nil, err
+	}
+
+	allErrs := validateApplication(application)
+	// 对比新旧对象，检查不可变字段和需要确认的变更，移除的子资源只给出 warning
+	transitionErrs, transitionWarnings := validateTransitions(oldApplication, application, v.MaxReplicaDropPercent)
+	allErrs = append(allErrs, transitionErrs...)
+	allErrs = append(allErrs, v.validateDependencies(ctx, application)...)
+	policyErrs, warnings, err := v.validatePolicies(ctx, application)
+	if err != nil {
+		return nil, err
+	}
+	allErrs = append(allErrs, policyErrs...)
+	warnings = append(transitionWarnings, warnings...)
+	if len(allErrs) > 0 {
+		return warnings, apierrors.NewInvalid(applicationGroupKind, application.Name, allErrs)
+	}
 
-	// TODO(user): fill in your validation logic upon object update.
+	return warnings, nil
+}
 
-	return nil, nil
+// validatePolicies 校验 namespace 级别的策略，有些策略只返回 warning 不拒绝请求
+func (v *ApplicationCustomValidator) validatePolicies(ctx context.Context, application *appsv1.Application) (field.ErrorList, admission.Warnings, error) {
+	ns, err := getNamespace(ctx, v.Client, application.Namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	sources, err := listPolicies(ctx, v.Client, ns)
+	if err != nil {
+		return nil, nil, err
+	}
+	policy, err := resolveReplicaPolicy(ns, v.ReplicaPolicy, sources)
+	if err != nil {
+		return nil, nil, err
+	}
+	allErrs, warnings := validateReplicas(application, policy)
+	if len(v.AllowedRegistries) > 0 {
+		allErrs = append(allErrs, validateAllowedRegistries(application, v.AllowedRegistries)...)
+	}
+	policyErrs, policyWarnings := validatePolicySources(application, sources)
+	allErrs = append(allErrs, policyErrs...)
+	warnings = append(warnings, policyWarnings...)
+	allErrs = append(allErrs, validateResourceProfile(application, sources)...)
+	budgetErrs, err := validateResourceBudget(ctx, v.Client, application, sources)
+	if err != nil {
+		return nil, nil, err
+	}
+	allErrs = append(allErrs, budgetErrs...)
+	// 按 namespace 上的 pod-security.kubernetes.io 标签检查 Pod Security Standards
+	securityErrs, securityWarnings := validatePodSecurity(application, ns)
+	allErrs = append(allErrs, securityErrs...)
+	warnings = append(warnings, securityWarnings...)
+	// 策略中使用 CEL 表达式描述的规则
+	if features.Enabled(features.PolicyRules) {
+		ruleErrs, ruleWarnings := validateRules(application, sources)
+		allErrs = append(allErrs, ruleErrs...)
+		warnings = append(warnings, ruleWarnings...)
+	}
+	// 有风险但是允许的配置，通过 warning 在 kubectl apply 的输出中提示
+	warnings = append(warnings, applicationWarnings(application, ns)...)
+	return allErrs, warnings, nil
 }
 
 // ValidateDelete implements webhook.CustomValidator so a webhook will be registered for the type Application.
@@ -142,8 +326,14 @@ func (v *ApplicationCustomValidator) ValidateDelete(ctx context.Context, obj run
 		return nil, fmt.Errorf("expected a Application object but got %T", obj)
 	}
 	applicationlog.Info("Validation for Application upon deletion", "name", application.GetName())
+	if inScope, err := v.Scope.Contains(ctx, v.Client, application); err != nil || !inScope {
+		return nil, err
+	}
 
-	// TODO(user): fill in your validation logic upon object deletion.
+	// 删除保护
+	if err := validateDeletion(application); err != nil {
+		return nil, err
+	}
 
 	return nil, nil
 }
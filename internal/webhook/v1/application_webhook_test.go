@@ -17,10 +17,25 @@ limitations under the License.
 package v1
 
 import (
+	"fmt"
+
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
+	k8sappsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
 	appsv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+	"github.com/aloys.zy/aloys-application-operator-webhook/internal/features"
+	"github.com/aloys.zy/aloys-application-operator-webhook/internal/scope"
 	// TODO (user): Add any additional imports if needed
 )
 
@@ -48,6 +63,616 @@ var _ = Describe("Application Webhook", func() {
 		// TODO (user): Add any teardown logic common to all tests
 	})
 
+	Context("When applying the replica policy", func() {
+		newNamespace := func(annotations map[string]string) *corev1.Namespace {
+			return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Annotations: annotations}}
+		}
+		BeforeEach(func() {
+			obj = newValidApplication("default", "shop")
+			defaulter.DefaultReplicas = 1
+		})
+
+		It("Should default replicas from the namespace annotation", func() {
+			defaulter.Client = newFakeClient(newNamespace(map[string]string{AnnotationDefaultReplicas: "3"}))
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(*obj.Spec.Deployment.Replicas).To(BeEquivalentTo(3))
+		})
+
+		It("Should keep replicas set by the user", func() {
+			replicas := int32(12)
+			obj.Spec.Deployment.Replicas = &replicas
+			defaulter.Client = newFakeClient(newNamespace(nil))
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(*obj.Spec.Deployment.Replicas).To(BeEquivalentTo(12))
+		})
+
+		It("Should deny replicas over the namespace maximum", func() {
+			replicas := int32(12)
+			obj.Spec.Deployment.Replicas = &replicas
+			validator.Client = newFakeClient(newNamespace(map[string]string{AnnotationMaxReplicas: "10"}))
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring("exceeds the maximum of 10 replicas")))
+		})
+
+		It("Should only warn when the namespace enforcement is Warn", func() {
+			replicas := int32(12)
+			obj.Spec.Deployment.Replicas = &replicas
+			validator.Client = newFakeClient(newNamespace(map[string]string{
+				AnnotationMaxReplicas:         "10",
+				AnnotationReplicasEnforcement: string(appsv1.ReplicasEnforcementWarn),
+			}))
+			warnings, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(ContainElement(ContainSubstring("exceeds the maximum of 10 replicas")))
+		})
+	})
+
+	Context("When returning admission warnings", func() {
+		BeforeEach(func() {
+			obj = newValidApplication("default", "shop")
+		})
+
+		It("Should warn about risky but allowed settings", func() {
+			privileged := true
+			replicas := int32(1)
+			obj.Spec.Deployment.Replicas = &replicas
+			obj.Spec.Deployment.Template.Spec.Containers[0].Image = "registry.local:5000/nginx"
+			obj.Spec.Deployment.Template.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{Privileged: &privileged}
+			obj.Spec.Deployment.Template.Spec.Containers[0].Resources = corev1.ResourceRequirements{}
+			obj.Spec.Deployment.Template.Spec.Containers[0].ReadinessProbe = nil
+			obj.Spec.Service.Type = corev1.ServiceTypeNodePort
+			validator.Client = newFakeClient(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "default",
+				Labels: map[string]string{LabelEnvironment: EnvironmentProduction},
+			}})
+
+			warnings, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(ContainElements(
+				ContainSubstring("has no tag"),
+				ContainSubstring("has no resource requests"),
+				ContainSubstring("has no resource limits"),
+				ContainSubstring("has no readiness probe"),
+				ContainSubstring("runs privileged"),
+				ContainSubstring("service type NodePort"),
+				ContainSubstring("single replica in a production namespace"),
+			))
+		})
+
+		It("Should not warn about pinned images", func() {
+			obj.Spec.Deployment.Template.Spec.Containers[0].Image = "nginx@sha256:0000000000000000000000000000000000000000000000000000000000000000"
+			warnings, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).NotTo(ContainElement(ContainSubstring("image")))
+		})
+	})
+
+	Context("When applying ApplicationPolicy and ClusterApplicationPolicy", func() {
+		var namespace *corev1.Namespace
+
+		BeforeEach(func() {
+			obj = newValidApplication("default", "shop")
+			namespace = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:   "default",
+				Labels: map[string]string{LabelEnvironment: EnvironmentProduction},
+			}}
+		})
+
+		It("Should apply defaults with namespaced policies overriding cluster policies", func() {
+			clusterReplicas, replicas := int32(2), int32(3)
+			defaulter.Client = newFakeClient(namespace,
+				&appsv1.ClusterApplicationPolicy{
+					ObjectMeta: metav1.ObjectMeta{Name: "production"},
+					Spec: appsv1.ClusterApplicationPolicySpec{ApplicationPolicySpec: appsv1.ApplicationPolicySpec{
+						Defaults: &appsv1.PolicyDefaults{
+							Replicas:    &clusterReplicas,
+							Labels:      map[string]string{"team": "platform", "tier": "backend"},
+							ServiceType: corev1.ServiceTypeClusterIP,
+						},
+					}},
+				},
+				&appsv1.ApplicationPolicy{
+					ObjectMeta: metav1.ObjectMeta{Name: "team", Namespace: "default"},
+					Spec: appsv1.ApplicationPolicySpec{Defaults: &appsv1.PolicyDefaults{
+						Replicas: &replicas,
+						Labels:   map[string]string{"team": "shop"},
+					}},
+				},
+			)
+			obj.Labels = map[string]string{"tier": "frontend"}
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(*obj.Spec.Deployment.Replicas).To(BeEquivalentTo(3))
+			Expect(obj.Labels).To(Equal(map[string]string{"tier": "frontend", "team": "platform"}))
+			Expect(obj.Spec.Service.Type).To(Equal(corev1.ServiceTypeClusterIP))
+		})
+
+		It("Should deny Applications violating a policy", func() {
+			maxReplicas, replicas := int32(2), int32(3)
+			obj.Spec.Deployment.Replicas = &replicas
+			obj.Spec.Service.Type = corev1.ServiceTypeLoadBalancer
+			validator.Client = newFakeClient(namespace,
+				&appsv1.ClusterApplicationPolicy{
+					ObjectMeta: metav1.ObjectMeta{Name: "production"},
+					Spec: appsv1.ClusterApplicationPolicySpec{
+						NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{LabelEnvironment: EnvironmentProduction}},
+						ApplicationPolicySpec: appsv1.ApplicationPolicySpec{
+							AllowedRegistries:     []string{"registry.corp"},
+							RequireResourceLimits: true,
+						},
+					},
+				},
+				&appsv1.ApplicationPolicy{
+					ObjectMeta: metav1.ObjectMeta{Name: "team", Namespace: "default"},
+					Spec: appsv1.ApplicationPolicySpec{
+						RequiredLabels:      []string{"team"},
+						MaxReplicas:         &maxReplicas,
+						AllowedServiceTypes: []corev1.ServiceType{corev1.ServiceTypeClusterIP},
+					},
+				},
+			)
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring(`registry "docker.io" is not allowed by ClusterApplicationPolicy production`)))
+			Expect(err).To(MatchError(ContainSubstring("spec.deployment.template.spec.containers[0].resources.limits[memory]")))
+			Expect(err).To(MatchError(ContainSubstring("metadata.labels[team]")))
+			Expect(err).To(MatchError(ContainSubstring("exceeds the maximum of 2 replicas allowed by ApplicationPolicy default/team")))
+			Expect(err).To(MatchError(ContainSubstring("service type LoadBalancer is not allowed")))
+		})
+
+		It("Should ignore cluster policies not selecting the namespace", func() {
+			namespace.Labels = nil
+			validator.Client = newFakeClient(namespace, &appsv1.ClusterApplicationPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "production"},
+				Spec: appsv1.ClusterApplicationPolicySpec{
+					NamespaceSelector:     &metav1.LabelSelector{MatchLabels: map[string]string{LabelEnvironment: EnvironmentProduction}},
+					ApplicationPolicySpec: appsv1.ApplicationPolicySpec{AllowedRegistries: []string{"registry.corp"}},
+				},
+			})
+			Expect(validator.ValidateCreate(ctx, obj)).Error().NotTo(HaveOccurred())
+		})
+	})
+
+	Context("When evaluating CEL rules from policies", func() {
+		newRulePolicy := func(rules ...appsv1.ValidationRule) *appsv1.ApplicationPolicy {
+			return &appsv1.ApplicationPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "rules", Namespace: "default"},
+				Spec:       appsv1.ApplicationPolicySpec{Rules: rules},
+			}
+		}
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+
+		BeforeEach(func() {
+			obj = newValidApplication("default", "shop")
+		})
+
+		It("Should deny or warn according to the rule severity", func() {
+			validator.Client = newFakeClient(namespace, newRulePolicy(
+				appsv1.ValidationRule{
+					Name:       "corp-registry",
+					Expression: "self.spec.deployment.template.spec.containers.all(c, c.image.startsWith('registry.corp/'))",
+					Message:    "images must come from registry.corp",
+				},
+				appsv1.ValidationRule{
+					Name:       "owner",
+					Expression: "has(self.metadata.labels) && 'owner' in self.metadata.labels",
+					Severity:   appsv1.RuleSeverityWarn,
+				},
+			))
+			warnings, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring(`rule "corp-registry" of ApplicationPolicy default/rules: images must come from registry.corp`)))
+			Expect(warnings).To(ContainElement(ContainSubstring(`rule "owner"`)))
+
+			obj.Spec.Deployment.Template.Spec.Containers[0].Image = "registry.corp/nginx:1.27"
+			obj.Labels = map[string]string{"owner": "shop"}
+			Expect(validator.ValidateCreate(ctx, obj)).Error().NotTo(HaveOccurred())
+		})
+
+		It("Should report rules that do not compile", func() {
+			validator.Client = newFakeClient(namespace, newRulePolicy(appsv1.ValidationRule{Name: "broken", Expression: "self.spec +"}))
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring(`rule "broken" of ApplicationPolicy default/rules is invalid`)))
+		})
+
+		It("Should compile each expression once and bound the cache", func() {
+			cache := newCELProgramCache()
+			first, err := cache.program("true")
+			Expect(err).NotTo(HaveOccurred())
+			again, err := cache.program("true")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(again).To(BeIdenticalTo(first))
+			changed, err := cache.program("false")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(changed).NotTo(BeIdenticalTo(first))
+
+			By("evicting the least recently used expressions")
+			for i := 0; i < celProgramCacheSize; i++ {
+				_, err := cache.program(fmt.Sprintf("self.spec.replicas > %d", i))
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(cache.programs.Len()).To(Equal(celProgramCacheSize))
+			evicted, err := cache.program("true")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(evicted).NotTo(BeIdenticalTo(first))
+		})
+	})
+
+	Context("When rewriting and restricting images", func() {
+		const digest = "sha256:0b6a027b5cf322f09f6706c754e86a4a6c4f7dcf40ebc6a2ab1c3ee2e5d8e8a1"
+
+		BeforeEach(func() {
+			obj = newValidApplication("default", "shop")
+		})
+
+		It("Should rewrite images to the mirror and pin digests", func() {
+			resolver, err := NewStaticImageResolver(map[string]string{"mirror.corp/dockerhub/library/nginx:1.27": digest})
+			Expect(err).NotTo(HaveOccurred())
+			defaulter.ImageMirrors = map[string]string{"docker.io": "mirror.corp/dockerhub", "quay.io/prometheus": "mirror.corp/prom"}
+			defaulter.ImageResolver = resolver
+			obj.Spec.Deployment.Template.Spec.InitContainers = []corev1.Container{{Name: "init", Image: "quay.io/prometheus/busybox:1.0"}}
+
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(obj.Spec.Deployment.Template.Spec.Containers[0].Image).To(Equal("mirror.corp/dockerhub/library/nginx:1.27@" + digest))
+			// 解析不到 digest 的镜像只改写仓库
+			Expect(obj.Spec.Deployment.Template.Spec.InitContainers[0].Image).To(Equal("mirror.corp/prom/busybox:1.0"))
+
+			// 再次设置默认值不会重复改写
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(obj.Spec.Deployment.Template.Spec.Containers[0].Image).To(Equal("mirror.corp/dockerhub/library/nginx:1.27@" + digest))
+		})
+
+		It("Should reject invalid digests", func() {
+			_, err := NewStaticImageResolver(map[string]string{"nginx:1.27": "latest"})
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should deny images outside the global allowlist", func() {
+			validator.AllowedRegistries = []string{"mirror.corp"}
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring(`spec.deployment.template.spec.containers[0].image: Forbidden: registry "docker.io" is not allowed`)))
+
+			obj.Spec.Deployment.Template.Spec.Containers[0].Image = "mirror.corp/dockerhub/library/nginx:1.27"
+			Expect(validator.ValidateCreate(ctx, obj)).Error().NotTo(HaveOccurred())
+		})
+	})
+
+	Context("When applying resource profiles and budgets", func() {
+		BeforeEach(func() {
+			obj = newValidApplication("default", "shop")
+		})
+
+		It("Should fill missing resources from the namespace profile", func() {
+			namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:        "default",
+				Annotations: map[string]string{AnnotationResourceProfile: "medium"},
+			}}
+			defaulter.Client = newFakeClient(namespace)
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+
+			resources := obj.Spec.Deployment.Template.Spec.Containers[0].Resources
+			// 用户设置的 cpu 保持不变，只补充 memory
+			Expect(resources.Requests).To(HaveKeyWithValue(corev1.ResourceCPU, resource.MustParse("100m")))
+			Expect(resources.Limits).To(HaveKeyWithValue(corev1.ResourceCPU, resource.MustParse("500m")))
+			Expect(resources.Requests).To(HaveKeyWithValue(corev1.ResourceMemory, resource.MustParse("256Mi")))
+			Expect(resources.Limits).To(HaveKeyWithValue(corev1.ResourceMemory, resource.MustParse("512Mi")))
+
+			namespace.Annotations[AnnotationResourceProfile] = "huge"
+			defaulter.Client = newFakeClient(namespace)
+			Expect(defaulter.Default(ctx, newValidApplication("default", "shop"))).To(MatchError(ContainSubstring(`unknown resource profile "huge"`)))
+		})
+
+		It("Should prefer spec.resourceProfile and custom profiles from policies", func() {
+			policy := &appsv1.ApplicationPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "profiles", Namespace: "default"},
+				Spec: appsv1.ApplicationPolicySpec{ResourceProfiles: []appsv1.ResourceProfile{{
+					Name:     "small",
+					Requests: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("64Mi")},
+				}}},
+			}
+			defaulter.Client = newFakeClient(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}, policy)
+			obj.Spec.ResourceProfile = "small"
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(obj.Spec.Deployment.Template.Spec.Containers[0].Resources.Requests).To(HaveKeyWithValue(corev1.ResourceMemory, resource.MustParse("64Mi")))
+
+			obj.Spec.ResourceProfile = "unknown"
+			Expect(validator.ValidateCreate(ctx, obj)).Error().To(MatchError(ContainSubstring(`spec.resourceProfile: Not found: "unknown"`)))
+		})
+
+		It("Should deny limits below requests", func() {
+			obj.Spec.Deployment.Template.Spec.Containers[0].Resources.Limits[corev1.ResourceCPU] = resource.MustParse("50m")
+			Expect(validator.ValidateCreate(ctx, obj)).Error().To(MatchError(ContainSubstring(
+				"spec.deployment.template.spec.containers[0].resources.limits[cpu]: Invalid value: \"50m\": must be greater than or equal to the cpu request 100m")))
+		})
+
+		It("Should deny Applications exceeding the namespace budget", func() {
+			policy := &appsv1.ApplicationPolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "budget", Namespace: "default"},
+				Spec:       appsv1.ApplicationPolicySpec{ResourceBudget: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m")}},
+			}
+			existing := newValidApplication("default", "cart")
+			three, one := int32(3), int32(1)
+			existing.Spec.Deployment.Replicas = &three
+			validator.Client = newFakeClient(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}, policy, existing)
+
+			obj.Spec.Deployment.Replicas = &one
+			Expect(validator.ValidateCreate(ctx, obj)).Error().NotTo(HaveOccurred())
+
+			obj.Spec.Deployment.Replicas = &three
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring("total cpu requests 600m of namespace default exceed the budget 500m set by ApplicationPolicy default/budget")))
+		})
+	})
+
+	Context("When hardening security contexts", func() {
+		newNamespace := func(labels map[string]string) *corev1.Namespace {
+			return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Labels: labels}}
+		}
+
+		BeforeEach(func() {
+			obj = newValidApplication("default", "shop")
+		})
+
+		It("Should inject a restricted security context unless opted out", func() {
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			podSpec := obj.Spec.Deployment.Template.Spec
+			Expect(*podSpec.SecurityContext.RunAsNonRoot).To(BeTrue())
+			Expect(podSpec.SecurityContext.SeccompProfile.Type).To(Equal(corev1.SeccompProfileTypeRuntimeDefault))
+			sc := podSpec.Containers[0].SecurityContext
+			Expect(*sc.AllowPrivilegeEscalation).To(BeFalse())
+			Expect(*sc.ReadOnlyRootFilesystem).To(BeTrue())
+			Expect(sc.Capabilities.Drop).To(ConsistOf(corev1.Capability("ALL")))
+
+			optOut := newValidApplication("default", "shop")
+			optOut.Annotations = map[string]string{AnnotationSecurityHardening: SecurityHardeningDisabled}
+			Expect(defaulter.Default(ctx, optOut)).To(Succeed())
+			Expect(optOut.Spec.Deployment.Template.Spec.SecurityContext).To(BeNil())
+			Expect(optOut.Spec.Deployment.Template.Spec.Containers[0].SecurityContext).To(BeNil())
+		})
+
+		It("Should not inject security contexts when the SecurityHardening feature is disabled", func() {
+			Expect(features.DefaultMutableFeatureGate.SetFromMap(map[string]bool{string(features.SecurityHardening): false})).To(Succeed())
+			DeferCleanup(func() {
+				Expect(features.DefaultMutableFeatureGate.SetFromMap(map[string]bool{string(features.SecurityHardening): true})).To(Succeed())
+			})
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(obj.Spec.Deployment.Template.Spec.SecurityContext).To(BeNil())
+			Expect(obj.Spec.Deployment.Template.Spec.Containers[0].SecurityContext).To(BeNil())
+		})
+
+		It("Should keep explicit settings", func() {
+			readOnly := false
+			obj.Spec.Deployment.Template.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{ReadOnlyRootFilesystem: &readOnly}
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(*obj.Spec.Deployment.Template.Spec.Containers[0].SecurityContext.ReadOnlyRootFilesystem).To(BeFalse())
+		})
+
+		It("Should report every field violating the restricted level", func() {
+			validator.Client = newFakeClient(newNamespace(map[string]string{LabelPodSecurityEnforce: PodSecurityRestricted}))
+			_, err := validator.ValidateCreate(ctx, obj)
+			containerPath := "spec.deployment.template.spec.containers[0].securityContext"
+			Expect(err).To(MatchError(ContainSubstring(containerPath + ".allowPrivilegeEscalation")))
+			Expect(err).To(MatchError(ContainSubstring(containerPath + ".capabilities.drop")))
+			Expect(err).To(MatchError(ContainSubstring(containerPath + ".runAsNonRoot")))
+			Expect(err).To(MatchError(ContainSubstring(containerPath + ".seccompProfile.type")))
+
+			// 设置默认值之后满足 restricted
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(validator.ValidateCreate(ctx, obj)).Error().NotTo(HaveOccurred())
+		})
+
+		It("Should deny baseline violations and warn about restricted ones", func() {
+			validator.Client = newFakeClient(newNamespace(map[string]string{
+				LabelPodSecurityEnforce: PodSecurityBaseline,
+				LabelPodSecurityWarn:    PodSecurityRestricted,
+			}))
+			obj.Spec.Deployment.Template.Spec.HostNetwork = true
+			obj.Spec.Deployment.Template.Spec.Containers[0].SecurityContext = &corev1.SecurityContext{
+				Capabilities: &corev1.Capabilities{Add: []corev1.Capability{"SYS_ADMIN"}},
+			}
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring(`spec.deployment.template.spec.hostNetwork: Forbidden: violates PodSecurity "baseline:latest"`)))
+			Expect(err).To(MatchError(ContainSubstring("spec.deployment.template.spec.containers[0].securityContext.capabilities.add[0]")))
+
+			obj.Spec.Deployment.Template.Spec.HostNetwork = false
+			obj.Spec.Deployment.Template.Spec.Containers[0].SecurityContext = nil
+			warnings, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(ContainElement(ContainSubstring(`violates PodSecurity "restricted:latest"`)))
+		})
+	})
+
+	Context("When injecting sidecars", func() {
+		const sidecarNamespace = "platform"
+		logForwarder := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "log-forwarder",
+				Namespace: sidecarNamespace,
+				Labels:    map[string]string{LabelSidecarTemplate: "true"},
+			},
+			Data: map[string]string{SidecarTemplateKey: `
+containers:
+  - name: fluent-bit
+    image: fluent/fluent-bit:3.0
+    volumeMounts:
+      - name: logs
+        mountPath: /var/log/app
+volumes:
+  - name: logs
+    emptyDir: {}
+env:
+  - name: LOG_DIR
+    value: /var/log/app
+`},
+		}
+
+		BeforeEach(func() {
+			obj = newValidApplication("default", "shop")
+			obj.Annotations = map[string]string{AnnotationInjectSidecars: "log-forwarder"}
+			defaulter.SidecarNamespace = sidecarNamespace
+			defaulter.Client = newFakeClient(logForwarder)
+		})
+
+		It("Should inject sidecars only once and record them", func() {
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+
+			podSpec := obj.Spec.Deployment.Template.Spec
+			Expect(podSpec.Containers).To(HaveLen(2))
+			Expect(podSpec.Containers[1].Name).To(Equal("fluent-bit"))
+			Expect(podSpec.Volumes).To(HaveLen(1))
+			Expect(podSpec.Containers[0].Env).To(ConsistOf(corev1.EnvVar{Name: "LOG_DIR", Value: "/var/log/app"}))
+			Expect(podSpec.Containers[1].Env).To(BeEmpty())
+			Expect(obj.Annotations).To(HaveKeyWithValue(AnnotationInjectedSidecars,
+				`{"log-forwarder":{"containers":["fluent-bit"],"env":["LOG_DIR"],"volumes":["logs"]}}`))
+		})
+
+		It("Should remove sidecars that are no longer requested", func() {
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(obj.Spec.Deployment.Template.Spec.Containers).To(HaveLen(2))
+
+			By("dropping the template from the annotation")
+			delete(obj.Annotations, AnnotationInjectSidecars)
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			containers := obj.Spec.Deployment.Template.Spec.Containers
+			Expect(containers).To(HaveLen(1))
+			Expect(containers[0].Name).NotTo(Equal("fluent-bit"))
+			Expect(obj.Annotations).NotTo(HaveKey(AnnotationInjectedSidecars))
+		})
+
+		It("Should remove the env and volumes injected by a dropped template", func() {
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(obj.Spec.Deployment.Template.Spec.Volumes).To(HaveLen(1))
+
+			delete(obj.Annotations, AnnotationInjectSidecars)
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			podSpec := obj.Spec.Deployment.Template.Spec
+			Expect(podSpec.Containers[0].Env).To(BeEmpty())
+			Expect(podSpec.Volumes).To(BeEmpty())
+		})
+
+		It("Should keep user-supplied containers, env and volumes when the template is dropped", func() {
+			podSpec := &obj.Spec.Deployment.Template.Spec
+			podSpec.Containers[0].Env = []corev1.EnvVar{{Name: "LOG_DIR", Value: "/logs"}}
+			podSpec.Containers = append(podSpec.Containers, corev1.Container{Name: "fluent-bit", Image: "fluent/fluent-bit:2.2"})
+			podSpec.Volumes = []corev1.Volume{{Name: "logs", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}}
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(obj.Annotations).To(HaveKeyWithValue(AnnotationInjectedSidecars, `{"log-forwarder":{}}`))
+
+			delete(obj.Annotations, AnnotationInjectSidecars)
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			podSpec = &obj.Spec.Deployment.Template.Spec
+			Expect(podSpec.Containers).To(HaveLen(2))
+			Expect(podSpec.Containers[1].Image).To(Equal("fluent/fluent-bit:2.2"))
+			Expect(podSpec.Containers[0].Env).To(ConsistOf(corev1.EnvVar{Name: "LOG_DIR", Value: "/logs"}))
+			Expect(podSpec.Volumes).To(HaveLen(1))
+			Expect(obj.Annotations).NotTo(HaveKey(AnnotationInjectedSidecars))
+		})
+
+		It("Should deny unknown templates", func() {
+			obj.Annotations[AnnotationInjectSidecars] = "log-forwarder, proxy"
+			Expect(defaulter.Default(ctx, obj)).To(MatchError(`sidecar template "proxy" not found in namespace platform`))
+		})
+	})
+
+	Context("When deleting protected Applications", func() {
+		BeforeEach(func() {
+			obj = newValidApplication("default", "shop")
+		})
+
+		It("Should allow deleting unprotected Applications", func() {
+			Expect(validator.ValidateDelete(ctx, obj)).Error().NotTo(HaveOccurred())
+		})
+
+		It("Should deny deletes until the name is confirmed", func() {
+			obj.Spec.DeletionProtection = true
+			_, err := validator.ValidateDelete(ctx, obj)
+			Expect(apierrors.IsForbidden(err)).To(BeTrue())
+			Expect(err).To(MatchError(ContainSubstring(AnnotationConfirmDelete + "=shop")))
+
+			obj.Annotations = map[string]string{AnnotationConfirmDelete: "cart"}
+			Expect(validator.ValidateDelete(ctx, obj)).Error().To(HaveOccurred())
+			obj.Annotations[AnnotationConfirmDelete] = "shop"
+			Expect(validator.ValidateDelete(ctx, obj)).Error().NotTo(HaveOccurred())
+		})
+
+		It("Should honour the protection annotation", func() {
+			obj.Annotations = map[string]string{AnnotationProtectDelete: "true"}
+			Expect(validator.ValidateDelete(ctx, obj)).Error().To(HaveOccurred())
+		})
+	})
+
+	Context("When several instances share the cluster", func() {
+		BeforeEach(func() {
+			obj = newValidApplication("default", "shop")
+			appScope, err := scope.New(nil, "", scope.LabelControllerClass+"=team-a")
+			Expect(err).NotTo(HaveOccurred())
+			defaulter.Scope = appScope
+			defaulter.DefaultReplicas = 2
+			validator.Scope = appScope
+		})
+
+		It("Should leave Applications of other classes untouched", func() {
+			obj.Spec.Deployment.Replicas = nil
+			obj.Spec.Deployment.Template.Spec.Containers[0].Image = ""
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(obj.Spec.Deployment.Replicas).To(BeNil())
+			Expect(validator.ValidateCreate(ctx, obj)).Error().NotTo(HaveOccurred())
+		})
+
+		It("Should default and validate Applications of its own class", func() {
+			obj.Labels = map[string]string{scope.LabelControllerClass: "team-a"}
+			obj.Spec.Deployment.Replicas = nil
+			Expect(defaulter.Default(ctx, obj)).To(Succeed())
+			Expect(*obj.Spec.Deployment.Replicas).To(BeEquivalentTo(2))
+			obj.Spec.Deployment.Template.Spec.Containers[0].Image = ""
+			Expect(validator.ValidateCreate(ctx, obj)).Error().To(HaveOccurred())
+		})
+	})
+
+	Context("When updating an Application", func() {
+		BeforeEach(func() {
+			oldObj = newValidApplication("default", "shop")
+			obj = newValidApplication("default", "shop")
+			validator.MaxReplicaDropPercent = 50
+		})
+
+		It("Should deny changing the selector", func() {
+			obj.Spec.Deployment.Selector.MatchLabels = map[string]string{"app": "shop-v2"}
+			_, err := validator.ValidateUpdate(ctx, oldObj, obj)
+			Expect(err).To(MatchError(ContainSubstring("spec.deployment.selector: Invalid value")))
+			Expect(err).To(MatchError(ContainSubstring("field is immutable")))
+		})
+
+		It("Should require acknowledging large replica drops", func() {
+			ten, four, six := int32(10), int32(4), int32(6)
+			oldObj.Spec.Deployment.Replicas = &ten
+			obj.Spec.Deployment.Replicas = &six
+			Expect(validator.ValidateUpdate(ctx, oldObj, obj)).Error().NotTo(HaveOccurred())
+
+			obj.Spec.Deployment.Replicas = &four
+			_, err := validator.ValidateUpdate(ctx, oldObj, obj)
+			Expect(err).To(MatchError(ContainSubstring("scaling down from 10 to 4 replicas (60%) exceeds the allowed 50%")))
+
+			Expect(err).To(MatchError(ContainSubstring(AnnotationAcknowledgeScaleDown + "=4 to acknowledge")))
+
+			obj.Annotations = map[string]string{AnnotationAcknowledgeScaleDown: "true"}
+			Expect(validator.ValidateUpdate(ctx, oldObj, obj)).Error().To(HaveOccurred())
+			obj.Annotations = map[string]string{AnnotationAcknowledgeScaleDown: "4"}
+			Expect(validator.ValidateUpdate(ctx, oldObj, obj)).Error().NotTo(HaveOccurred())
+
+			By("not reusing an earlier acknowledgement for the next drop")
+			one := int32(1)
+			oldObj = obj.DeepCopy()
+			obj.Spec.Deployment.Replicas = &one
+			Expect(validator.ValidateUpdate(ctx, oldObj, obj)).Error().To(MatchError(ContainSubstring("scaling down from 4 to 1 replicas")))
+		})
+
+		It("Should warn when moving away from LoadBalancer", func() {
+			oldObj.Spec.Service.Type = corev1.ServiceTypeLoadBalancer
+			warnings, err := validator.ValidateUpdate(ctx, oldObj, obj)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(ConsistOf("spec.service.type: changing from LoadBalancer to ClusterIP releases the external load balancer and its address"))
+		})
+	})
+
 	Context("When creating Application under Defaulting Webhook", func() {
 		// TODO (user): Add logic for defaulting webhooks
 		// Example:
@@ -84,4 +709,136 @@ var _ = Describe("Application Webhook", func() {
 		// })
 	})
 
+	Context("When validating Application dependencies", func() {
+		newApplication := func(namespace, name string, dependsOn ...appsv1.ApplicationReference) *appsv1.Application {
+			application := newValidApplication(namespace, name)
+			application.Spec.DependsOn = dependsOn
+			return application
+		}
+
+		BeforeEach(func() {
+			validator.Client = newFakeClient(
+				newApplication("default", "api", appsv1.ApplicationReference{Name: "db", Namespace: "data"}),
+				newApplication("data", "db", appsv1.ApplicationReference{Name: "frontend", Namespace: "default"}),
+			)
+		})
+
+		It("Should deny an Application that depends on itself", func() {
+			obj = newApplication("default", "frontend", appsv1.ApplicationReference{Name: "frontend"})
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring("cannot depend on itself")))
+		})
+
+		It("Should deny a dependency cycle across namespaces", func() {
+			obj = newApplication("default", "frontend", appsv1.ApplicationReference{Name: "api"})
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring("default/frontend -> default/api -> data/db -> default/frontend")))
+		})
+
+		It("Should admit dependencies without a cycle", func() {
+			obj = newApplication("default", "web", appsv1.ApplicationReference{Name: "api"})
+			Expect(validator.ValidateCreate(ctx, obj)).Error().NotTo(HaveOccurred())
+		})
+
+		It("Should deny dependencies outside the watched namespaces", func() {
+			appScope, err := scope.New([]string{"default"}, "", "")
+			Expect(err).NotTo(HaveOccurred())
+			validator.Scope = appScope
+			obj = newApplication("default", "web", appsv1.ApplicationReference{Name: "db", Namespace: "data"})
+			_, err = validator.ValidateCreate(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring(`spec.dependsOn[0].namespace: Forbidden: dependency namespace "data" is outside the operator's scope`)))
+
+			By("not following dependencies that leave the scope")
+			obj = newApplication("default", "web", appsv1.ApplicationReference{Name: "api"})
+			Expect(validator.ValidateCreate(ctx, obj)).Error().NotTo(HaveOccurred())
+		})
+	})
+	Context("When validating the Application spec", func() {
+		BeforeEach(func() {
+			obj = newValidApplication("default", "shop")
+		})
+
+		It("Should admit a valid Application", func() {
+			Expect(validator.ValidateCreate(ctx, obj)).Error().NotTo(HaveOccurred())
+		})
+
+		It("Should aggregate every field error", func() {
+			obj.Spec.Deployment.Template.Spec.Containers[0].Image = ""
+			obj.Spec.Deployment.Template.Labels = map[string]string{"app": "other"}
+			obj.Spec.Service.Ports[0].TargetPort = intstr.FromInt32(8080)
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring("spec.deployment.template.spec.containers[0].image")))
+			Expect(err).To(MatchError(ContainSubstring("spec.deployment.selector.matchLabels[app]")))
+			Expect(err).To(MatchError(ContainSubstring("spec.service.ports[0].targetPort")))
+		})
+
+		It("Should deny an Application without containers", func() {
+			obj.Spec.Deployment.Template.Spec.Containers = nil
+			Expect(validator.ValidateCreate(ctx, obj)).Error().To(MatchError(ContainSubstring("at least one container is required")))
+		})
+
+		It("Should deny invalid service type combinations", func() {
+			obj.Spec.Service.Ports[0].NodePort = 30080
+			obj.Spec.Service.ClusterIP = corev1.ClusterIPNone
+			obj.Spec.Service.Type = corev1.ServiceTypeLoadBalancer
+			_, err := validator.ValidateCreate(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring("headless service cannot be of type LoadBalancer")))
+
+			obj.Spec.Service.ClusterIP = ""
+			obj.Spec.Service.Type = corev1.ServiceTypeClusterIP
+			_, err = validator.ValidateCreate(ctx, obj)
+			Expect(err).To(MatchError(ContainSubstring("spec.service.ports[0].nodePort")))
+		})
+
+		It("Should deny names whose generated children exceed DNS limits", func() {
+			obj.Name = "a-very-long-application-name-that-will-not-fit-with-suffix"
+			Expect(validator.ValidateCreate(ctx, obj)).Error().To(MatchError(ContainSubstring("-deployment")))
+		})
+
+		It("Should admit removing a component with a warning", func() {
+			oldObj = newValidApplication("default", "shop")
+			oldObj.Spec.Components = []appsv1.ComponentSpec{{Name: "worker", Deployment: oldObj.Spec.Deployment}}
+			warnings, err := validator.ValidateUpdate(ctx, oldObj, obj)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(warnings).To(ContainElement(`spec.components: component "worker" was removed or renamed, its Deployment and Service will be deleted`))
+		})
+	})
 })
+
+// newValidApplication 返回一个能通过校验且没有 warning 的 Application，测试在此基础上修改
+func newValidApplication(namespace, name string) *appsv1.Application {
+	labels := map[string]string{"app": name}
+	return &appsv1.Application{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: appsv1.ApplicationSpec{
+			Deployment: appsv1.DeploymentTemplate{DeploymentSpec: k8sappsv1.DeploymentSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: labels},
+				Template: corev1.PodTemplateSpec{Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{
+						Name:  "main",
+						Image: "nginx:1.27",
+						Ports: []corev1.ContainerPort{{ContainerPort: 80}},
+						Resources: corev1.ResourceRequirements{
+							Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("100m")},
+							Limits:   corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m")},
+						},
+						ReadinessProbe: &corev1.Probe{ProbeHandler: corev1.ProbeHandler{
+							TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt32(80)},
+						}},
+					}},
+				}},
+			}},
+			Service: appsv1.ServiceTemplate{ServiceSpec: corev1.ServiceSpec{
+				Ports: []corev1.ServicePort{{Port: 80}},
+			}},
+		},
+	}
+}
+
+// newFakeClient 返回包含内置资源和 Application 的 fake client
+func newFakeClient(objs ...client.Object) client.Client {
+	testScheme := runtime.NewScheme()
+	Expect(clientgoscheme.AddToScheme(testScheme)).To(Succeed())
+	Expect(appsv1.AddToScheme(testScheme)).To(Succeed())
+	return fake.NewClientBuilder().WithScheme(testScheme).WithObjects(objs...).Build()
+}
@@ -0,0 +1,122 @@
+package v1
+
+import (
+	"fmt"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/ext"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"k8s.io/utils/lru"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	appsv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+)
+
+// celCostLimit 限制单条规则的计算量，避免写得很差的表达式拖慢 apiserver 的请求
+const celCostLimit = 1000000
+
+// celPrograms 编译好的 CEL 程序，所有 validator 共享
+var celPrograms = newCELProgramCache()
+
+// celProgramCacheSize 缓存的表达式数量上限，策略修改或删除之后旧的表达式会逐渐被淘汰
+const celProgramCacheSize = 1024
+
+// celProgramCache 按表达式缓存编译结果，相同的表达式只编译一次。
+// 使用 LRU 限制大小，策略反复修改时不会一直增长
+type celProgramCache struct {
+	env      *cel.Env
+	envErr   error
+	programs *lru.Cache
+}
+
+type compiledRule struct {
+	program cel.Program
+	err     error
+}
+
+func newCELProgramCache() *celProgramCache {
+	env, err := cel.NewEnv(
+		cel.Variable("self", cel.DynType),
+		ext.Strings(),
+	)
+	return &celProgramCache{env: env, envErr: err, programs: lru.New(celProgramCacheSize)}
+}
+
+// program 返回表达式对应的程序，编译失败的结果同样会被缓存
+func (c *celProgramCache) program(expression string) (cel.Program, error) {
+	if c.envErr != nil {
+		return nil, c.envErr
+	}
+	if cached, ok := c.programs.Get(expression); ok {
+		compiled := cached.(compiledRule)
+		return compiled.program, compiled.err
+	}
+
+	var compiled compiledRule
+	ast, issues := c.env.Compile(expression)
+	switch {
+	case issues != nil && issues.Err() != nil:
+		compiled.err = issues.Err()
+	case ast.OutputType() != cel.BoolType && ast.OutputType() != cel.DynType:
+		compiled.err = fmt.Errorf("must evaluate to bool, got %s", ast.OutputType())
+	default:
+		compiled.program, compiled.err = c.env.Program(ast, cel.CostLimit(celCostLimit), cel.InterruptCheckFrequency(100))
+	}
+	c.programs.Add(expression, compiled)
+	return compiled.program, compiled.err
+}
+
+// validateRules 依次执行策略中的 CEL 规则
+func validateRules(application *appsv1.Application, sources []policySource) (field.ErrorList, admission.Warnings) {
+	var allErrs field.ErrorList
+	var warnings admission.Warnings
+	var self map[string]interface{}
+	for _, source := range sources {
+		for _, rule := range source.Spec.Rules {
+			// 只有存在规则时才转换对象
+			if self == nil {
+				obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(application)
+				if err != nil {
+					return append(allErrs, field.InternalError(field.NewPath(""), err)), warnings
+				}
+				self = obj
+			}
+
+			msg := evaluateRule(source, rule, self)
+			if msg == "" {
+				continue
+			}
+			if rule.Severity == appsv1.RuleSeverityWarn {
+				warnings = append(warnings, msg)
+				continue
+			}
+			allErrs = append(allErrs, field.Forbidden(field.NewPath("spec"), msg))
+		}
+	}
+	return allErrs, warnings
+}
+
+// evaluateRule 满足规则时返回空字符串，否则返回给用户的信息
+func evaluateRule(source policySource, rule appsv1.ValidationRule, self map[string]interface{}) string {
+	prefix := fmt.Sprintf("rule %q of %s", rule.Name, source)
+	program, err := celPrograms.program(rule.Expression)
+	if err != nil {
+		return fmt.Sprintf("%s is invalid: %v", prefix, err)
+	}
+	out, _, err := program.Eval(map[string]interface{}{"self": self})
+	if err != nil {
+		return fmt.Sprintf("%s failed to evaluate: %v", prefix, err)
+	}
+	passed, ok := out.Value().(bool)
+	if !ok {
+		return fmt.Sprintf("%s must evaluate to bool, got %v", prefix, out.Type())
+	}
+	if passed {
+		return ""
+	}
+	if rule.Message != "" {
+		return fmt.Sprintf("%s: %s", prefix, rule.Message)
+	}
+	return fmt.Sprintf("%s: failed expression %s", prefix, rule.Expression)
+}
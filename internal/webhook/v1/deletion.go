@@ -0,0 +1,38 @@
+package v1
+
+import (
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+
+	appsv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+)
+
+const (
+	// AnnotationProtectDelete 值为 true 时禁止删除，和 spec.deletionProtection 等价
+	AnnotationProtectDelete = "apps.aloys.cn/protect-delete"
+	// AnnotationConfirmDelete 值必须等于 Application 的名称，才能删除受保护的应用
+	AnnotationConfirmDelete = "apps.aloys.cn/confirm-delete"
+)
+
+// applicationGroupResource 用于构造 Forbidden 错误
+var applicationGroupResource = appsv1.GroupVersion.WithResource("applications").GroupResource()
+
+// deletionProtected spec.deletionProtection 或者注解任意一个开启即受保护
+func deletionProtected(application *appsv1.Application) bool {
+	return application.Spec.DeletionProtection || strings.EqualFold(application.Annotations[AnnotationProtectDelete], "true")
+}
+
+// validateDeletion 受保护的应用必须先通过注解确认名称才能删除，防止 kubectl delete -f 误删
+func validateDeletion(application *appsv1.Application) error {
+	if !deletionProtected(application) {
+		return nil
+	}
+	if application.Annotations[AnnotationConfirmDelete] == application.Name {
+		return nil
+	}
+	return apierrors.NewForbidden(applicationGroupResource, application.Name, fmt.Errorf(
+		"application is protected from deletion, annotate it with %s=%s to confirm or disable the protection first",
+		AnnotationConfirmDelete, application.Name))
+}
@@ -0,0 +1,74 @@
+package v1
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	appsv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+)
+
+// validateDependencies 检查 spec.dependsOn 是否引用了自身、当前实例范围之外的 namespace 或者形成了依赖环
+// 依赖图中不存在的 Application 不算错误，控制器会一直等待它被创建
+func (v *ApplicationCustomValidator) validateDependencies(ctx context.Context, application *appsv1.Application) field.ErrorList {
+	var allErrs field.ErrorList
+	self := types.NamespacedName{Namespace: application.Namespace, Name: application.Name}
+	fldPath := field.NewPath("spec", "dependsOn")
+	for i, ref := range application.Spec.DependsOn {
+		key := ref.NamespacedName(application.Namespace)
+		if key == self {
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i), ref, "an Application cannot depend on itself"))
+			continue
+		}
+		// 设置了 --watch-namespaces 时其他 namespace 不在缓存中，控制器没法读取依赖的状态
+		if !v.Scope.CachesNamespace(key.Namespace) {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Index(i).Child("namespace"),
+				fmt.Sprintf("dependency namespace %q is outside the operator's scope", key.Namespace)))
+			continue
+		}
+		path, err := v.findDependencyPath(ctx, key, self, map[types.NamespacedName]bool{})
+		if err != nil {
+			allErrs = append(allErrs, field.InternalError(fldPath.Index(i), err))
+			continue
+		}
+		if path != nil {
+			cycle := append([]string{self.String()}, path...)
+			allErrs = append(allErrs, field.Invalid(fldPath.Index(i), ref, "dependency cycle detected: "+strings.Join(cycle, " -> ")))
+		}
+	}
+	return allErrs
+}
+
+// findDependencyPath 深度优先查找从 from 到 target 的依赖路径，找到时返回经过的应用（包含两端）
+func (v *ApplicationCustomValidator) findDependencyPath(ctx context.Context, from, target types.NamespacedName, visited map[types.NamespacedName]bool) ([]string, error) {
+	if from == target {
+		return []string{target.String()}, nil
+	}
+	// 范围之外的 Application 读不到，范围变化之前创建的依赖不再继续查找
+	if v.Client == nil || visited[from] || !v.Scope.CachesNamespace(from.Namespace) {
+		return nil, nil
+	}
+	visited[from] = true
+
+	dependency := &appsv1.Application{}
+	if err := v.Client.Get(ctx, from, dependency); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, ref := range dependency.Spec.DependsOn {
+		path, err := v.findDependencyPath(ctx, ref.NamespacedName(dependency.Namespace), target, visited)
+		if err != nil || path != nil {
+			if path != nil {
+				path = append([]string{from.String()}, path...)
+			}
+			return path, err
+		}
+	}
+	return nil, nil
+}
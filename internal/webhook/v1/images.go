@@ -0,0 +1,79 @@
+package v1
+
+import "strings"
+
+// defaultRegistry 没有写仓库地址的镜像默认来自 docker hub
+const defaultRegistry = "docker.io"
+
+// normalizeImage 补全镜像的仓库地址，nginx -> docker.io/library/nginx
+func normalizeImage(image string) string {
+	registry, remainder := splitImageRegistry(image)
+	if registry == "" {
+		if !strings.Contains(remainder, "/") {
+			remainder = "library/" + remainder
+		}
+		registry = defaultRegistry
+	}
+	return registry + "/" + remainder
+}
+
+// imageRegistry 返回镜像所在的仓库地址
+func imageRegistry(image string) string {
+	registry, _ := splitImageRegistry(image)
+	if registry == "" {
+		return defaultRegistry
+	}
+	return registry
+}
+
+// splitImageRegistry 按照 docker 的规则拆分仓库地址：第一段包含 . 或 : 或者是 localhost 才是仓库地址
+func splitImageRegistry(image string) (string, string) {
+	i := strings.Index(image, "/")
+	if i < 0 {
+		return "", image
+	}
+	first := image[:i]
+	if strings.ContainsAny(first, ".:") || first == "localhost" {
+		return first, image[i+1:]
+	}
+	return "", image
+}
+
+// imageMatchesRegistry 判断镜像是否来自给定的仓库，allowed 可以是仓库地址，也可以是带路径的前缀
+func imageMatchesRegistry(image, allowed string) bool {
+	allowed = strings.TrimSuffix(allowed, "/")
+	if allowed == "" {
+		return false
+	}
+	normalized := normalizeImage(image)
+	if !strings.Contains(allowed, "/") {
+		return imageRegistry(image) == allowed
+	}
+	return strings.HasPrefix(normalized, allowed+"/")
+}
+
+// imageHasDigest 镜像已经通过 @sha256:... 固定了版本
+func imageHasDigest(image string) bool {
+	return strings.Contains(image, "@")
+}
+
+// mirrorImage 按照最长前缀把镜像改写到镜像仓库，mirrors 的 key 可以是仓库地址或者带路径的前缀
+// 例如 docker.io=mirror.corp/dockerhub 会把 nginx:1.27 改写为 mirror.corp/dockerhub/library/nginx:1.27
+func mirrorImage(image string, mirrors map[string]string) string {
+	var from, to string
+	for k, v := range mirrors {
+		k = strings.TrimSuffix(k, "/")
+		if k == "" || !imageMatchesRegistry(image, k) || len(k) <= len(from) {
+			continue
+		}
+		from, to = k, strings.TrimSuffix(v, "/")
+	}
+	if from == "" || to == "" {
+		return image
+	}
+	normalized := normalizeImage(image)
+	if !strings.Contains(from, "/") {
+		from = imageRegistry(image)
+	}
+	return to + strings.TrimPrefix(normalized, from)
+}
@@ -0,0 +1,266 @@
+package v1
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	appsv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+)
+
+// 和 Pod Security Admission 使用相同的 namespace 标签，enforce 拒绝请求，warn 只返回 warning
+const (
+	LabelPodSecurityEnforce = "pod-security.kubernetes.io/enforce"
+	LabelPodSecurityWarn    = "pod-security.kubernetes.io/warn"
+)
+
+// Pod Security Standards 的级别
+const (
+	PodSecurityPrivileged = "privileged"
+	PodSecurityBaseline   = "baseline"
+	PodSecurityRestricted = "restricted"
+)
+
+var (
+	// podSecurityRank 级别从宽松到严格
+	podSecurityRank = map[string]int{PodSecurityPrivileged: 0, PodSecurityBaseline: 1, PodSecurityRestricted: 2}
+	// baselineCapabilities baseline 级别允许添加的 capabilities
+	baselineCapabilities = sets.New[corev1.Capability](
+		"AUDIT_WRITE", "CHOWN", "DAC_OVERRIDE", "FOWNER", "FSETID", "KILL", "MKNOD",
+		"NET_BIND_SERVICE", "SETFCAP", "SETGID", "SETPCAP", "SETUID", "SYS_CHROOT")
+	// baselineSELinuxTypes baseline 级别允许的 seLinuxOptions.type
+	baselineSELinuxTypes = sets.New("", "container_t", "container_init_t", "container_kvm_t")
+	// safeSysctls baseline 级别允许的 sysctls
+	safeSysctls = sets.New(
+		"kernel.shm_rmid_forced", "net.ipv4.ip_local_port_range", "net.ipv4.ip_unprivileged_port_start",
+		"net.ipv4.tcp_syncookies", "net.ipv4.ping_group_range", "net.ipv4.ip_local_reserved_ports",
+		"net.ipv4.tcp_keepalive_time", "net.ipv4.tcp_fin_timeout", "net.ipv4.tcp_keepalive_intvl",
+		"net.ipv4.tcp_keepalive_probes")
+)
+
+// podSecurityLevel 读取 namespace 上的级别，没有设置时为 privileged，无法识别的值和 Pod Security Admission 一样按 restricted 处理
+func podSecurityLevel(ns *corev1.Namespace, label string) string {
+	if ns == nil {
+		return PodSecurityPrivileged
+	}
+	level, ok := ns.Labels[label]
+	if !ok {
+		return PodSecurityPrivileged
+	}
+	switch level {
+	case PodSecurityPrivileged, PodSecurityBaseline, PodSecurityRestricted:
+		return level
+	default:
+		return PodSecurityRestricted
+	}
+}
+
+// validatePodSecurity 按 namespace 配置的级别检查所有工作负载的 pod 模板
+func validatePodSecurity(application *appsv1.Application, ns *corev1.Namespace) (field.ErrorList, admission.Warnings) {
+	var allErrs field.ErrorList
+	var warnings admission.Warnings
+	enforce := podSecurityLevel(ns, LabelPodSecurityEnforce)
+	warn := podSecurityLevel(ns, LabelPodSecurityWarn)
+	forEachWorkload(application, func(fldPath *field.Path, workload *appsv1.DeploymentTemplate, _ *appsv1.ServiceTemplate) {
+		specPath := fldPath.Child("deployment", "template", "spec")
+		allErrs = append(allErrs, checkPodSecurity(specPath, &workload.Template.Spec, enforce)...)
+		// warn 不比 enforce 严格时，违规的请求已经被拒绝，不需要再提示
+		if podSecurityRank[warn] <= podSecurityRank[enforce] {
+			return
+		}
+		for _, err := range checkPodSecurity(specPath, &workload.Template.Spec, warn) {
+			warnings = append(warnings, err.Error())
+		}
+	})
+	return allErrs, warnings
+}
+
+// checkPodSecurity 检查 pod 模板是否满足给定级别的 Pod Security Standards，每个违规的字段单独返回一个错误
+func checkPodSecurity(fldPath *field.Path, podSpec *corev1.PodSpec, level string) field.ErrorList {
+	if level == PodSecurityPrivileged {
+		return nil
+	}
+	restricted := level == PodSecurityRestricted
+	var allErrs field.ErrorList
+	forbid := func(path *field.Path, detail string) {
+		allErrs = append(allErrs, field.Forbidden(path, fmt.Sprintf("violates PodSecurity %q: %s", level+":latest", detail)))
+	}
+
+	if podSpec.HostNetwork {
+		forbid(fldPath.Child("hostNetwork"), "host namespaces are not allowed")
+	}
+	if podSpec.HostPID {
+		forbid(fldPath.Child("hostPID"), "host namespaces are not allowed")
+	}
+	if podSpec.HostIPC {
+		forbid(fldPath.Child("hostIPC"), "host namespaces are not allowed")
+	}
+
+	for i := range podSpec.Volumes {
+		volume := &podSpec.Volumes[i]
+		idxPath := fldPath.Child("volumes").Index(i)
+		if volume.HostPath != nil {
+			forbid(idxPath.Child("hostPath"), "hostPath volumes are not allowed")
+			continue
+		}
+		if restricted && !restrictedVolume(&volume.VolumeSource) {
+			forbid(idxPath, fmt.Sprintf("volume %q uses a restricted volume type", volume.Name))
+		}
+	}
+
+	// pod 级别的 securityContext 会被容器继承，restricted 的检查需要同时考虑两者
+	podSC := podSpec.SecurityContext
+	if podSC == nil {
+		podSC = &corev1.PodSecurityContext{}
+	}
+	podSCPath := fldPath.Child("securityContext")
+	allErrs = append(allErrs, checkSELinux(podSCPath.Child("seLinuxOptions"), podSC.SELinuxOptions, level)...)
+	if podSC.SeccompProfile != nil && podSC.SeccompProfile.Type == corev1.SeccompProfileTypeUnconfined {
+		forbid(podSCPath.Child("seccompProfile", "type"), "seccomp profile must not be Unconfined")
+	}
+	if podSC.AppArmorProfile != nil && podSC.AppArmorProfile.Type == corev1.AppArmorProfileTypeUnconfined {
+		forbid(podSCPath.Child("appArmorProfile", "type"), "AppArmor profile must not be Unconfined")
+	}
+	if podSC.WindowsOptions != nil && podSC.WindowsOptions.HostProcess != nil && *podSC.WindowsOptions.HostProcess {
+		forbid(podSCPath.Child("windowsOptions", "hostProcess"), "host process containers are not allowed")
+	}
+	for i, sysctl := range podSC.Sysctls {
+		if !safeSysctls.Has(sysctl.Name) {
+			forbid(podSCPath.Child("sysctls").Index(i).Child("name"), fmt.Sprintf("sysctl %q is not allowed", sysctl.Name))
+		}
+	}
+	if restricted && podSC.RunAsUser != nil && *podSC.RunAsUser == 0 {
+		forbid(podSCPath.Child("runAsUser"), "must not run as root (uid 0)")
+	}
+
+	check := func(containersPath *field.Path, containers []corev1.Container) {
+		for i := range containers {
+			allErrs = append(allErrs, checkContainerSecurity(containersPath.Index(i), &containers[i], podSC, level)...)
+		}
+	}
+	check(fldPath.Child("initContainers"), podSpec.InitContainers)
+	check(fldPath.Child("containers"), podSpec.Containers)
+	return allErrs
+}
+
+func checkContainerSecurity(fldPath *field.Path, c *corev1.Container, podSC *corev1.PodSecurityContext, level string) field.ErrorList {
+	restricted := level == PodSecurityRestricted
+	var allErrs field.ErrorList
+	forbid := func(path *field.Path, detail string) {
+		allErrs = append(allErrs, field.Forbidden(path, fmt.Sprintf("violates PodSecurity %q: container %q %s", level+":latest", c.Name, detail)))
+	}
+
+	for i, port := range c.Ports {
+		if port.HostPort != 0 {
+			forbid(fldPath.Child("ports").Index(i).Child("hostPort"), "must not use host ports")
+		}
+	}
+
+	sc := c.SecurityContext
+	if sc == nil {
+		sc = &corev1.SecurityContext{}
+	}
+	scPath := fldPath.Child("securityContext")
+	if sc.Privileged != nil && *sc.Privileged {
+		forbid(scPath.Child("privileged"), "must not be privileged")
+	}
+	if sc.ProcMount != nil && *sc.ProcMount != corev1.DefaultProcMount {
+		forbid(scPath.Child("procMount"), "must use the default proc mount")
+	}
+	if sc.WindowsOptions != nil && sc.WindowsOptions.HostProcess != nil && *sc.WindowsOptions.HostProcess {
+		forbid(scPath.Child("windowsOptions", "hostProcess"), "must not be a host process container")
+	}
+	allErrs = append(allErrs, checkSELinux(scPath.Child("seLinuxOptions"), sc.SELinuxOptions, level)...)
+	if sc.AppArmorProfile != nil && sc.AppArmorProfile.Type == corev1.AppArmorProfileTypeUnconfined {
+		forbid(scPath.Child("appArmorProfile", "type"), "must not use an Unconfined AppArmor profile")
+	}
+
+	seccompType := corev1.SeccompProfileType("")
+	if podSC.SeccompProfile != nil {
+		seccompType = podSC.SeccompProfile.Type
+	}
+	if sc.SeccompProfile != nil {
+		seccompType = sc.SeccompProfile.Type
+		if seccompType == corev1.SeccompProfileTypeUnconfined {
+			forbid(scPath.Child("seccompProfile", "type"), "must not use an Unconfined seccomp profile")
+		}
+	}
+
+	var added []corev1.Capability
+	var dropped []corev1.Capability
+	if sc.Capabilities != nil {
+		added, dropped = sc.Capabilities.Add, sc.Capabilities.Drop
+	}
+	for i, capability := range added {
+		allowed := baselineCapabilities.Has(capability)
+		if restricted {
+			allowed = capability == "NET_BIND_SERVICE"
+		}
+		if !allowed {
+			forbid(scPath.Child("capabilities", "add").Index(i), fmt.Sprintf("must not add capability %q", capability))
+		}
+	}
+
+	if !restricted {
+		return allErrs
+	}
+	if sc.AllowPrivilegeEscalation == nil || *sc.AllowPrivilegeEscalation {
+		forbid(scPath.Child("allowPrivilegeEscalation"), "must set allowPrivilegeEscalation=false")
+	}
+	if !dropsAll(dropped) {
+		forbid(scPath.Child("capabilities", "drop"), `must drop "ALL" capabilities`)
+	}
+	runAsNonRoot := podSC.RunAsNonRoot
+	if sc.RunAsNonRoot != nil {
+		runAsNonRoot = sc.RunAsNonRoot
+	}
+	if runAsNonRoot == nil || !*runAsNonRoot {
+		forbid(scPath.Child("runAsNonRoot"), "must set runAsNonRoot=true on the container or the pod")
+	}
+	if sc.RunAsUser != nil && *sc.RunAsUser == 0 {
+		forbid(scPath.Child("runAsUser"), "must not run as root (uid 0)")
+	}
+	if seccompType != corev1.SeccompProfileTypeRuntimeDefault && seccompType != corev1.SeccompProfileTypeLocalhost {
+		forbid(scPath.Child("seccompProfile", "type"), "must set seccompProfile.type to RuntimeDefault or Localhost on the container or the pod")
+	}
+	return allErrs
+}
+
+func checkSELinux(fldPath *field.Path, options *corev1.SELinuxOptions, level string) field.ErrorList {
+	if options == nil {
+		return nil
+	}
+	var allErrs field.ErrorList
+	detail := func(msg string) string {
+		return fmt.Sprintf("violates PodSecurity %q: %s", level+":latest", msg)
+	}
+	if !baselineSELinuxTypes.Has(options.Type) {
+		allErrs = append(allErrs, field.Forbidden(fldPath.Child("type"), detail(fmt.Sprintf("SELinux type %q is not allowed", options.Type))))
+	}
+	if options.User != "" {
+		allErrs = append(allErrs, field.Forbidden(fldPath.Child("user"), detail("SELinux user must not be set")))
+	}
+	if options.Role != "" {
+		allErrs = append(allErrs, field.Forbidden(fldPath.Child("role"), detail("SELinux role must not be set")))
+	}
+	return allErrs
+}
+
+func dropsAll(capabilities []corev1.Capability) bool {
+	for _, capability := range capabilities {
+		if strings.EqualFold(string(capability), "ALL") {
+			return true
+		}
+	}
+	return false
+}
+
+// restrictedVolume restricted 级别只允许这些卷类型
+func restrictedVolume(source *corev1.VolumeSource) bool {
+	return source.ConfigMap != nil || source.CSI != nil || source.DownwardAPI != nil || source.EmptyDir != nil ||
+		source.Ephemeral != nil || source.PersistentVolumeClaim != nil || source.Projected != nil || source.Secret != nil
+}
@@ -0,0 +1,242 @@
+package v1
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	appsv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+)
+
+// +kubebuilder:rbac:groups=apps.aloys.cn,resources=applicationpolicies,verbs=get;list;watch
+// +kubebuilder:rbac:groups=apps.aloys.cn,resources=clusterapplicationpolicies,verbs=get;list;watch
+
+// policySource 对 Application 生效的一条策略
+type policySource struct {
+	// Cluster 为 true 表示来自 ClusterApplicationPolicy
+	Cluster bool
+	Name    string
+	Spec    *appsv1.ApplicationPolicySpec
+}
+
+func (p policySource) String() string {
+	if p.Cluster {
+		return "ClusterApplicationPolicy " + p.Name
+	}
+	return "ApplicationPolicy " + p.Name
+}
+
+// listPolicies 返回对 namespace 生效的策略，ClusterApplicationPolicy 在前，ApplicationPolicy 在后，同类按名称排序
+// 设置默认值时后面的策略覆盖前面的策略
+func listPolicies(ctx context.Context, reader client.Reader, ns *corev1.Namespace) ([]policySource, error) {
+	if reader == nil || ns == nil {
+		return nil, nil
+	}
+	var sources []policySource
+
+	clusterPolicies := &appsv1.ClusterApplicationPolicyList{}
+	if err := reader.List(ctx, clusterPolicies); err != nil {
+		return nil, err
+	}
+	sort.Slice(clusterPolicies.Items, func(i, j int) bool {
+		return clusterPolicies.Items[i].Name < clusterPolicies.Items[j].Name
+	})
+	for i := range clusterPolicies.Items {
+		policy := &clusterPolicies.Items[i]
+		// 没有设置 selector 时作用于所有 namespace
+		if policy.Spec.NamespaceSelector != nil {
+			selector, err := metav1.LabelSelectorAsSelector(policy.Spec.NamespaceSelector)
+			if err != nil {
+				return nil, fmt.Errorf("invalid namespaceSelector in ClusterApplicationPolicy %s: %w", policy.Name, err)
+			}
+			if !selector.Matches(labels.Set(ns.Labels)) {
+				continue
+			}
+		}
+		sources = append(sources, policySource{Cluster: true, Name: policy.Name, Spec: &policy.Spec.ApplicationPolicySpec})
+	}
+
+	policies := &appsv1.ApplicationPolicyList{}
+	if err := reader.List(ctx, policies, client.InNamespace(ns.Name)); err != nil {
+		return nil, err
+	}
+	sort.Slice(policies.Items, func(i, j int) bool {
+		return policies.Items[i].Name < policies.Items[j].Name
+	})
+	for i := range policies.Items {
+		policy := &policies.Items[i]
+		sources = append(sources, policySource{Name: policy.Namespace + "/" + policy.Name, Spec: &policy.Spec})
+	}
+	return sources, nil
+}
+
+// applyPolicyDefaults 填充策略中的标签和 Service 类型默认值，副本数的默认值由 resolveReplicaPolicy 处理
+func applyPolicyDefaults(application *appsv1.Application, sources []policySource) {
+	for _, source := range sources {
+		defaults := source.Spec.Defaults
+		if defaults == nil {
+			continue
+		}
+		for k, v := range defaults.Labels {
+			if _, ok := application.Labels[k]; ok {
+				continue
+			}
+			if application.Labels == nil {
+				application.Labels = map[string]string{}
+			}
+			application.Labels[k] = v
+		}
+	}
+
+	// Service 类型同样是后面的策略优先，只填充用户没有写的值
+	var serviceType corev1.ServiceType
+	for _, source := range sources {
+		if source.Spec.Defaults != nil && source.Spec.Defaults.ServiceType != "" {
+			serviceType = source.Spec.Defaults.ServiceType
+		}
+	}
+	if serviceType == "" {
+		return
+	}
+	if hasDefaultWorkload(application) && application.Spec.Service.Type == "" {
+		application.Spec.Service.Type = serviceType
+	}
+	for i := range application.Spec.Components {
+		if service := application.Spec.Components[i].Service; service != nil && service.Type == "" {
+			service.Type = serviceType
+		}
+	}
+}
+
+// validatePolicySources 逐条校验策略，错误信息中带上策略的名称方便定位
+func validatePolicySources(application *appsv1.Application, sources []policySource) (field.ErrorList, admission.Warnings) {
+	var allErrs field.ErrorList
+	var warnings admission.Warnings
+	for _, source := range sources {
+		spec := source.Spec
+
+		for _, key := range spec.RequiredLabels {
+			if _, ok := application.Labels[key]; !ok {
+				allErrs = append(allErrs, field.Required(field.NewPath("metadata", "labels").Key(key),
+					fmt.Sprintf("label is required by %s", source)))
+			}
+		}
+
+		if spec.MaxReplicas != nil {
+			errs, warns := validateReplicas(application, ReplicaPolicy{
+				MaxReplicas: *spec.MaxReplicas,
+				Enforcement: spec.ReplicasEnforcement,
+				Source:      source.String(),
+			})
+			allErrs = append(allErrs, errs...)
+			warnings = append(warnings, warns...)
+		}
+
+		forEachWorkload(application, func(fldPath *field.Path, workload *appsv1.DeploymentTemplate, service *appsv1.ServiceTemplate) {
+			allErrs = append(allErrs, validateWorkloadPolicy(fldPath.Child("deployment"), workload, spec, source)...)
+			if service != nil && len(spec.AllowedServiceTypes) > 0 {
+				serviceType := service.Type
+				if serviceType == "" {
+					serviceType = corev1.ServiceTypeClusterIP
+				}
+				if !containsServiceType(spec.AllowedServiceTypes, serviceType) {
+					allErrs = append(allErrs, field.Forbidden(fldPath.Child("service", "type"),
+						fmt.Sprintf("service type %s is not allowed by %s, allowed types: %s", serviceType, source, joinServiceTypes(spec.AllowedServiceTypes))))
+				}
+			}
+		})
+	}
+	return allErrs, warnings
+}
+
+// validateWorkloadPolicy 校验镜像仓库和资源限制
+func validateWorkloadPolicy(fldPath *field.Path, workload *appsv1.DeploymentTemplate, spec *appsv1.ApplicationPolicySpec, source policySource) field.ErrorList {
+	var allErrs field.ErrorList
+	podSpec := &workload.Template.Spec
+	check := func(containersPath *field.Path, containers []corev1.Container, limitsRequired bool) {
+		for i := range containers {
+			c := &containers[i]
+			idxPath := containersPath.Index(i)
+			if len(spec.AllowedRegistries) > 0 && c.Image != "" && !imageAllowed(c.Image, spec.AllowedRegistries) {
+				allErrs = append(allErrs, field.Forbidden(idxPath.Child("image"),
+					fmt.Sprintf("registry %q is not allowed by %s, allowed registries: %s", imageRegistry(c.Image), source, strings.Join(spec.AllowedRegistries, ", "))))
+			}
+			if !limitsRequired || !spec.RequireResourceLimits {
+				continue
+			}
+			for _, name := range []corev1.ResourceName{corev1.ResourceCPU, corev1.ResourceMemory} {
+				if _, ok := c.Resources.Limits[name]; !ok {
+					allErrs = append(allErrs, field.Required(idxPath.Child("resources", "limits").Key(string(name)),
+						fmt.Sprintf("resource limit is required by %s", source)))
+				}
+			}
+		}
+	}
+	check(fldPath.Child("template", "spec", "initContainers"), podSpec.InitContainers, false)
+	check(fldPath.Child("template", "spec", "containers"), podSpec.Containers, true)
+	return allErrs
+}
+
+// validateAllowedRegistries 校验启动参数中配置的全局镜像仓库白名单，对所有 namespace 生效
+func validateAllowedRegistries(application *appsv1.Application, allowed []string) field.ErrorList {
+	var allErrs field.ErrorList
+	forEachWorkload(application, func(fldPath *field.Path, workload *appsv1.DeploymentTemplate, _ *appsv1.ServiceTemplate) {
+		podSpec := &workload.Template.Spec
+		check := func(containersPath *field.Path, containers []corev1.Container) {
+			for i := range containers {
+				if image := containers[i].Image; image != "" && !imageAllowed(image, allowed) {
+					allErrs = append(allErrs, field.Forbidden(containersPath.Index(i).Child("image"),
+						fmt.Sprintf("registry %q is not allowed, allowed registries: %s", imageRegistry(image), strings.Join(allowed, ", "))))
+				}
+			}
+		}
+		check(fldPath.Child("deployment", "template", "spec", "initContainers"), podSpec.InitContainers)
+		check(fldPath.Child("deployment", "template", "spec", "containers"), podSpec.Containers)
+	})
+	return allErrs
+}
+
+// forEachWorkload 遍历默认工作负载和所有组件，fldPath 指向 spec 或者 spec.components[i]，组件没有 Service 时 service 为 nil
+func forEachWorkload(application *appsv1.Application, fn func(fldPath *field.Path, workload *appsv1.DeploymentTemplate, service *appsv1.ServiceTemplate)) {
+	if hasDefaultWorkload(application) {
+		fn(field.NewPath("spec"), &application.Spec.Deployment, &application.Spec.Service)
+	}
+	for i := range application.Spec.Components {
+		component := &application.Spec.Components[i]
+		fn(field.NewPath("spec", "components").Index(i), &component.Deployment, component.Service)
+	}
+}
+
+func imageAllowed(image string, allowed []string) bool {
+	for _, registry := range allowed {
+		if imageMatchesRegistry(image, registry) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsServiceType(types []corev1.ServiceType, serviceType corev1.ServiceType) bool {
+	for _, t := range types {
+		if t == serviceType {
+			return true
+		}
+	}
+	return false
+}
+
+func joinServiceTypes(types []corev1.ServiceType) string {
+	names := make([]string, 0, len(types))
+	for _, t := range types {
+		names = append(names, string(t))
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,169 @@
+package v1
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	appsv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+)
+
+// 在 namespace 上通过注解配置副本数策略
+const (
+	// AnnotationDefaultReplicas 未指定副本数时使用的默认值
+	AnnotationDefaultReplicas = "apps.aloys.cn/default-replicas"
+	// AnnotationMaxReplicas 允许的最大副本数
+	AnnotationMaxReplicas = "apps.aloys.cn/max-replicas"
+	// AnnotationReplicasEnforcement 超过最大副本数时的处理方式，Deny 或 Warn
+	AnnotationReplicasEnforcement = "apps.aloys.cn/replicas-enforcement"
+)
+
+// ReplicaPolicy 副本数的默认值和上限，MaxReplicas 为 0 表示不限制
+type ReplicaPolicy struct {
+	DefaultReplicas int32
+	MaxReplicas     int32
+	Enforcement     appsv1.ReplicasEnforcement
+	// Source 策略的来源，用于错误信息
+	Source string
+}
+
+// getNamespace 读取 Application 所在的 namespace，reader 为空或 namespace 不存在时返回 nil
+func getNamespace(ctx context.Context, reader client.Reader, name string) (*corev1.Namespace, error) {
+	if reader == nil || name == "" {
+		return nil, nil
+	}
+	ns := &corev1.Namespace{}
+	if err := reader.Get(ctx, client.ObjectKey{Name: name}, ns); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	return ns, nil
+}
+
+// resolveReplicaPolicy 以全局配置为基础，依次使用 ClusterApplicationPolicy、namespace 注解和 ApplicationPolicy 的默认值覆盖
+// 返回的 MaxReplicas 只包含全局配置和 namespace 注解，策略资源上的上限由 validatePolicySources 分别校验
+func resolveReplicaPolicy(ns *corev1.Namespace, defaults ReplicaPolicy, sources []policySource) (ReplicaPolicy, error) {
+	policy := defaults
+	if policy.Enforcement == "" {
+		policy.Enforcement = appsv1.ReplicasEnforcementDeny
+	}
+	if ns == nil {
+		return policy, nil
+	}
+	namespace := ns.Name
+	policy.Source = "namespace " + namespace
+
+	for _, source := range sources {
+		if source.Cluster && source.Spec.Defaults != nil && source.Spec.Defaults.Replicas != nil {
+			policy.DefaultReplicas = *source.Spec.Defaults.Replicas
+		}
+	}
+
+	annotations := ns.GetAnnotations()
+	if value, ok := annotations[AnnotationDefaultReplicas]; ok {
+		replicas, err := parseReplicas(value)
+		if err != nil {
+			return policy, fmt.Errorf("invalid annotation %s on namespace %s: %w", AnnotationDefaultReplicas, namespace, err)
+		}
+		policy.DefaultReplicas = replicas
+	}
+	if value, ok := annotations[AnnotationMaxReplicas]; ok {
+		replicas, err := parseReplicas(value)
+		if err != nil {
+			return policy, fmt.Errorf("invalid annotation %s on namespace %s: %w", AnnotationMaxReplicas, namespace, err)
+		}
+		policy.MaxReplicas = replicas
+	}
+	if value, ok := annotations[AnnotationReplicasEnforcement]; ok {
+		switch enforcement := appsv1.ReplicasEnforcement(value); enforcement {
+		case appsv1.ReplicasEnforcementDeny, appsv1.ReplicasEnforcementWarn:
+			policy.Enforcement = enforcement
+		default:
+			return policy, fmt.Errorf("invalid annotation %s on namespace %s: must be %s or %s",
+				AnnotationReplicasEnforcement, namespace, appsv1.ReplicasEnforcementDeny, appsv1.ReplicasEnforcementWarn)
+		}
+	}
+	for _, source := range sources {
+		if !source.Cluster && source.Spec.Defaults != nil && source.Spec.Defaults.Replicas != nil {
+			policy.DefaultReplicas = *source.Spec.Defaults.Replicas
+		}
+	}
+
+	// 默认值本身不能超过任何一个上限，否则默认出来的对象就会被校验拒绝
+	capDefault := func(max int32) {
+		if max > 0 && policy.DefaultReplicas > max {
+			policy.DefaultReplicas = max
+		}
+	}
+	capDefault(policy.MaxReplicas)
+	for _, source := range sources {
+		if source.Spec.MaxReplicas != nil {
+			capDefault(*source.Spec.MaxReplicas)
+		}
+	}
+	return policy, nil
+}
+
+func parseReplicas(value string) (int32, error) {
+	replicas, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	if replicas < 0 {
+		return 0, fmt.Errorf("must be non-negative, got %d", replicas)
+	}
+	return int32(replicas), nil
+}
+
+// defaultReplicas 为没有指定副本数的工作负载设置默认值
+func defaultReplicas(application *appsv1.Application, policy ReplicaPolicy) {
+	if hasDefaultWorkload(application) && application.Spec.Deployment.Replicas == nil {
+		replicas := policy.DefaultReplicas
+		application.Spec.Deployment.Replicas = &replicas
+		applicationlog.V(1).Info("Setting default replicas for application.", "ApplicationName", application.Name, "DefaultReplicas", replicas)
+	}
+	for i := range application.Spec.Components {
+		if application.Spec.Components[i].Deployment.Replicas == nil {
+			replicas := policy.DefaultReplicas
+			application.Spec.Components[i].Deployment.Replicas = &replicas
+			applicationlog.V(1).Info("Setting default replicas for application.", "ApplicationName", application.Name,
+				"Component", application.Spec.Components[i].Name, "DefaultReplicas", replicas)
+		}
+	}
+}
+
+// validateReplicas 检查副本数是否超过上限，根据策略返回错误或者 warning
+func validateReplicas(application *appsv1.Application, policy ReplicaPolicy) (field.ErrorList, admission.Warnings) {
+	if policy.MaxReplicas <= 0 {
+		return nil, nil
+	}
+	var allErrs field.ErrorList
+	var warnings admission.Warnings
+	check := func(fldPath *field.Path, replicas *int32) {
+		if replicas == nil || *replicas <= policy.MaxReplicas {
+			return
+		}
+		source := policy.Source
+		if source == "" {
+			source = "namespace " + application.Namespace
+		}
+		msg := fmt.Sprintf("exceeds the maximum of %d replicas allowed by %s", policy.MaxReplicas, source)
+		if policy.Enforcement == appsv1.ReplicasEnforcementWarn {
+			warnings = append(warnings, fmt.Sprintf("%s: %d %s", fldPath, *replicas, msg))
+			return
+		}
+		allErrs = append(allErrs, field.Invalid(fldPath, *replicas, msg))
+	}
+
+	if hasDefaultWorkload(application) {
+		check(field.NewPath("spec", "deployment", "replicas"), application.Spec.Deployment.Replicas)
+	}
+	for i := range application.Spec.Components {
+		check(field.NewPath("spec", "components").Index(i).Child("deployment", "replicas"), application.Spec.Components[i].Deployment.Replicas)
+	}
+	return allErrs, warnings
+}
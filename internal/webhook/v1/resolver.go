@@ -0,0 +1,96 @@
+package v1
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/yaml"
+
+	appsv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+)
+
+// ImageResolver resolves an image tag to its digest, e.g. sha256:...
+// An empty digest without error means the image is unknown and is left as is.
+type ImageResolver interface {
+	Resolve(ctx context.Context, image string) (string, error)
+}
+
+// FileImageResolver 从文件中读取 镜像 -> digest 的映射，不访问镜像仓库，适合离线环境和测试
+type FileImageResolver struct {
+	digests map[string]string
+}
+
+var _ ImageResolver = &FileImageResolver{}
+
+// NewFileImageResolver 读取 YAML/JSON 文件，内容为 镜像: digest 的映射，例如
+//
+//	nginx:1.27: sha256:...
+func NewFileImageResolver(path string) (*FileImageResolver, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	digests := map[string]string{}
+	if err := yaml.Unmarshal(data, &digests); err != nil {
+		return nil, fmt.Errorf("invalid image digest file %s: %w", path, err)
+	}
+	return NewStaticImageResolver(digests)
+}
+
+// NewStaticImageResolver 使用给定的映射创建 resolver，镜像名会被补全仓库地址，nginx:1.27 和 docker.io/library/nginx:1.27 等价
+func NewStaticImageResolver(digests map[string]string) (*FileImageResolver, error) {
+	r := &FileImageResolver{digests: make(map[string]string, len(digests))}
+	for image, digest := range digests {
+		if !strings.HasPrefix(digest, "sha256:") {
+			return nil, fmt.Errorf("invalid digest %q for image %s, expected sha256:<hex>", digest, image)
+		}
+		r.digests[normalizeImage(image)] = digest
+	}
+	return r, nil
+}
+
+// Resolve implements ImageResolver.
+func (r *FileImageResolver) Resolve(_ context.Context, image string) (string, error) {
+	return r.digests[normalizeImage(image)], nil
+}
+
+// rewriteImages 先把镜像改写到镜像仓库，再把 tag 固定为 digest，已经带 digest 的镜像不会再解析
+func rewriteImages(ctx context.Context, application *appsv1.Application, mirrors map[string]string, resolver ImageResolver) error {
+	if len(mirrors) == 0 && resolver == nil {
+		return nil
+	}
+	var err error
+	rewrite := func(image string) string {
+		if image == "" || err != nil {
+			return image
+		}
+		image = mirrorImage(image, mirrors)
+		if resolver == nil || imageHasDigest(image) {
+			return image
+		}
+		var digest string
+		if digest, err = resolver.Resolve(ctx, image); err != nil {
+			err = fmt.Errorf("failed to resolve digest of image %s: %w", image, err)
+			return image
+		}
+		if digest == "" {
+			return image
+		}
+		// 保留 tag 方便阅读，实际拉取时以 digest 为准
+		return image + "@" + digest
+	}
+
+	forEachWorkload(application, func(_ *field.Path, workload *appsv1.DeploymentTemplate, _ *appsv1.ServiceTemplate) {
+		podSpec := &workload.Template.Spec
+		for i := range podSpec.InitContainers {
+			podSpec.InitContainers[i].Image = rewrite(podSpec.InitContainers[i].Image)
+		}
+		for i := range podSpec.Containers {
+			podSpec.Containers[i].Image = rewrite(podSpec.Containers[i].Image)
+		}
+	})
+	return err
+}
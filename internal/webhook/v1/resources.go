@@ -0,0 +1,233 @@
+package v1
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	appsv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+)
+
+// AnnotationResourceProfile namespace 上的默认资源规格，Application 没有设置 spec.resourceProfile 时使用
+const AnnotationResourceProfile = "apps.aloys.cn/resource-profile"
+
+// builtinResourceProfiles 内置的资源规格，策略中的同名规格会覆盖它们
+var builtinResourceProfiles = map[string]appsv1.ResourceProfile{
+	"small":  newResourceProfile("small", "100m", "128Mi", "500m", "256Mi"),
+	"medium": newResourceProfile("medium", "250m", "256Mi", "1", "512Mi"),
+	"large":  newResourceProfile("large", "500m", "512Mi", "2", "1Gi"),
+}
+
+func newResourceProfile(name, cpuRequest, memoryRequest, cpuLimit, memoryLimit string) appsv1.ResourceProfile {
+	return appsv1.ResourceProfile{
+		Name: name,
+		Requests: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(cpuRequest),
+			corev1.ResourceMemory: resource.MustParse(memoryRequest),
+		},
+		Limits: corev1.ResourceList{
+			corev1.ResourceCPU:    resource.MustParse(cpuLimit),
+			corev1.ResourceMemory: resource.MustParse(memoryLimit),
+		},
+	}
+}
+
+// lookupResourceProfile 后面的策略优先，其次是内置规格
+func lookupResourceProfile(name string, sources []policySource) (*appsv1.ResourceProfile, bool) {
+	for i := len(sources) - 1; i >= 0; i-- {
+		for j := range sources[i].Spec.ResourceProfiles {
+			if profile := &sources[i].Spec.ResourceProfiles[j]; profile.Name == name {
+				return profile, true
+			}
+		}
+	}
+	if profile, ok := builtinResourceProfiles[name]; ok {
+		return &profile, true
+	}
+	return nil, false
+}
+
+// resolveResourceProfile 返回 Application 使用的资源规格，没有选择规格时返回 nil
+// spec.resourceProfile 不存在时同样返回 nil，由 validateResourceProfile 报告字段错误；namespace 注解写错时返回 error
+func resolveResourceProfile(application *appsv1.Application, ns *corev1.Namespace, sources []policySource) (*appsv1.ResourceProfile, error) {
+	if name := application.Spec.ResourceProfile; name != "" {
+		profile, _ := lookupResourceProfile(name, sources)
+		return profile, nil
+	}
+	if ns == nil {
+		return nil, nil
+	}
+	name, ok := ns.Annotations[AnnotationResourceProfile]
+	if !ok || name == "" {
+		return nil, nil
+	}
+	profile, ok := lookupResourceProfile(name, sources)
+	if !ok {
+		return nil, fmt.Errorf("invalid annotation %s on namespace %s: unknown resource profile %q", AnnotationResourceProfile, ns.Name, name)
+	}
+	return profile, nil
+}
+
+// validateResourceProfile 校验 spec.resourceProfile 引用的规格存在
+func validateResourceProfile(application *appsv1.Application, sources []policySource) field.ErrorList {
+	name := application.Spec.ResourceProfile
+	if name == "" {
+		return nil
+	}
+	if _, ok := lookupResourceProfile(name, sources); ok {
+		return nil
+	}
+	return field.ErrorList{field.NotFound(field.NewPath("spec", "resourceProfile"), name)}
+}
+
+// applyResourceProfile 只填充容器没有设置的资源，已有的 requests/limits 保持不变
+func applyResourceProfile(application *appsv1.Application, profile *appsv1.ResourceProfile) {
+	if profile == nil {
+		return
+	}
+	forEachWorkload(application, func(_ *field.Path, workload *appsv1.DeploymentTemplate, _ *appsv1.ServiceTemplate) {
+		podSpec := &workload.Template.Spec
+		for i := range podSpec.InitContainers {
+			defaultContainerResources(&podSpec.InitContainers[i].Resources, profile)
+		}
+		for i := range podSpec.Containers {
+			defaultContainerResources(&podSpec.Containers[i].Resources, profile)
+		}
+	})
+}
+
+func defaultContainerResources(resources *corev1.ResourceRequirements, profile *appsv1.ResourceProfile) {
+	for name, request := range profile.Requests {
+		if _, ok := resources.Requests[name]; ok {
+			continue
+		}
+		// 用户只设置了更小的 limit 时，request 不能超过 limit
+		if limit, ok := resources.Limits[name]; ok && limit.Cmp(request) < 0 {
+			request = limit
+		}
+		if resources.Requests == nil {
+			resources.Requests = corev1.ResourceList{}
+		}
+		resources.Requests[name] = request.DeepCopy()
+	}
+	for name, limit := range profile.Limits {
+		if _, ok := resources.Limits[name]; ok {
+			continue
+		}
+		if request, ok := resources.Requests[name]; ok && limit.Cmp(request) < 0 {
+			limit = request
+		}
+		if resources.Limits == nil {
+			resources.Limits = corev1.ResourceList{}
+		}
+		resources.Limits[name] = limit.DeepCopy()
+	}
+}
+
+// validateContainerResources limits 不能小于 requests
+func validateContainerResources(fldPath *field.Path, resources *corev1.ResourceRequirements) field.ErrorList {
+	var allErrs field.ErrorList
+	for name, request := range resources.Requests {
+		if limit, ok := resources.Limits[name]; ok && limit.Cmp(request) < 0 {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("limits").Key(string(name)), limit.String(),
+				fmt.Sprintf("must be greater than or equal to the %s request %s", name, request.String())))
+		}
+	}
+	return allErrs
+}
+
+// applicationRequests Application 所有工作负载的 requests 总和：副本数 x 单个 pod 的 requests
+func applicationRequests(application *appsv1.Application) corev1.ResourceList {
+	total := corev1.ResourceList{}
+	forEachWorkload(application, func(_ *field.Path, workload *appsv1.DeploymentTemplate, _ *appsv1.ServiceTemplate) {
+		replicas := int64(1)
+		if workload.Replicas != nil {
+			replicas = int64(*workload.Replicas)
+		}
+		for name, quantity := range podRequests(&workload.Template.Spec) {
+			addQuantity(total, name, *resource.NewMilliQuantity(quantity.MilliValue()*replicas, quantity.Format))
+		}
+	})
+	return total
+}
+
+// podRequests 和调度器的计算方式一致：容器的 requests 之和，与每个 init container 的 requests 取较大值
+func podRequests(podSpec *corev1.PodSpec) corev1.ResourceList {
+	requests := corev1.ResourceList{}
+	for i := range podSpec.Containers {
+		for name, quantity := range podSpec.Containers[i].Resources.Requests {
+			addQuantity(requests, name, quantity)
+		}
+	}
+	for i := range podSpec.InitContainers {
+		for name, quantity := range podSpec.InitContainers[i].Resources.Requests {
+			if current, ok := requests[name]; !ok || current.Cmp(quantity) < 0 {
+				requests[name] = quantity.DeepCopy()
+			}
+		}
+	}
+	return requests
+}
+
+func addQuantity(list corev1.ResourceList, name corev1.ResourceName, quantity resource.Quantity) {
+	current, ok := list[name]
+	if !ok {
+		list[name] = quantity.DeepCopy()
+		return
+	}
+	current.Add(quantity)
+	list[name] = current
+}
+
+// validateResourceBudget 校验 namespace 内所有 Application 的 requests 总和不超过策略中的预算
+func validateResourceBudget(ctx context.Context, reader client.Reader, application *appsv1.Application, sources []policySource) (field.ErrorList, error) {
+	var budgets []policySource
+	for _, source := range sources {
+		if len(source.Spec.ResourceBudget) > 0 {
+			budgets = append(budgets, source)
+		}
+	}
+	if len(budgets) == 0 {
+		return nil, nil
+	}
+
+	total := applicationRequests(application)
+	if reader != nil {
+		applications := &appsv1.ApplicationList{}
+		if err := reader.List(ctx, applications, client.InNamespace(application.Namespace)); err != nil {
+			return nil, err
+		}
+		for i := range applications.Items {
+			// 更新时以新的对象为准
+			if applications.Items[i].Name == application.Name {
+				continue
+			}
+			for name, quantity := range applicationRequests(&applications.Items[i]) {
+				addQuantity(total, name, quantity)
+			}
+		}
+	}
+
+	var allErrs field.ErrorList
+	for _, source := range budgets {
+		names := make([]corev1.ResourceName, 0, len(source.Spec.ResourceBudget))
+		for name := range source.Spec.ResourceBudget {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool { return names[i] < names[j] })
+		for _, name := range names {
+			budget := source.Spec.ResourceBudget[name]
+			if requested, ok := total[name]; ok && requested.Cmp(budget) > 0 {
+				allErrs = append(allErrs, field.Forbidden(field.NewPath("spec"),
+					fmt.Sprintf("total %s requests %s of namespace %s exceed the budget %s set by %s",
+						name, requested.String(), application.Namespace, budget.String(), source)))
+			}
+		}
+	}
+	return allErrs, nil
+}
@@ -0,0 +1,66 @@
+package v1
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	appsv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+)
+
+const (
+	// AnnotationSecurityHardening 设置为 disabled 时 defaulter 不会注入受限的 securityContext
+	AnnotationSecurityHardening = "apps.aloys.cn/security-hardening"
+	// SecurityHardeningDisabled 关闭 securityContext 默认值
+	SecurityHardeningDisabled = "disabled"
+)
+
+// applySecurityDefaults 为 pod 和容器注入 restricted 级别的 securityContext，只填充用户没有设置的字段
+func applySecurityDefaults(application *appsv1.Application) {
+	if application.Annotations[AnnotationSecurityHardening] == SecurityHardeningDisabled {
+		return
+	}
+	forEachWorkload(application, func(_ *field.Path, workload *appsv1.DeploymentTemplate, _ *appsv1.ServiceTemplate) {
+		podSpec := &workload.Template.Spec
+		if podSpec.SecurityContext == nil {
+			podSpec.SecurityContext = &corev1.PodSecurityContext{}
+		}
+		if podSpec.SecurityContext.RunAsNonRoot == nil {
+			runAsNonRoot := true
+			podSpec.SecurityContext.RunAsNonRoot = &runAsNonRoot
+		}
+		if podSpec.SecurityContext.SeccompProfile == nil {
+			podSpec.SecurityContext.SeccompProfile = &corev1.SeccompProfile{Type: corev1.SeccompProfileTypeRuntimeDefault}
+		}
+		for i := range podSpec.InitContainers {
+			hardenContainer(&podSpec.InitContainers[i])
+		}
+		for i := range podSpec.Containers {
+			hardenContainer(&podSpec.Containers[i])
+		}
+	})
+}
+
+func hardenContainer(c *corev1.Container) {
+	// 特权容器和 allowPrivilegeEscalation=false 互斥，显式声明了特权的容器保持原样
+	if isPrivileged(c) {
+		return
+	}
+	if c.SecurityContext == nil {
+		c.SecurityContext = &corev1.SecurityContext{}
+	}
+	sc := c.SecurityContext
+	if sc.AllowPrivilegeEscalation == nil {
+		allowPrivilegeEscalation := false
+		sc.AllowPrivilegeEscalation = &allowPrivilegeEscalation
+	}
+	if sc.ReadOnlyRootFilesystem == nil {
+		readOnlyRootFilesystem := true
+		sc.ReadOnlyRootFilesystem = &readOnlyRootFilesystem
+	}
+	if sc.Capabilities == nil {
+		sc.Capabilities = &corev1.Capabilities{}
+	}
+	if len(sc.Capabilities.Drop) == 0 {
+		sc.Capabilities.Drop = []corev1.Capability{"ALL"}
+	}
+}
@@ -0,0 +1,288 @@
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+
+	appsv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+)
+
+// +kubebuilder:rbac:groups=core,resources=configmaps,verbs=get;list;watch
+
+const (
+	// LabelSidecarTemplate 带有该标签（值为 true）的 ConfigMap 才会被当作 sidecar 模板，模板名称就是 ConfigMap 的名称
+	LabelSidecarTemplate = "apps.aloys.cn/sidecar-template"
+	// SidecarTemplateKey ConfigMap 中保存模板的 key
+	SidecarTemplateKey = "template.yaml"
+	// AnnotationInjectSidecars Application 上需要注入的模板名称，多个用逗号分隔
+	AnnotationInjectSidecars = "apps.aloys.cn/inject-sidecars"
+	// AnnotationInjectedSidecars defaulter 记录每个模板实际注入的容器、环境变量和卷，
+	// 格式为 {"<template>":{"containers":[...],"env":[...],"volumes":[...]}}
+	AnnotationInjectedSidecars = "apps.aloys.cn/injected-sidecars"
+)
+
+// sidecarTemplate ConfigMap 中 template.yaml 的内容
+type sidecarTemplate struct {
+	// InitContainers 注入到 pod 的 init containers
+	InitContainers []corev1.Container `json:"initContainers,omitempty"`
+	// Containers 注入到 pod 的 sidecar 容器
+	Containers []corev1.Container `json:"containers,omitempty"`
+	// Volumes sidecar 需要的卷，同名的卷不会重复添加
+	Volumes []corev1.Volume `json:"volumes,omitempty"`
+	// Env 追加到应用自身容器的环境变量，同名的变量以应用为准
+	Env []corev1.EnvVar `json:"env,omitempty"`
+}
+
+// sidecarNames 解析 Application 上的注解，保持声明的顺序并去重
+func sidecarNames(application *appsv1.Application) []string {
+	value := application.Annotations[AnnotationInjectSidecars]
+	var names []string
+	seen := sets.New[string]()
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" && !seen.Has(name) {
+			seen.Insert(name)
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// loadSidecarTemplates 从 namespace 中读取 Application 需要的模板，不存在的模板返回 error
+func loadSidecarTemplates(ctx context.Context, reader client.Reader, namespace string, names []string) ([]*sidecarTemplate, error) {
+	if reader == nil || namespace == "" {
+		return nil, fmt.Errorf("sidecar injection is not configured, cannot inject %s", strings.Join(names, ", "))
+	}
+	configMaps := &corev1.ConfigMapList{}
+	if err := reader.List(ctx, configMaps, client.InNamespace(namespace), client.MatchingLabels{LabelSidecarTemplate: "true"}); err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*corev1.ConfigMap, len(configMaps.Items))
+	for i := range configMaps.Items {
+		byName[configMaps.Items[i].Name] = &configMaps.Items[i]
+	}
+
+	templates := make([]*sidecarTemplate, 0, len(names))
+	for _, name := range names {
+		configMap, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("sidecar template %q not found in namespace %s", name, namespace)
+		}
+		template := &sidecarTemplate{}
+		if err := yaml.UnmarshalStrict([]byte(configMap.Data[SidecarTemplateKey]), template); err != nil {
+			return nil, fmt.Errorf("invalid sidecar template %s/%s: %w", namespace, name, err)
+		}
+		templates = append(templates, template)
+	}
+	return templates, nil
+}
+
+// injectSidecars 把模板合并到所有工作负载的 pod 模板，容器、卷和环境变量按名称去重，重复执行结果不变。
+// 之前注入但已经不再需要的模板，按注解中记录的名称删除它注入的容器、环境变量和卷，再重新记录注解
+func injectSidecars(application *appsv1.Application, names []string, templates []*sidecarTemplate) {
+	// 再次准入时 pod 中已经有注入的 sidecar，环境变量不能追加到它们上面
+	sidecars := sets.New[string]()
+	env := sets.New[string]()
+	volumes := sets.New[string]()
+	for _, template := range templates {
+		for _, c := range template.InitContainers {
+			sidecars.Insert(c.Name)
+		}
+		for _, c := range template.Containers {
+			sidecars.Insert(c.Name)
+		}
+		for _, e := range template.Env {
+			env.Insert(e.Name)
+		}
+		for _, v := range template.Volumes {
+			volumes.Insert(v.Name)
+		}
+	}
+	previous := injectedSidecars(application)
+	requested := sets.New(names...)
+	removed := injectedSidecar{}
+	for template, injected := range previous {
+		if !requested.Has(template) {
+			removed.Containers = append(removed.Containers, injected.Containers...)
+			removed.Env = append(removed.Env, injected.Env...)
+			removed.Volumes = append(removed.Volumes, injected.Volumes...)
+		}
+	}
+	// 仍然由其他模板注入的同名容器、环境变量和卷保留
+	removeInjected(application,
+		sets.New(removed.Containers...).Difference(sidecars),
+		sets.New(removed.Env...).Difference(env),
+		sets.New(removed.Volumes...).Difference(volumes),
+		sidecars)
+
+	records := make(map[string]injectedSidecar, len(templates))
+	for i, template := range templates {
+		// 合并之前已经存在的同名项是用户自己声明的，不记录，除非上一次就是由这个模板注入的
+		present := presentInPods(application, sidecars)
+		forEachWorkload(application, func(_ *field.Path, workload *appsv1.DeploymentTemplate, _ *appsv1.ServiceTemplate) {
+			mergeSidecarTemplate(&workload.Template.Spec, template, sidecars)
+		})
+		last := previous[names[i]]
+		record := injectedSidecar{}
+		for _, c := range append(append([]corev1.Container{}, template.InitContainers...), template.Containers...) {
+			if !present.Containers.Has(c.Name) || slices.Contains(last.Containers, c.Name) {
+				record.Containers = append(record.Containers, c.Name)
+			}
+		}
+		for _, e := range template.Env {
+			if !present.Env.Has(e.Name) || slices.Contains(last.Env, e.Name) {
+				record.Env = append(record.Env, e.Name)
+			}
+		}
+		for _, v := range template.Volumes {
+			if !present.Volumes.Has(v.Name) || slices.Contains(last.Volumes, v.Name) {
+				record.Volumes = append(record.Volumes, v.Name)
+			}
+		}
+		records[names[i]] = record
+	}
+	if len(records) == 0 {
+		delete(application.Annotations, AnnotationInjectedSidecars)
+		return
+	}
+	// map 序列化时 key 有序，重复执行得到的注解不变
+	data, _ := json.Marshal(records)
+	if application.Annotations == nil {
+		application.Annotations = map[string]string{}
+	}
+	application.Annotations[AnnotationInjectedSidecars] = string(data)
+}
+
+// injectedSidecar 一个模板实际注入的容器、环境变量和卷的名称
+type injectedSidecar struct {
+	Containers []string `json:"containers,omitempty"`
+	Env        []string `json:"env,omitempty"`
+	Volumes    []string `json:"volumes,omitempty"`
+}
+
+// injectedSidecars 解析上一次注入时记录的注解，返回模板名称到注入内容的映射，无法解析的注解当作没有注入过
+func injectedSidecars(application *appsv1.Application) map[string]injectedSidecar {
+	injected := map[string]injectedSidecar{}
+	if value := application.Annotations[AnnotationInjectedSidecars]; value != "" {
+		if err := json.Unmarshal([]byte(value), &injected); err != nil {
+			return map[string]injectedSidecar{}
+		}
+	}
+	return injected
+}
+
+// podNames 所有工作负载中已经存在的容器、应用容器的环境变量和卷的名称
+type podNames struct {
+	Containers sets.Set[string]
+	Env        sets.Set[string]
+	Volumes    sets.Set[string]
+}
+
+func presentInPods(application *appsv1.Application, sidecars sets.Set[string]) podNames {
+	present := podNames{Containers: sets.New[string](), Env: sets.New[string](), Volumes: sets.New[string]()}
+	forEachWorkload(application, func(_ *field.Path, workload *appsv1.DeploymentTemplate, _ *appsv1.ServiceTemplate) {
+		podSpec := &workload.Template.Spec
+		for _, c := range podSpec.InitContainers {
+			present.Containers.Insert(c.Name)
+		}
+		for _, c := range podSpec.Containers {
+			present.Containers.Insert(c.Name)
+			if !sidecars.Has(c.Name) {
+				for _, e := range c.Env {
+					present.Env.Insert(e.Name)
+				}
+			}
+		}
+		for _, v := range podSpec.Volumes {
+			present.Volumes.Insert(v.Name)
+		}
+	})
+	return present
+}
+
+// removeInjected 从所有工作负载中删除之前注入的容器、卷，以及应用容器上注入的环境变量
+func removeInjected(application *appsv1.Application, containers, env, volumes, sidecars sets.Set[string]) {
+	if containers.Len() == 0 && env.Len() == 0 && volumes.Len() == 0 {
+		return
+	}
+	forEachWorkload(application, func(_ *field.Path, workload *appsv1.DeploymentTemplate, _ *appsv1.ServiceTemplate) {
+		podSpec := &workload.Template.Spec
+		podSpec.InitContainers = removeContainers(podSpec.InitContainers, containers)
+		podSpec.Containers = removeContainers(podSpec.Containers, containers)
+		for i := range podSpec.Containers {
+			if !sidecars.Has(podSpec.Containers[i].Name) {
+				podSpec.Containers[i].Env = slices.DeleteFunc(podSpec.Containers[i].Env, func(e corev1.EnvVar) bool {
+					return env.Has(e.Name)
+				})
+			}
+		}
+		podSpec.Volumes = slices.DeleteFunc(podSpec.Volumes, func(v corev1.Volume) bool {
+			return volumes.Has(v.Name)
+		})
+	})
+}
+
+func removeContainers(containers []corev1.Container, names sets.Set[string]) []corev1.Container {
+	return slices.DeleteFunc(containers, func(c corev1.Container) bool {
+		return names.Has(c.Name)
+	})
+}
+
+func mergeSidecarTemplate(podSpec *corev1.PodSpec, template *sidecarTemplate, sidecars sets.Set[string]) {
+	// 环境变量只追加到应用自身的容器
+	for i := range podSpec.Containers {
+		if !sidecars.Has(podSpec.Containers[i].Name) {
+			podSpec.Containers[i].Env = mergeEnv(podSpec.Containers[i].Env, template.Env)
+		}
+	}
+	podSpec.InitContainers = mergeContainers(podSpec.InitContainers, template.InitContainers)
+	podSpec.Containers = mergeContainers(podSpec.Containers, template.Containers)
+
+	volumes := sets.New[string]()
+	for _, v := range podSpec.Volumes {
+		volumes.Insert(v.Name)
+	}
+	for _, v := range template.Volumes {
+		if !volumes.Has(v.Name) {
+			volumes.Insert(v.Name)
+			podSpec.Volumes = append(podSpec.Volumes, *v.DeepCopy())
+		}
+	}
+}
+
+// mergeContainers 已经存在的同名容器保持不变，用户可以通过同名容器覆盖模板
+func mergeContainers(containers, injected []corev1.Container) []corev1.Container {
+	names := sets.New[string]()
+	for _, c := range containers {
+		names.Insert(c.Name)
+	}
+	for i := range injected {
+		if !names.Has(injected[i].Name) {
+			names.Insert(injected[i].Name)
+			containers = append(containers, *injected[i].DeepCopy())
+		}
+	}
+	return containers
+}
+
+func mergeEnv(env, injected []corev1.EnvVar) []corev1.EnvVar {
+	names := sets.New[string]()
+	for _, e := range env {
+		names.Insert(e.Name)
+	}
+	for i := range injected {
+		if !names.Has(injected[i].Name) {
+			names.Insert(injected[i].Name)
+			env = append(env, *injected[i].DeepCopy())
+		}
+	}
+	return env
+}
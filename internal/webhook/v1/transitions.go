@@ -0,0 +1,103 @@
+package v1
+
+import (
+	"fmt"
+	"strconv"
+
+	corev1 "k8s.io/api/core/v1"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	appsv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+)
+
+// AnnotationAcknowledgeScaleDown 值等于新的副本数时允许超过比例的副本数下降，
+// 确认只对这一个目标副本数有效，之后再次缩容需要重新确认
+const AnnotationAcknowledgeScaleDown = "apps.aloys.cn/acknowledge-scale-down"
+
+// validateTransitions 比较新旧对象，检查更新时不允许或者需要确认的变更
+// maxDropPercent 为单次允许下降的副本数比例，0 表示不限制
+func validateTransitions(oldApp, newApp *appsv1.Application, maxDropPercent int32) (field.ErrorList, admission.Warnings) {
+	var allErrs field.ErrorList
+	var warnings admission.Warnings
+	specPath := field.NewPath("spec")
+
+	acknowledged := newApp.Annotations[AnnotationAcknowledgeScaleDown]
+	check := func(fldPath *field.Path, oldWorkload, newWorkload *appsv1.DeploymentTemplate, oldService, newService *appsv1.ServiceTemplate) {
+		// Deployment 本身也不允许修改 selector，在这里提前拒绝，避免控制器一直更新失败
+		if !apiequality.Semantic.DeepEqual(oldWorkload.Selector, newWorkload.Selector) {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("deployment", "selector"), newWorkload.Selector, "field is immutable"))
+		}
+		if msg := replicaDrop(oldWorkload.Replicas, newWorkload.Replicas, maxDropPercent); msg != "" {
+			if target := strconv.Itoa(int(*newWorkload.Replicas)); acknowledged != target {
+				allErrs = append(allErrs, field.Forbidden(fldPath.Child("deployment", "replicas"),
+					fmt.Sprintf("%s, annotate the Application with %s=%s to acknowledge", msg, AnnotationAcknowledgeScaleDown, target)))
+			}
+		}
+		if oldService != nil && newService != nil && oldService.Type == corev1.ServiceTypeLoadBalancer && newService.Type != corev1.ServiceTypeLoadBalancer {
+			newType := newService.Type
+			if newType == "" {
+				newType = corev1.ServiceTypeClusterIP
+			}
+			warnings = append(warnings, fmt.Sprintf("%s: changing from LoadBalancer to %s releases the external load balancer and its address",
+				fldPath.Child("service", "type"), newType))
+		}
+	}
+
+	if hasDefaultWorkload(oldApp) && hasDefaultWorkload(newApp) {
+		check(specPath, &oldApp.Spec.Deployment, &newApp.Spec.Deployment, &oldApp.Spec.Service, &newApp.Spec.Service)
+	}
+	oldComponents := make(map[string]*appsv1.ComponentSpec, len(oldApp.Spec.Components))
+	for i := range oldApp.Spec.Components {
+		oldComponents[oldApp.Spec.Components[i].Name] = &oldApp.Spec.Components[i]
+	}
+	for i := range newApp.Spec.Components {
+		newComponent := &newApp.Spec.Components[i]
+		if oldComponent, ok := oldComponents[newComponent.Name]; ok {
+			check(specPath.Child("components").Index(i), &oldComponent.Deployment, &newComponent.Deployment, oldComponent.Service, newComponent.Service)
+		}
+	}
+	warnings = append(warnings, removalWarnings(oldApp, newApp)...)
+	return allErrs, warnings
+}
+
+// removalWarnings 控制器会删除不再声明的子资源，移除组件、组件的 service 或者默认的工作负载时提醒用户
+func removalWarnings(oldApp, newApp *appsv1.Application) admission.Warnings {
+	var warnings admission.Warnings
+	specPath := field.NewPath("spec")
+	if hasDefaultWorkload(oldApp) && !hasDefaultWorkload(newApp) {
+		warnings = append(warnings, fmt.Sprintf("%s: emptied, %s-deployment and %s-service will be deleted",
+			specPath.Child("deployment", "template", "spec", "containers"), oldApp.Name, oldApp.Name))
+	}
+	newComponents := make(map[string]*appsv1.ComponentSpec, len(newApp.Spec.Components))
+	for i := range newApp.Spec.Components {
+		newComponents[newApp.Spec.Components[i].Name] = &newApp.Spec.Components[i]
+	}
+	componentsPath := specPath.Child("components")
+	for i := range oldApp.Spec.Components {
+		oldComponent := &oldApp.Spec.Components[i]
+		newComponent, ok := newComponents[oldComponent.Name]
+		if !ok {
+			warnings = append(warnings, fmt.Sprintf("%s: component %q was removed or renamed, its Deployment and Service will be deleted",
+				componentsPath, oldComponent.Name))
+			continue
+		}
+		if oldComponent.Service != nil && newComponent.Service == nil {
+			warnings = append(warnings, fmt.Sprintf("%s: removed, the Service will be deleted", componentsPath.Key(oldComponent.Name).Child("service")))
+		}
+	}
+	return warnings
+}
+
+// replicaDrop 副本数下降超过比例时返回说明，否则返回空字符串
+func replicaDrop(oldReplicas, newReplicas *int32, maxDropPercent int32) string {
+	if maxDropPercent <= 0 || oldReplicas == nil || newReplicas == nil || *oldReplicas <= 0 || *newReplicas >= *oldReplicas {
+		return ""
+	}
+	drop := int64(*oldReplicas-*newReplicas) * 100 / int64(*oldReplicas)
+	if drop <= int64(maxDropPercent) {
+		return ""
+	}
+	return fmt.Sprintf("scaling down from %d to %d replicas (%d%%) exceeds the allowed %d%%", *oldReplicas, *newReplicas, drop, maxDropPercent)
+}
@@ -0,0 +1,185 @@
+package v1
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	appsv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+)
+
+// applicationGroupKind 用于构造 Invalid/Forbidden 错误
+var applicationGroupKind = appsv1.GroupVersion.WithKind("Application").GroupKind()
+
+// reservedComponentNames 组件名不能和默认子资源的后缀重复，否则 <app>-<component> 会和 <app>-deployment/<app>-service 冲突
+var reservedComponentNames = sets.New("deployment", "service")
+
+// hasDefaultWorkload 和控制器保持一致：只声明了 components 的应用不会创建 <app>-deployment/<app>-service
+func hasDefaultWorkload(application *appsv1.Application) bool {
+	return len(application.Spec.Components) == 0 || len(application.Spec.Deployment.Template.Spec.Containers) > 0
+}
+
+// validateApplication 校验 Application 的 spec，创建和更新时都会调用
+func validateApplication(application *appsv1.Application) field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	if hasDefaultWorkload(application) {
+		allErrs = append(allErrs, validateChildName(field.NewPath("metadata", "name"), application.Name, application.Name+"-deployment")...)
+		allErrs = append(allErrs, validateChildName(field.NewPath("metadata", "name"), application.Name, application.Name+"-service")...)
+		// 默认 deployment 的 selector 是必填的，控制器直接使用它作为 pod 的标签
+		allErrs = append(allErrs, validateWorkload(specPath.Child("deployment"), &application.Spec.Deployment, true)...)
+		allErrs = append(allErrs, validateService(specPath.Child("service"), &application.Spec.Service, &application.Spec.Deployment)...)
+	}
+
+	componentsPath := specPath.Child("components")
+	for i := range application.Spec.Components {
+		component := &application.Spec.Components[i]
+		idxPath := componentsPath.Index(i)
+		if reservedComponentNames.Has(component.Name) {
+			allErrs = append(allErrs, field.Invalid(idxPath.Child("name"), component.Name,
+				fmt.Sprintf("must not be one of %s", strings.Join(sets.List(reservedComponentNames), ", "))))
+		}
+		allErrs = append(allErrs, validateChildName(idxPath.Child("name"), component.Name, application.Name+"-"+component.Name)...)
+		allErrs = append(allErrs, validateWorkload(idxPath.Child("deployment"), &component.Deployment, false)...)
+		if component.Service != nil {
+			allErrs = append(allErrs, validateService(idxPath.Child("service"), component.Service, &component.Deployment)...)
+		}
+	}
+	return allErrs
+}
+
+// validateChildName 子资源名称需要满足 DNS-1123 label（63 个字符）的限制
+func validateChildName(fldPath *field.Path, value, childName string) field.ErrorList {
+	var allErrs field.ErrorList
+	for _, msg := range validation.IsDNS1123Label(childName) {
+		allErrs = append(allErrs, field.Invalid(fldPath, value, fmt.Sprintf("generated name %q is invalid: %s", childName, msg)))
+	}
+	return allErrs
+}
+
+// validateWorkload 校验 pod 模板：至少一个容器、镜像不能为空、limits 不小于 requests、selector 和模板标签一致
+func validateWorkload(fldPath *field.Path, workload *appsv1.DeploymentTemplate, selectorRequired bool) field.ErrorList {
+	var allErrs field.ErrorList
+
+	containersPath := fldPath.Child("template", "spec", "containers")
+	containers := workload.Template.Spec.Containers
+	if len(containers) == 0 {
+		allErrs = append(allErrs, field.Required(containersPath, "at least one container is required"))
+	}
+	for i := range containers {
+		if strings.TrimSpace(containers[i].Image) == "" {
+			allErrs = append(allErrs, field.Required(containersPath.Index(i).Child("image"), "image must not be empty"))
+		}
+		allErrs = append(allErrs, validateContainerResources(containersPath.Index(i).Child("resources"), &containers[i].Resources)...)
+	}
+	initContainersPath := fldPath.Child("template", "spec", "initContainers")
+	for i := range workload.Template.Spec.InitContainers {
+		allErrs = append(allErrs, validateContainerResources(initContainersPath.Index(i).Child("resources"), &workload.Template.Spec.InitContainers[i].Resources)...)
+	}
+
+	selectorPath := fldPath.Child("selector", "matchLabels")
+	if workload.Selector == nil || len(workload.Selector.MatchLabels) == 0 {
+		if selectorRequired {
+			allErrs = append(allErrs, field.Required(selectorPath, "selector matchLabels are required"))
+		}
+		return allErrs
+	}
+	// 模板没有写标签时由控制器补全；写了就必须和 selector 一致，否则 Deployment 选不中自己的 pod
+	templateLabels := workload.Template.Labels
+	if len(templateLabels) == 0 {
+		return allErrs
+	}
+	for k, v := range workload.Selector.MatchLabels {
+		if templateLabels[k] != v {
+			allErrs = append(allErrs, field.Invalid(selectorPath.Key(k), v,
+				"selector does not match template labels"))
+		}
+	}
+	return allErrs
+}
+
+// validateService 校验 Service 的端口和类型组合
+func validateService(fldPath *field.Path, service *appsv1.ServiceTemplate, workload *appsv1.DeploymentTemplate) field.ErrorList {
+	var allErrs field.ErrorList
+	spec := &service.ServiceSpec
+	headless := spec.ClusterIP == corev1.ClusterIPNone
+
+	serviceType := spec.Type
+	if serviceType == "" {
+		serviceType = corev1.ServiceTypeClusterIP
+	}
+	exposed := serviceType == corev1.ServiceTypeNodePort || serviceType == corev1.ServiceTypeLoadBalancer
+
+	switch {
+	case serviceType == corev1.ServiceTypeExternalName:
+		if spec.ExternalName == "" {
+			allErrs = append(allErrs, field.Required(fldPath.Child("externalName"), "required for type ExternalName"))
+		}
+	case spec.ExternalName != "":
+		allErrs = append(allErrs, field.Forbidden(fldPath.Child("externalName"), "may only be set for type ExternalName"))
+	}
+	if headless && exposed {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("clusterIP"), spec.ClusterIP,
+			fmt.Sprintf("headless service cannot be of type %s", serviceType)))
+	}
+	if serviceType != corev1.ServiceTypeLoadBalancer {
+		if spec.LoadBalancerIP != "" {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("loadBalancerIP"), "may only be set for type LoadBalancer"))
+		}
+		if len(spec.LoadBalancerSourceRanges) > 0 {
+			allErrs = append(allErrs, field.Forbidden(fldPath.Child("loadBalancerSourceRanges"), "may only be set for type LoadBalancer"))
+		}
+	}
+	if !exposed && spec.ExternalTrafficPolicy != "" {
+		allErrs = append(allErrs, field.Forbidden(fldPath.Child("externalTrafficPolicy"), "may only be set for type NodePort or LoadBalancer"))
+	}
+
+	portsPath := fldPath.Child("ports")
+	if serviceType != corev1.ServiceTypeExternalName && !headless && len(spec.Ports) == 0 {
+		allErrs = append(allErrs, field.Required(portsPath, "at least one port is required"))
+	}
+
+	// 收集容器声明的端口，Service 的 targetPort 必须引用其中之一
+	containerPorts := sets.New[int32]()
+	portNames := sets.New[string]()
+	for _, c := range workload.Template.Spec.Containers {
+		for _, p := range c.Ports {
+			containerPorts.Insert(p.ContainerPort)
+			if p.Name != "" {
+				portNames.Insert(p.Name)
+			}
+		}
+	}
+	for i, port := range spec.Ports {
+		idxPath := portsPath.Index(i)
+		if port.NodePort != 0 && !exposed {
+			allErrs = append(allErrs, field.Forbidden(idxPath.Child("nodePort"), "may only be set for type NodePort or LoadBalancer"))
+		}
+		if serviceType == corev1.ServiceTypeExternalName {
+			continue
+		}
+		target := port.TargetPort
+		if target.Type == intstr.Int && target.IntVal == 0 {
+			target = intstr.FromInt32(port.Port)
+		}
+		switch target.Type {
+		case intstr.String:
+			if !portNames.Has(target.StrVal) {
+				allErrs = append(allErrs, field.Invalid(idxPath.Child("targetPort"), target.StrVal,
+					"must reference a named container port"))
+			}
+		default:
+			if !containerPorts.Has(target.IntVal) {
+				allErrs = append(allErrs, field.Invalid(idxPath.Child("targetPort"), target.IntVal,
+					"must reference a declared container port"))
+			}
+		}
+	}
+	return allErrs
+}
@@ -0,0 +1,116 @@
+package v1
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	appsv1 "github.com/aloys.zy/aloys-application-operator-webhook/api/v1"
+)
+
+const (
+	// LabelEnvironment namespace 上标记环境的标签，值为 production 时单副本会提示 warning
+	LabelEnvironment = "apps.aloys.cn/environment"
+	// EnvironmentProduction 生产环境
+	EnvironmentProduction = "production"
+)
+
+// applicationWarnings 收集 SRE 希望提示但不拦截的配置
+func applicationWarnings(application *appsv1.Application, ns *corev1.Namespace) admission.Warnings {
+	var warnings admission.Warnings
+	production := ns != nil && ns.Labels[LabelEnvironment] == EnvironmentProduction
+	specPath := field.NewPath("spec")
+
+	if hasDefaultWorkload(application) {
+		warnings = append(warnings, workloadWarnings(specPath.Child("deployment"), &application.Spec.Deployment, production)...)
+		warnings = append(warnings, serviceWarnings(specPath.Child("service"), &application.Spec.Service)...)
+	}
+	for i := range application.Spec.Components {
+		component := &application.Spec.Components[i]
+		idxPath := specPath.Child("components").Index(i)
+		warnings = append(warnings, workloadWarnings(idxPath.Child("deployment"), &component.Deployment, production)...)
+		if component.Service != nil {
+			warnings = append(warnings, serviceWarnings(idxPath.Child("service"), component.Service)...)
+		}
+	}
+	return warnings
+}
+
+func workloadWarnings(fldPath *field.Path, workload *appsv1.DeploymentTemplate, production bool) admission.Warnings {
+	var warnings admission.Warnings
+	if production && workload.Replicas != nil && *workload.Replicas == 1 {
+		warnings = append(warnings, fmt.Sprintf("%s: a single replica in a production namespace has no redundancy", fldPath.Child("replicas")))
+	}
+
+	podSpec := &workload.Template.Spec
+	containersPath := fldPath.Child("template", "spec", "containers")
+	for i := range podSpec.Containers {
+		c := &podSpec.Containers[i]
+		idxPath := containersPath.Index(i)
+		if warning := imageTagWarning(idxPath.Child("image"), c.Image); warning != "" {
+			warnings = append(warnings, warning)
+		}
+		if len(c.Resources.Requests) == 0 {
+			warnings = append(warnings, fmt.Sprintf("%s: container %q has no resource requests", idxPath.Child("resources", "requests"), c.Name))
+		}
+		if len(c.Resources.Limits) == 0 {
+			warnings = append(warnings, fmt.Sprintf("%s: container %q has no resource limits", idxPath.Child("resources", "limits"), c.Name))
+		}
+		if c.ReadinessProbe == nil {
+			warnings = append(warnings, fmt.Sprintf("%s: container %q has no readiness probe", idxPath.Child("readinessProbe"), c.Name))
+		}
+		if isPrivileged(c) {
+			warnings = append(warnings, fmt.Sprintf("%s: container %q runs privileged", idxPath.Child("securityContext", "privileged"), c.Name))
+		}
+	}
+	initContainersPath := fldPath.Child("template", "spec", "initContainers")
+	for i := range podSpec.InitContainers {
+		c := &podSpec.InitContainers[i]
+		if isPrivileged(c) {
+			warnings = append(warnings, fmt.Sprintf("%s: init container %q runs privileged", initContainersPath.Index(i).Child("securityContext", "privileged"), c.Name))
+		}
+	}
+	return warnings
+}
+
+func serviceWarnings(fldPath *field.Path, service *appsv1.ServiceTemplate) admission.Warnings {
+	switch service.Type {
+	case corev1.ServiceTypeNodePort, corev1.ServiceTypeLoadBalancer:
+		return admission.Warnings{fmt.Sprintf("%s: service type %s exposes the application outside the cluster", fldPath.Child("type"), service.Type)}
+	}
+	return nil
+}
+
+// imageTagWarning 镜像没有 tag 或者使用 latest 时返回 warning，使用 digest 的镜像不提示
+func imageTagWarning(fldPath *field.Path, image string) string {
+	if image == "" || strings.Contains(image, "@") {
+		return ""
+	}
+	tag := imageTag(image)
+	switch tag {
+	case "":
+		return fmt.Sprintf("%s: image %q has no tag and resolves to :latest", fldPath, image)
+	case "latest":
+		return fmt.Sprintf("%s: image %q uses the mutable :latest tag", fldPath, image)
+	}
+	return ""
+}
+
+// imageTag 返回镜像的 tag，registry 中的端口号不算 tag
+func imageTag(image string) string {
+	name := image
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.LastIndex(name, ":"); i >= 0 {
+		return name[i+1:]
+	}
+	return ""
+}
+
+func isPrivileged(c *corev1.Container) bool {
+	return c.SecurityContext != nil && c.SecurityContext.Privileged != nil && *c.SecurityContext.Privileged
+}